@@ -0,0 +1,601 @@
+package main
+
+import (
+	"bufio"
+	"chat-app/internal/accounts"
+	"chat-app/internal/audit"
+	"chat-app/internal/broker"
+	"chat-app/internal/chats"
+	"chat-app/internal/config"
+	"chat-app/internal/handlers"
+	"chat-app/internal/password"
+	"chat-app/internal/protocol"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const usage = `Usage: chat-app <command> [flags]
+
+Commands:
+  serve                      Start the HTTP server (default)
+  migrate                    Create or upgrade the database schema
+  user create                Create a user
+  user list                  List users
+  user reset-password        Set a new password for a user
+  user suspend               Suspend a user
+  user unsuspend             Lift a suspension
+  user set-role              Change a user's role
+  user unlock                Clear a login lockout (database login store only)
+  chat list                  List chats
+  purge                      Delete expired and old data
+  export                     Export users, chats and messages as JSON lines
+  audit verify               Check the audit log hash chain
+  protocol schema            Print the WebSocket protocol schema as JSON
+  broker check               Check the configured broker delivers messages
+
+Run "chat-app <command> -h" for the flags of a command.
+`
+
+var errUsage = errors.New("invalid command, run \"chat-app help\" for usage")
+
+// runCommand dispatches to a subcommand. Every command except help uses the
+// same database setup as the server.
+func runCommand(args []string) error {
+	switch args[0] {
+	case "serve":
+		fs := flag.NewFlagSet("serve", flag.ExitOnError)
+		port := fs.Int("port", 8000, "port to listen on")
+		fs.Parse(args[1:])
+		serve(*port)
+		return nil
+	case "migrate":
+		config.InitDB()
+		defer config.DB.Close()
+		fmt.Println("Database schema is up to date")
+		return nil
+	case "user":
+		if len(args) < 2 {
+			return errUsage
+		}
+		return runUserCommand(args[1], args[2:])
+	case "chat":
+		if len(args) < 2 || args[1] != "list" {
+			return errUsage
+		}
+		return chatList(args[2:])
+	case "purge":
+		return purge(args[1:])
+	case "export":
+		return export(args[1:])
+	case "audit":
+		if len(args) < 2 || args[1] != "verify" {
+			return errUsage
+		}
+		return auditVerify(args[2:])
+	case "protocol":
+		if len(args) < 2 {
+			return errUsage
+		}
+		switch args[1] {
+		case "schema":
+			return protocolSchema()
+		}
+		return errUsage
+	case "broker":
+		if len(args) < 2 || args[1] != "check" {
+			return errUsage
+		}
+		return brokerCheck(args[2:])
+	case "help", "-h", "--help":
+		fmt.Print(usage)
+		return nil
+	}
+	return errUsage
+}
+
+func runUserCommand(name string, args []string) error {
+	switch name {
+	case "create":
+		return userCreate(args)
+	case "list":
+		return userList(args)
+	case "reset-password":
+		return userResetPassword(args)
+	case "suspend", "unsuspend", "unlock":
+		return userAction(name, args)
+	case "set-role":
+		return userSetRole(args)
+	}
+	return errUsage
+}
+
+func userCreate(args []string) error {
+	fs := flag.NewFlagSet("user create", flag.ExitOnError)
+	username := fs.String("username", "", "username (required)")
+	email := fs.String("email", "", "email (required)")
+	role := fs.String("role", accounts.RoleUser, "role: user, moderator or admin")
+	fs.Parse(args)
+
+	if *username == "" || *email == "" {
+		return errors.New("--username and --email are required")
+	}
+
+	plaintext, err := readPassword()
+	if err != nil {
+		return err
+	}
+	if err := password.Validate(plaintext, *username, *email); err != nil {
+		return err
+	}
+
+	config.InitDB()
+	defer config.DB.Close()
+
+	hashed, err := password.Hash(plaintext)
+	if err != nil {
+		return err
+	}
+
+	userID, err := accounts.Create(*username, *email, hashed, *role)
+	if err != nil {
+		return err
+	}
+	recordCLIAudit(audit.UserRegistered, userID, map[string]interface{}{"email": *email, "role": *role})
+
+	fmt.Printf("Created user %s\n", userID)
+	return nil
+}
+
+func userList(args []string) error {
+	fs := flag.NewFlagSet("user list", flag.ExitOnError)
+	limit := fs.Int("limit", 100, "maximum number of users")
+	offset := fs.Int("offset", 0, "number of users to skip")
+	fs.Parse(args)
+
+	config.InitDB()
+	defer config.DB.Close()
+
+	users, err := accounts.List(*limit, *offset)
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tUSERNAME\tEMAIL\tROLE\tONLINE\tSUSPENDED\tCREATED")
+	for _, u := range users {
+		suspended := ""
+		if u.SuspendedAt != nil {
+			suspended = u.SuspendedAt.Format(time.RFC3339)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%t\t%s\t%s\n",
+			u.ID, u.Username, u.Email, u.Role, u.IsOnline, suspended, u.CreatedAt.Format(time.RFC3339))
+	}
+	return tw.Flush()
+}
+
+func userResetPassword(args []string) error {
+	fs := flag.NewFlagSet("user reset-password", flag.ExitOnError)
+	email := fs.String("email", "", "email of the user (required)")
+	fs.Parse(args)
+
+	if *email == "" {
+		return errors.New("--email is required")
+	}
+
+	plaintext, err := readPassword()
+	if err != nil {
+		return err
+	}
+
+	config.InitDB()
+	defer config.DB.Close()
+
+	userID, err := accounts.FindByEmail(*email)
+	if err != nil {
+		return err
+	}
+
+	var username string
+	if err := config.DB.QueryRow("SELECT username FROM users WHERE id = ?", userID).Scan(&username); err != nil {
+		return err
+	}
+	if err := password.Validate(plaintext, username, *email); err != nil {
+		return err
+	}
+
+	hashed, err := password.Hash(plaintext)
+	if err != nil {
+		return err
+	}
+	if err := accounts.SetPassword(userID, hashed); err != nil {
+		return err
+	}
+	recordCLIAudit(audit.PasswordReset, userID, nil)
+
+	fmt.Printf("Password reset for %s\n", *email)
+	return nil
+}
+
+func userAction(name string, args []string) error {
+	fs := flag.NewFlagSet("user "+name, flag.ExitOnError)
+	email := fs.String("email", "", "email of the user (required)")
+	fs.Parse(args)
+
+	*email = strings.TrimSpace(*email)
+	if *email == "" {
+		return errors.New("--email is required")
+	}
+	// Only counters kept in the database can be cleared from here; the
+	// in-memory store belongs to the running server
+	if name == "unlock" && config.LoginAttemptStore != "database" {
+		return fmt.Errorf("login counters are kept in the server's memory (LoginAttemptStore = %q) and can't be cleared from here; a lockout ends on its own after %s", config.LoginAttemptStore, config.LoginLockoutDuration)
+	}
+
+	config.InitDB()
+	defer config.DB.Close()
+
+	userID, err := accounts.FindByEmail(*email)
+	if err != nil {
+		return err
+	}
+
+	var events []string
+	var note string
+	switch name {
+	case "suspend":
+		// Servers check suspension on every request, so existing sessions
+		// stop working at once. Open WebSocket connections can only be
+		// closed through a broker the server shares.
+		err = accounts.Suspend(userID)
+		events = []string{audit.UserSuspended, audit.TokensRevoked}
+		if config.BrokerURL == "" {
+			note = "WebSocket connections already open stay open until they reconnect, as no BrokerURL is set"
+		}
+	case "unsuspend":
+		err = accounts.Unsuspend(userID)
+		events = []string{audit.UserUnsuspended}
+	case "unlock":
+		// The server's own tracker builds the key, normalizing the email
+		// the same way as at login
+		handlers.InitLoginGuard()
+		err = handlers.UnlockLogin(*email)
+		events = []string{audit.LoginUnlocked}
+	}
+	if err != nil {
+		return err
+	}
+	for _, event := range events {
+		recordCLIAudit(event, userID, nil)
+	}
+
+	fmt.Printf("%s: done for %s\n", name, *email)
+	if note != "" {
+		fmt.Println("Note: " + note)
+	}
+	return nil
+}
+
+func userSetRole(args []string) error {
+	fs := flag.NewFlagSet("user set-role", flag.ExitOnError)
+	email := fs.String("email", "", "email of the user (required)")
+	role := fs.String("role", "", "role: user, moderator or admin (required)")
+	fs.Parse(args)
+
+	if *email == "" || *role == "" {
+		return errors.New("--email and --role are required")
+	}
+
+	config.InitDB()
+	defer config.DB.Close()
+
+	userID, err := accounts.FindByEmail(*email)
+	if err != nil {
+		return err
+	}
+	if err := accounts.SetRole(userID, *role); err != nil {
+		return err
+	}
+	recordCLIAudit(audit.UserRoleChanged, userID, map[string]interface{}{"role": *role})
+
+	fmt.Printf("%s is now %s\n", *email, *role)
+	return nil
+}
+
+func chatList(args []string) error {
+	fs := flag.NewFlagSet("chat list", flag.ExitOnError)
+	limit := fs.Int("limit", 100, "maximum number of chats")
+	offset := fs.Int("offset", 0, "number of chats to skip")
+	fs.Parse(args)
+
+	config.InitDB()
+	defer config.DB.Close()
+
+	list, err := chats.ListMetadata(*limit, *offset)
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tNAME\tGROUP\tPARTICIPANTS\tMESSAGES\tLAST MESSAGE\tCREATED")
+	for _, c := range list {
+		lastMessage := ""
+		if c.LastMessageAt != nil {
+			lastMessage = c.LastMessageAt.Format(time.RFC3339)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%t\t%d\t%d\t%s\t%s\n",
+			c.ID, c.Name, c.IsGroup, c.ParticipantCount, c.MessageCount, lastMessage, c.CreatedAt.Format(time.RFC3339))
+	}
+	return tw.Flush()
+}
+
+// purgeStep deletes the rows of table matching where
+type purgeStep struct {
+	name  string
+	table string
+	where string
+	args  []interface{}
+}
+
+// purge deletes data nothing needs any more: accounts past their deletion
+// grace period, used recovery codes, expired login counters and idle rate
+// limit buckets. Old messages are only deleted
+// when --messages-older-than is given.
+func purge(args []string) error {
+	fs := flag.NewFlagSet("purge", flag.ExitOnError)
+	messagesOlderThan := fs.Duration("messages-older-than", 0, "also delete messages older than this, e.g. 8760h")
+	dryRun := fs.Bool("dry-run", false, "report what would be deleted without deleting")
+	fs.Parse(args)
+
+	config.InitDB()
+	defer config.DB.Close()
+
+	now := time.Now()
+	steps := []purgeStep{
+		{"used recovery codes", "recovery_codes", "used_at IS NOT NULL", nil},
+		{"expired login counters", "login_attempts",
+			"last_failure < ? AND (locked_until IS NULL OR locked_until < ?)",
+			[]interface{}{now.Add(-config.LoginFailureWindow), now}},
+		{"idle rate limit buckets", "rate_limits", "updated_at < ?", []interface{}{now.Add(-time.Hour)}},
+	}
+	if *messagesOlderThan > 0 {
+		// created_at is set with NOW(), so the database computes the cutoff
+		steps = append(steps, purgeStep{"old messages", "messages", "created_at < NOW() - INTERVAL ? SECOND",
+			[]interface{}{int64(*messagesOlderThan / time.Second)}})
+	}
+
+	if *dryRun {
+		var count int
+		err := config.DB.QueryRow(`
+			SELECT COUNT(*) FROM users WHERE deleted_at IS NULL AND deletion_scheduled_at <= ?
+		`, now).Scan(&count)
+		if err != nil {
+			return fmt.Errorf("accounts due for deletion: %v", err)
+		}
+		fmt.Printf("accounts due for deletion: %d\n", count)
+	} else {
+		deleted, err := accounts.DeleteDue()
+		for _, userID := range deleted {
+			recordCLIAudit(audit.UserDeleted, userID, map[string]interface{}{"reason": "requested"})
+		}
+		if err != nil {
+			return fmt.Errorf("accounts due for deletion: %v", err)
+		}
+		fmt.Printf("accounts due for deletion: %d\n", len(deleted))
+	}
+
+	for _, step := range steps {
+		var count int64
+		if *dryRun {
+			err := config.DB.QueryRow("SELECT COUNT(*) FROM "+step.table+" WHERE "+step.where, step.args...).Scan(&count)
+			if err != nil {
+				return fmt.Errorf("%s: %v", step.name, err)
+			}
+		} else {
+			res, err := config.DB.Exec("DELETE FROM "+step.table+" WHERE "+step.where, step.args...)
+			if err != nil {
+				return fmt.Errorf("%s: %v", step.name, err)
+			}
+			count, _ = res.RowsAffected()
+			if step.table == "messages" && count > 0 {
+				recordCLIAudit(audit.MessagesPurged, "", map[string]interface{}{
+					"count":     count,
+					"olderThan": messagesOlderThan.String(),
+				})
+			}
+		}
+		fmt.Printf("%s: %d\n", step.name, count)
+	}
+	return nil
+}
+
+// auditVerify checks the audit log hash chain and fails if it is broken
+func auditVerify(args []string) error {
+	fs := flag.NewFlagSet("audit verify", flag.ExitOnError)
+	fs.Parse(args)
+
+	config.InitDB()
+	defer config.DB.Close()
+
+	result, err := audit.Verify()
+	if err != nil {
+		return err
+	}
+	if !result.Valid {
+		return fmt.Errorf("audit log broken at entry %d: %s", result.BrokenAt, result.Problem)
+	}
+
+	fmt.Printf("%d entries, chain intact, last hash %s\n", result.Entries, result.LastHash)
+	return nil
+}
+
+// recordCLIAudit audits a change made from the command line. There is no
+// acting user, so the source is noted instead.
+func recordCLIAudit(eventType, targetID string, details map[string]interface{}) {
+	if details == nil {
+		details = map[string]interface{}{}
+	}
+	details["source"] = "cli"
+
+	err := audit.Record(audit.Event{Type: eventType, TargetID: targetID, Details: details})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "warning: could not record audit event %s: %v\n", eventType, err)
+	}
+}
+
+// export writes every user, chat, participant and message as one JSON object
+// per line, tagged with its kind. Password hashes and two-factor secrets are
+// never exported.
+func export(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	out := fs.String("out", "-", "file to write to, - for stdout")
+	fs.Parse(args)
+
+	var w io.Writer = os.Stdout
+	if *out != "-" {
+		file, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
+	}
+	buffered := bufio.NewWriter(w)
+	defer buffered.Flush()
+	encoder := json.NewEncoder(buffered)
+
+	config.InitDB()
+	defer config.DB.Close()
+
+	queries := []struct {
+		kind  string
+		query string
+	}{
+		{"user", `SELECT id, username, email, COALESCE(avatar, ''), role, created_at FROM users ORDER BY created_at`},
+		{"chat", `SELECT id, COALESCE(name, ''), is_group, created_at FROM chats ORDER BY created_at`},
+		{"participant", `SELECT chat_id, user_id, joined_at FROM chat_participants ORDER BY joined_at`},
+		{"message", `SELECT id, chat_id, sender_id, content, is_read, created_at FROM messages ORDER BY created_at`},
+	}
+	columns := map[string][]string{
+		"user":        {"id", "username", "email", "avatar", "role", "createdAt"},
+		"chat":        {"id", "name", "isGroup", "createdAt"},
+		"participant": {"chatId", "userId", "joinedAt"},
+		"message":     {"id", "chatId", "senderId", "content", "isRead", "timestamp"},
+	}
+
+	for _, q := range queries {
+		rows, err := config.DB.Query(q.query)
+		if err != nil {
+			return fmt.Errorf("exporting %ss: %v", q.kind, err)
+		}
+
+		names := columns[q.kind]
+		for rows.Next() {
+			values := make([]interface{}, len(names))
+			pointers := make([]interface{}, len(names))
+			for i := range values {
+				pointers[i] = &values[i]
+			}
+			if err := rows.Scan(pointers...); err != nil {
+				rows.Close()
+				return fmt.Errorf("exporting %ss: %v", q.kind, err)
+			}
+
+			record := map[string]interface{}{"kind": q.kind}
+			for i, name := range names {
+				// The driver returns text columns as []byte
+				if b, ok := values[i].([]byte); ok {
+					values[i] = string(b)
+				}
+				record[name] = values[i]
+			}
+			if err := encoder.Encode(record); err != nil {
+				rows.Close()
+				return err
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("exporting %ss: %v", q.kind, err)
+		}
+	}
+	return nil
+}
+
+// readPassword reads a password from the first line of stdin so it doesn't
+// end up in shell history or the process list
+func readPassword() (string, error) {
+	fmt.Fprint(os.Stderr, "Password: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if line == "" {
+		return "", errors.New("password is required")
+	}
+	return line, nil
+}
+
+// protocolSchema prints the WebSocket protocol schema. It needs no database.
+func protocolSchema() error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(protocol.Schema())
+}
+
+// brokerCheck publishes a message through the configured broker and waits
+// for it to come back, e.g. to try a local Redis before deploying
+func brokerCheck(args []string) error {
+	fs := flag.NewFlagSet("broker check", flag.ExitOnError)
+	url := fs.String("url", config.BrokerURL, "broker URL, empty for in-process")
+	timeout := fs.Duration("timeout", 5*time.Second, "how long to wait for the message")
+	fs.Parse(args)
+
+	b, err := broker.New(*url)
+	if err != nil {
+		return err
+	}
+	defer b.Close()
+
+	received := make(chan []byte, 1)
+	topic := "chat-app:check:" + uuid.New().String()
+	unsubscribe, err := b.Subscribe(topic, func(msg []byte) {
+		select {
+		case received <- msg:
+		default:
+		}
+	})
+	if err != nil {
+		return err
+	}
+	defer unsubscribe()
+
+	// Subscriptions to a remote broker take effect asynchronously, so keep
+	// publishing until the message arrives
+	started := time.Now()
+	deadline := time.After(*timeout)
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		if err := b.Publish(topic, []byte("ping")); err != nil {
+			return err
+		}
+		select {
+		case <-received:
+			fmt.Printf("Broker OK, message received after %v\n", time.Since(started).Round(time.Millisecond))
+			return nil
+		case <-deadline:
+			return fmt.Errorf("no message received within %v", *timeout)
+		case <-ticker.C:
+		}
+	}
+}
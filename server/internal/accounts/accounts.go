@@ -0,0 +1,301 @@
+package accounts
+
+import (
+	"chat-app/internal/config"
+	"chat-app/internal/hub"
+	"chat-app/internal/models"
+	"chat-app/internal/store"
+	"database/sql"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Roles, from least to most privileged
+const (
+	RoleUser      = "user"
+	RoleModerator = "moderator"
+	RoleAdmin     = "admin"
+)
+
+var (
+	ErrNotFound    = errors.New("user not found")
+	ErrInvalidRole = errors.New("invalid role")
+	ErrEmailTaken  = errors.New("email is already in use")
+)
+
+// ValidRole reports whether role is one of the known roles
+func ValidRole(role string) bool {
+	return role == RoleUser || role == RoleModerator || role == RoleAdmin
+}
+
+// Create adds a user with an already hashed password and returns its ID
+func Create(username, email, passwordHash, role string) (string, error) {
+	if !ValidRole(role) {
+		return "", ErrInvalidRole
+	}
+
+	var count int
+	if err := config.DB.QueryRow("SELECT COUNT(*) FROM users WHERE email = ?", email).Scan(&count); err != nil {
+		return "", err
+	}
+	if count > 0 {
+		return "", ErrEmailTaken
+	}
+
+	userID := uuid.New().String()
+	_, err := config.DB.Exec(`
+		INSERT INTO users (id, username, email, password, role, is_online, last_seen, created_at)
+		VALUES (?, ?, ?, ?, ?, false, NOW(), NOW())
+	`, userID, username, email, passwordHash, role)
+	if err != nil {
+		return "", err
+	}
+	return userID, nil
+}
+
+// FindByEmail returns the ID of the user with the given email
+func FindByEmail(email string) (string, error) {
+	var userID string
+	err := config.DB.QueryRow("SELECT id FROM users WHERE email = ?", email).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return "", ErrNotFound
+	}
+	return userID, err
+}
+
+// SetPassword stores a new password hash for a user
+func SetPassword(userID, passwordHash string) error {
+	return exec("UPDATE users SET password = ? WHERE id = ?", passwordHash, userID)
+}
+
+// List returns users ordered by creation date, including role and
+// suspension state
+func List(limit, offset int) ([]models.User, error) {
+	rows, err := config.DB.Query(`
+		SELECT id, username, email, avatar, role, is_online, last_seen, created_at, suspended_at
+		FROM users
+		ORDER BY created_at
+		LIMIT ? OFFSET ?
+	`, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []models.User{}
+	for rows.Next() {
+		var user models.User
+		var avatar sql.NullString
+		var suspendedAt sql.NullTime
+
+		err := rows.Scan(
+			&user.ID, &user.Username, &user.Email, &avatar, &user.Role,
+			&user.IsOnline, &user.LastSeen, &user.CreatedAt, &suspendedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		if avatar.Valid {
+			user.Avatar = avatar.String
+		}
+		if suspendedAt.Valid {
+			user.SuspendedAt = &suspendedAt.Time
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+// SetRole changes a user's role. middleware.Auth reads the role on every
+// request, so it applies on every instance at once.
+func SetRole(userID, role string) error {
+	if !ValidRole(role) {
+		return ErrInvalidRole
+	}
+	if err := exec("UPDATE users SET role = ? WHERE id = ?", role, userID); err != nil {
+		return err
+	}
+	store.RemoveUser(userID)
+	return nil
+}
+
+// Suspend blocks a user from logging in or using existing sessions, which
+// middleware.Auth checks on every request, and closes their WebSocket
+// connection
+func Suspend(userID string) error {
+	err := exec(`
+		UPDATE users SET suspended_at = COALESCE(suspended_at, NOW()), is_online = false WHERE id = ?
+	`, userID)
+	if err != nil {
+		return err
+	}
+	store.RemoveUser(userID)
+	hub.Disconnect(userID)
+	return nil
+}
+
+// Unsuspend lets a suspended user log in again
+func Unsuspend(userID string) error {
+	if err := exec("UPDATE users SET suspended_at = NULL WHERE id = ?", userID); err != nil {
+		return err
+	}
+	store.RemoveUser(userID)
+	return nil
+}
+
+// DeletedUsername replaces the name of deleted users, whose messages stay in
+// their chats
+const DeletedUsername = "Deleted user"
+
+// RequestDeletion schedules a user's account for deletion once
+// config.AccountDeletionGracePeriod has passed and returns when that will
+// be. Asking again keeps the original date.
+func RequestDeletion(userID string) (time.Time, error) {
+	err := exec(`
+		UPDATE users SET deletion_scheduled_at = COALESCE(deletion_scheduled_at, ?)
+		WHERE id = ? AND deleted_at IS NULL
+	`, time.Now().Add(config.AccountDeletionGracePeriod), userID)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	var scheduledAt time.Time
+	err = config.DB.QueryRow("SELECT deletion_scheduled_at FROM users WHERE id = ?", userID).Scan(&scheduledAt)
+	return scheduledAt, err
+}
+
+// CancelDeletion keeps an account scheduled for deletion
+func CancelDeletion(userID string) error {
+	return exec("UPDATE users SET deletion_scheduled_at = NULL WHERE id = ? AND deleted_at IS NULL", userID)
+}
+
+// Delete anonymizes a user and disconnects them. The row is kept, renamed
+// to DeletedUsername and stripped of personal data, so the user's messages
+// stay in other people's chats instead of cascading away with it.
+func Delete(userID string) error {
+	tx, err := config.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`
+		UPDATE users SET
+			username = ?, email = CONCAT('deleted-', id, '@deleted.invalid'), password = '',
+			avatar = NULL, display_name = NULL, bio = NULL, status_text = NULL, totp_secret = NULL, totp_enabled = false, totp_last_step = 0,
+			role = ?, suspended_at = NULL, is_online = false,
+			deletion_scheduled_at = NULL, deleted_at = NOW()
+		WHERE id = ? AND deleted_at IS NULL
+	`, DeletedUsername, RoleUser, userID)
+	if err != nil {
+		return err
+	}
+	if affected, _ := res.RowsAffected(); affected == 0 {
+		return ErrNotFound
+	}
+
+	for _, query := range []string{
+		"DELETE FROM recovery_codes WHERE user_id = ?",
+		"DELETE FROM user_identities WHERE user_id = ?",
+		"DELETE FROM user_warnings WHERE user_id = ?",
+		"DELETE FROM email_verifications WHERE user_id = ?",
+		"DELETE FROM blocks WHERE blocker_id = ?",
+		"DELETE FROM blocks WHERE blocked_id = ?",
+	} {
+		if _, err := tx.Exec(query, userID); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	// Uploaded avatars are personal data too
+	if files, err := filepath.Glob(filepath.Join(config.AvatarDir, userID+"-*.jpg")); err == nil {
+		for _, f := range files {
+			os.Remove(f)
+		}
+	}
+
+	store.RemoveUser(userID)
+	hub.Disconnect(userID)
+	return nil
+}
+
+// DeleteDue deletes every account whose grace period has run out and returns
+// their IDs. IDs deleted before an error are returned along with it.
+func DeleteDue() ([]string, error) {
+	rows, err := config.DB.Query(`
+		SELECT id FROM users WHERE deleted_at IS NULL AND deletion_scheduled_at <= ?
+	`, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	var due []string
+	for rows.Next() {
+		var userID string
+		if err := rows.Scan(&userID); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		due = append(due, userID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	deleted := []string{}
+	for _, userID := range due {
+		if err := Delete(userID); err != nil && err != ErrNotFound {
+			return deleted, err
+		}
+		deleted = append(deleted, userID)
+	}
+	return deleted, nil
+}
+
+// IsSuspended reports whether a user is currently suspended
+func IsSuspended(userID string) (bool, error) {
+	var suspendedAt sql.NullTime
+	err := config.DB.QueryRow("SELECT suspended_at FROM users WHERE id = ?", userID).Scan(&suspendedAt)
+	if err == sql.ErrNoRows {
+		return false, ErrNotFound
+	}
+	if err != nil {
+		return false, err
+	}
+	return suspendedAt.Valid, nil
+}
+
+// exec runs a statement against a single user row and maps a missing row to
+// ErrNotFound
+func exec(query string, args ...interface{}) error {
+	res, err := config.DB.Exec(query, args...)
+	if err != nil {
+		return err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		// MySQL reports rows changed, not rows matched, so confirm the user
+		// exists before calling it missing
+		var count int
+		if err := config.DB.QueryRow("SELECT COUNT(*) FROM users WHERE id = ?", args[len(args)-1]).Scan(&count); err != nil {
+			return err
+		}
+		if count == 0 {
+			return ErrNotFound
+		}
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+// Package broker carries events between server instances so every instance
+// can deliver to the users connected to it
+package broker
+
+import (
+	"fmt"
+	"net/url"
+)
+
+// Broker publishes messages to topics and delivers them to every
+// subscriber of the topic, on any instance sharing the broker
+type Broker interface {
+	// Publish sends msg to the topic's subscribers
+	Publish(topic string, msg []byte) error
+
+	// Subscribe calls handler for every message published to topic until
+	// the returned function is called. Handlers must not block.
+	Subscribe(topic string, handler func(msg []byte)) (unsubscribe func(), err error)
+
+	Close() error
+}
+
+// New returns the broker for rawURL: the in-process broker when it is
+// empty, or a Redis broker for redis:// URLs
+func New(rawURL string) (Broker, error) {
+	if rawURL == "" {
+		return NewMemory(), nil
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "redis":
+		return NewRedis(u)
+	}
+	return nil, fmt.Errorf("unsupported broker %q", u.Scheme)
+}
+
+// subscriptions keeps the handlers of each topic. Callers hold their own
+// lock around it.
+type subscriptions struct {
+	handlers map[string]map[int]func([]byte)
+	nextID   int
+}
+
+func newSubscriptions() subscriptions {
+	return subscriptions{handlers: make(map[string]map[int]func([]byte))}
+}
+
+// add registers a handler and reports whether it is the topic's first
+func (s *subscriptions) add(topic string, handler func([]byte)) (int, bool) {
+	s.nextID++
+	first := len(s.handlers[topic]) == 0
+	if first {
+		s.handlers[topic] = make(map[int]func([]byte))
+	}
+	s.handlers[topic][s.nextID] = handler
+	return s.nextID, first
+}
+
+// remove drops a handler and reports whether it was the topic's last
+func (s *subscriptions) remove(topic string, id int) bool {
+	handlers, ok := s.handlers[topic]
+	if !ok {
+		return false
+	}
+	if _, ok := handlers[id]; !ok {
+		return false
+	}
+	delete(handlers, id)
+	if len(handlers) > 0 {
+		return false
+	}
+	delete(s.handlers, topic)
+	return true
+}
+
+// get copies the topic's handlers so they can be called without the lock
+func (s *subscriptions) get(topic string) []func([]byte) {
+	handlers := make([]func([]byte), 0, len(s.handlers[topic]))
+	for _, h := range s.handlers[topic] {
+		handlers = append(handlers, h)
+	}
+	return handlers
+}
+
+func (s *subscriptions) topics() []string {
+	topics := make([]string, 0, len(s.handlers))
+	for topic := range s.handlers {
+		topics = append(topics, topic)
+	}
+	return topics
+}
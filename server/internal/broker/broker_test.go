@@ -0,0 +1,130 @@
+package broker
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestNew(t *testing.T) {
+	b, err := New("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := b.(*Memory); !ok {
+		t.Errorf("New(\"\") = %T, want *Memory", b)
+	}
+
+	if _, err := New("nats://localhost:4222"); err == nil {
+		t.Error("New accepted an unsupported scheme")
+	}
+}
+
+func TestMemoryPublish(t *testing.T) {
+	m := NewMemory()
+	defer m.Close()
+
+	var first, second, other []string
+	m.Subscribe("chat:1", func(msg []byte) { first = append(first, string(msg)) })
+	m.Subscribe("chat:1", func(msg []byte) { second = append(second, string(msg)) })
+	m.Subscribe("chat:2", func(msg []byte) { other = append(other, string(msg)) })
+
+	if err := m.Publish("chat:1", []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	m.Publish("chat:1", []byte("again"))
+
+	// Every subscriber of the topic gets every message, in order, by the
+	// time Publish returns
+	want := []string{"hello", "again"}
+	if !reflect.DeepEqual(first, want) || !reflect.DeepEqual(second, want) {
+		t.Errorf("subscribers got %v and %v, want %v", first, second, want)
+	}
+	if len(other) != 0 {
+		t.Errorf("a subscriber of another topic got %v", other)
+	}
+
+	// Publishing to a topic nobody subscribed to is not an error
+	if err := m.Publish("chat:3", []byte("nobody")); err != nil {
+		t.Errorf("Publish without subscribers = %v", err)
+	}
+}
+
+func TestMemoryUnsubscribe(t *testing.T) {
+	m := NewMemory()
+	defer m.Close()
+
+	var kept, dropped int
+	m.Subscribe("topic", func([]byte) { kept++ })
+	unsubscribe, err := m.Subscribe("topic", func([]byte) { dropped++ })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m.Publish("topic", nil)
+	unsubscribe()
+	// A second call is harmless
+	unsubscribe()
+	m.Publish("topic", nil)
+
+	if kept != 2 || dropped != 1 {
+		t.Errorf("handlers ran %d and %d times, want 2 and 1", kept, dropped)
+	}
+}
+
+func TestMemorySubscribeFromHandler(t *testing.T) {
+	m := NewMemory()
+	defer m.Close()
+
+	// Handlers run without the broker's lock held, so they may subscribe
+	// and unsubscribe themselves
+	var unsubscribe func()
+	calls := 0
+	unsubscribe, _ = m.Subscribe("topic", func([]byte) {
+		calls++
+		unsubscribe()
+		m.Subscribe("other", func([]byte) {})
+	})
+
+	m.Publish("topic", nil)
+	m.Publish("topic", nil)
+	if calls != 1 {
+		t.Errorf("handler ran %d times, want 1", calls)
+	}
+}
+
+func TestSubscriptions(t *testing.T) {
+	s := newSubscriptions()
+
+	a, first := s.add("topic", func([]byte) {})
+	if !first {
+		t.Error("the first handler of a topic was not reported as first")
+	}
+	b, first := s.add("topic", func([]byte) {})
+	if first || a == b {
+		t.Errorf("second add = %d, %v; want a new id and not first", b, first)
+	}
+	s.add("other", func([]byte) {})
+
+	topics := s.topics()
+	sort.Strings(topics)
+	if want := []string{"other", "topic"}; !reflect.DeepEqual(topics, want) {
+		t.Errorf("topics = %v, want %v", topics, want)
+	}
+
+	if s.remove("topic", a) {
+		t.Error("removing one of two handlers was reported as the last")
+	}
+	if s.remove("topic", a) {
+		t.Error("removing a handler twice was reported as the last")
+	}
+	if !s.remove("topic", b) {
+		t.Error("removing the last handler was not reported")
+	}
+	if s.remove("missing", 1) {
+		t.Error("removing from an unknown topic was reported as the last")
+	}
+	if got := s.get("topic"); len(got) != 0 {
+		t.Errorf("get after removing every handler = %d handlers", len(got))
+	}
+}
@@ -0,0 +1,45 @@
+package broker
+
+import "sync"
+
+// Memory delivers messages within this process only. It is enough for a
+// single server instance.
+type Memory struct {
+	mutex sync.Mutex
+	subs  subscriptions
+}
+
+func NewMemory() *Memory {
+	return &Memory{subs: newSubscriptions()}
+}
+
+// Publish calls the topic's handlers before returning
+func (m *Memory) Publish(topic string, msg []byte) error {
+	m.mutex.Lock()
+	handlers := m.subs.get(topic)
+	m.mutex.Unlock()
+
+	for _, h := range handlers {
+		h(msg)
+	}
+	return nil
+}
+
+func (m *Memory) Subscribe(topic string, handler func([]byte)) (func(), error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	id, _ := m.subs.add(topic, handler)
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			m.mutex.Lock()
+			defer m.mutex.Unlock()
+			m.subs.remove(topic, id)
+		})
+	}, nil
+}
+
+func (m *Memory) Close() error {
+	return nil
+}
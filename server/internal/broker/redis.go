@@ -0,0 +1,340 @@
+package broker
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	redisDialTimeout = 5 * time.Second
+	redisTimeout     = 5 * time.Second
+	redisMaxBackoff  = 30 * time.Second
+)
+
+var errClosed = errors.New("broker closed")
+
+// Redis shares messages between instances through Redis pub/sub. Publishing
+// uses one connection and subscriptions another, which is reconnected with
+// backoff and resubscribed if it drops. Messages published while it is down
+// are lost, as with any pub/sub.
+type Redis struct {
+	addr     string
+	password string
+
+	// pubMutex serialises commands on the publish connection
+	pubMutex sync.Mutex
+	pub      *redisConn
+
+	// mutex guards the handlers and the subscribe connection, which
+	// writes SUBSCRIBE and UNSUBSCRIBE while run reads from it
+	mutex  sync.Mutex
+	subs   subscriptions
+	sub    *redisConn
+	closed chan struct{}
+}
+
+// NewRedis connects to the Redis server at u, redis://[:password@]host:port
+func NewRedis(u *url.URL) (*Redis, error) {
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	password, _ := u.User.Password()
+
+	r := &Redis{
+		addr:     addr,
+		password: password,
+		subs:     newSubscriptions(),
+		closed:   make(chan struct{}),
+	}
+
+	// Fail early on a wrong address or password
+	r.pubMutex.Lock()
+	err := r.connectPub()
+	r.pubMutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	go r.run()
+	return r, nil
+}
+
+func (r *Redis) Publish(topic string, msg []byte) error {
+	r.pubMutex.Lock()
+	defer r.pubMutex.Unlock()
+
+	// Retry once on a fresh connection in case the old one went stale
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		if r.pub == nil {
+			if err = r.connectPub(); err != nil {
+				continue
+			}
+		}
+		if _, err = r.pub.do("PUBLISH", topic, string(msg)); err == nil {
+			return nil
+		}
+		r.pub.Close()
+		r.pub = nil
+	}
+	return err
+}
+
+func (r *Redis) Subscribe(topic string, handler func([]byte)) (func(), error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	select {
+	case <-r.closed:
+		return nil, errClosed
+	default:
+	}
+
+	id, first := r.subs.add(topic, handler)
+	if first && r.sub != nil {
+		// A failed write breaks the connection; run resubscribes after
+		// reconnecting
+		r.sub.send("SUBSCRIBE", topic)
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			r.mutex.Lock()
+			defer r.mutex.Unlock()
+			if r.subs.remove(topic, id) && r.sub != nil {
+				r.sub.send("UNSUBSCRIBE", topic)
+			}
+		})
+	}, nil
+}
+
+func (r *Redis) Close() error {
+	r.mutex.Lock()
+	select {
+	case <-r.closed:
+	default:
+		close(r.closed)
+	}
+	if r.sub != nil {
+		r.sub.Close()
+	}
+	r.mutex.Unlock()
+
+	r.pubMutex.Lock()
+	defer r.pubMutex.Unlock()
+	if r.pub != nil {
+		r.pub.Close()
+		r.pub = nil
+	}
+	return nil
+}
+
+// connectPub opens the publish connection. It is called with pubMutex held.
+func (r *Redis) connectPub() error {
+	conn, err := dialRedis(r.addr, r.password)
+	if err != nil {
+		return err
+	}
+	r.pub = conn
+	return nil
+}
+
+// run keeps the subscribe connection up and dispatches messages until the
+// broker is closed
+func (r *Redis) run() {
+	backoff := time.Second
+	for {
+		started := time.Now()
+		err := r.listen()
+
+		select {
+		case <-r.closed:
+			return
+		default:
+		}
+
+		// Reset the backoff after a connection that stayed up a while
+		if time.Since(started) > redisMaxBackoff {
+			backoff = time.Second
+		}
+		log.Printf("Redis broker subscription lost, retrying in %v: %v", backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-r.closed:
+			return
+		}
+		if backoff *= 2; backoff > redisMaxBackoff {
+			backoff = redisMaxBackoff
+		}
+	}
+}
+
+// listen subscribes to every topic with handlers and dispatches messages
+// until the connection fails
+func (r *Redis) listen() error {
+	conn, err := dialRedis(r.addr, r.password)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	// Clear the deadline AUTH may have set
+	conn.SetReadDeadline(time.Time{})
+
+	r.mutex.Lock()
+	r.sub = conn
+	topics := r.subs.topics()
+	if len(topics) > 0 {
+		err = conn.send(append([]string{"SUBSCRIBE"}, topics...)...)
+	}
+	r.mutex.Unlock()
+
+	defer func() {
+		r.mutex.Lock()
+		if r.sub == conn {
+			r.sub = nil
+		}
+		r.mutex.Unlock()
+	}()
+	if err != nil {
+		return err
+	}
+
+	for {
+		reply, err := conn.read()
+		if err != nil {
+			return err
+		}
+
+		// Pushes are ["message", topic, payload]; subscribe and
+		// unsubscribe confirmations are ignored
+		push, ok := reply.([]interface{})
+		if !ok || len(push) != 3 {
+			continue
+		}
+		kind, _ := push[0].(string)
+		topic, _ := push[1].(string)
+		payload, _ := push[2].(string)
+		if kind != "message" {
+			continue
+		}
+
+		r.mutex.Lock()
+		handlers := r.subs.get(topic)
+		r.mutex.Unlock()
+		for _, h := range handlers {
+			h([]byte(payload))
+		}
+	}
+}
+
+// redisConn speaks RESP, the Redis protocol, over a TCP connection
+type redisConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func dialRedis(addr, password string) (*redisConn, error) {
+	nc, err := net.DialTimeout("tcp", addr, redisDialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	conn := &redisConn{Conn: nc, reader: bufio.NewReader(nc)}
+
+	if password != "" {
+		if _, err := conn.do("AUTH", password); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("redis auth: %v", err)
+		}
+	}
+	return conn, nil
+}
+
+// do sends a command and reads its reply. It is not used on the subscribe
+// connection, which waits for pushes without a deadline.
+func (c *redisConn) do(args ...string) (interface{}, error) {
+	if err := c.send(args...); err != nil {
+		return nil, err
+	}
+	c.SetReadDeadline(time.Now().Add(redisTimeout))
+	return c.read()
+}
+
+// send writes a command as an array of bulk strings
+func (c *redisConn) send(args ...string) error {
+	buf := make([]byte, 0, 64)
+	buf = append(buf, '*')
+	buf = strconv.AppendInt(buf, int64(len(args)), 10)
+	buf = append(buf, '\r', '\n')
+	for _, arg := range args {
+		buf = append(buf, '$')
+		buf = strconv.AppendInt(buf, int64(len(arg)), 10)
+		buf = append(buf, '\r', '\n')
+		buf = append(buf, arg...)
+		buf = append(buf, '\r', '\n')
+	}
+
+	c.SetWriteDeadline(time.Now().Add(redisTimeout))
+	_, err := c.Write(buf)
+	return err
+}
+
+// read parses one reply. Bulk strings are returned as strings, integers as
+// int64 and arrays as []interface{}. Error replies become errors.
+func (c *redisConn) read() (interface{}, error) {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("redis: malformed reply %q", line)
+	}
+	kind, body := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return body, nil
+	case '-':
+		return nil, errors.New("redis: " + body)
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(c.reader, data); err != nil {
+			return nil, err
+		}
+		return string(data[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = c.read(); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
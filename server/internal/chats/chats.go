@@ -0,0 +1,44 @@
+package chats
+
+import (
+	"chat-app/internal/config"
+	"chat-app/internal/models"
+	"database/sql"
+)
+
+// ListMetadata returns chats with participant and message counts, ordered by
+// creation date. Message contents are deliberately not included.
+func ListMetadata(limit, offset int) ([]models.AdminChat, error) {
+	rows, err := config.DB.Query(`
+		SELECT
+			c.id, COALESCE(c.name, ''), c.is_group, c.created_at,
+			(SELECT COUNT(*) FROM chat_participants cp WHERE cp.chat_id = c.id),
+			(SELECT COUNT(*) FROM messages m WHERE m.chat_id = c.id),
+			(SELECT MAX(m.created_at) FROM messages m WHERE m.chat_id = c.id)
+		FROM chats c
+		ORDER BY c.created_at
+		LIMIT ? OFFSET ?
+	`, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	chats := []models.AdminChat{}
+	for rows.Next() {
+		var chat models.AdminChat
+		var lastMessageAt sql.NullTime
+		err := rows.Scan(
+			&chat.ID, &chat.Name, &chat.IsGroup, &chat.CreatedAt,
+			&chat.ParticipantCount, &chat.MessageCount, &lastMessageAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		if lastMessageAt.Valid {
+			chat.LastMessageAt = &lastMessageAt.Time
+		}
+		chats = append(chats, chat)
+	}
+	return chats, rows.Err()
+}
@@ -1,7 +1,311 @@
-
 package config
 
+import "time"
+
 var (
 	// JWTSecret key (in production, this should be an environment variable)
 	JWTSecret = []byte("your_jwt_secret_key")
+
+	// TOTPIssuer is the name authenticator apps show next to the account
+	TOTPIssuer = "Chat App"
+
+	// TwoFactorChallengeTTL is how long a login challenge token can be
+	// exchanged for a session token
+	TwoFactorChallengeTTL = 5 * time.Minute
+
+	// RecoveryCodeCount is the number of one-time recovery codes issued when
+	// two-factor authentication is enabled
+	RecoveryCodeCount = 10
+
+	// OIDCProviders are the single sign-on providers users can log in with,
+	// keyed by the name used in /api/auth/oidc/{provider}/... routes. For
+	// example:
+	//
+	//	"corp": {
+	//		IssuerURL:   "https://login.example.com",
+	//		ClientID:    "chat-app",
+	//		RedirectURL: "http://localhost:8000/api/auth/oidc/corp/callback",
+	//	}
+	OIDCProviders = map[string]OIDCProvider{}
+
+	// OIDCFrontendURL is where the browser is sent after a single sign-on
+	// callback. The session token or error is passed in the URL fragment.
+	OIDCFrontendURL = "http://localhost:8080/auth/callback"
+
+	// OIDCStateTTL is how long a user has to complete sign-in at the provider
+	OIDCStateTTL = 10 * time.Minute
+
+	// OIDCStateStore selects where pending sign-ins are kept: "memory" for
+	// a single instance, where the provider's callback must reach the
+	// instance that started the sign-in, or "database" to share them
+	OIDCStateStore = "memory"
+
+	// LoginAttemptStore selects where failed login counters are kept:
+	// "memory" for a single instance or "database" to share them
+	LoginAttemptStore = "memory"
+
+	// Failed logins per account back off exponentially from
+	// LoginBackoffBase up to LoginBackoffMax, and the account is locked for
+	// LoginLockoutDuration after LoginMaxFailures. Failures are forgotten
+	// after LoginFailureWindow without a new one.
+	LoginMaxFailures     = 5
+	LoginBackoffBase     = time.Second
+	LoginBackoffMax      = time.Minute
+	LoginLockoutDuration = 15 * time.Minute
+	LoginFailureWindow   = time.Hour
+
+	// LoginMaxFailuresPerIP is higher than the per-account limit since many
+	// users can share an address behind NAT
+	LoginMaxFailuresPerIP = 50
+
+	// Passwords must be between PasswordMinLength and PasswordMaxLength
+	// characters long
+	PasswordMinLength = 8
+	PasswordMaxLength = 128
+
+	// PasswordBreachedRangeDir holds breached password hashes in the Pwned
+	// Passwords range format, one file per SHA-1 prefix. Empty disables the
+	// check.
+	PasswordBreachedRangeDir = ""
+
+	// PasswordHashAlgorithm is "argon2id" or "bcrypt". Stored hashes using
+	// the other algorithm or weaker parameters are upgraded on login.
+	PasswordHashAlgorithm = "argon2id"
+	BcryptCost            = 12
+	Argon2                = Argon2Params{
+		Memory:      64 * 1024,
+		Iterations:  3,
+		Parallelism: 2,
+		SaltLength:  16,
+		KeyLength:   32,
+	}
+
+	// RateLimitStore selects where rate limit buckets are kept: "memory" for
+	// a single instance or "database" to share limits between instances
+	RateLimitStore = "memory"
+
+	// Rate limits per route group, applied per user or per client address
+	// for unauthenticated routes
+	AuthRateLimit    = RateLimit{Rate: 0.5, Burst: 10}
+	APIRateLimit     = RateLimit{Rate: 10, Burst: 50}
+	MessageRateLimit = RateLimit{Rate: 2, Burst: 10}
+
+	// WebSocketFrameRateLimit limits the frames a user can send over /ws
+	WebSocketFrameRateLimit = RateLimit{Rate: 5, Burst: 20}
+
+	// BrokerURL is the pub/sub server instances share to reach each other's
+	// WebSocket clients, e.g. "redis://:password@localhost:6379". Empty
+	// delivers within this process only, which is enough for one instance.
+	BrokerURL = ""
+
+	// WebSocket keepalive. The server pings every WebSocketPingInterval and
+	// drops connections that haven't answered within WebSocketPongWait, or
+	// whose writes take longer than WebSocketWriteWait. Client frames larger
+	// than WebSocketMaxMessageSize bytes close the connection.
+	WebSocketPingInterval   = 30 * time.Second
+	WebSocketPongWait       = 60 * time.Second
+	WebSocketWriteWait      = 10 * time.Second
+	WebSocketMaxMessageSize = int64(64 * 1024)
+
+	// WebSocketSendBuffer is the number of frames queued per connection.
+	// Clients whose queue overflows, or stays over half full for longer than
+	// WebSocketSlowConsumerTimeout, are disconnected.
+	WebSocketSendBuffer          = 256
+	WebSocketSlowConsumerTimeout = 10 * time.Second
+
+	// WebSocketCompression negotiates permessage-deflate with clients that
+	// offer it, compressing frames at WebSocketCompressionLevel (1 fastest
+	// to 9 smallest). Level 1 leaves most frames uncompressed as they are
+	// too small for it; compare with the benchmarks in internal/protocol.
+	WebSocketCompression      = true
+	WebSocketCompressionLevel = 6
+
+	// Clients that can't use /ws read the same events from /api/events, as
+	// Server-Sent Events or by long polling. The last EventBufferSize events
+	// are kept so a client can resume from Last-Event-ID. A session nobody
+	// has read from for EventSessionTimeout is closed and the user goes
+	// offline. Streams send a heartbeat comment every EventHeartbeatInterval
+	// to keep proxies from timing them out; polls wait at most
+	// LongPollTimeout for an event.
+	EventBufferSize        = 500
+	EventSessionTimeout    = time.Minute
+	EventHeartbeatInterval = 15 * time.Second
+	LongPollTimeout        = 25 * time.Second
+
+	// AccountDeletionGracePeriod is how long users have to change their mind
+	// after asking for their account to be deleted
+	AccountDeletionGracePeriod = 14 * 24 * time.Hour
+
+	// Avatars are resized to each of AvatarSizes, largest first, and stored
+	// in AvatarDir, which is served under /avatars/
+	AvatarDir            = "uploads/avatars"
+	AvatarSizes          = []int{256, 128, 64}
+	AvatarMaxUploadBytes = int64(5 << 20)
+
+	// EmailVerificationURL is the frontend page that confirms an email
+	// change; the token is appended as the "token" query parameter
+	EmailVerificationURL = "http://localhost:8080/verify-email"
+	EmailVerificationTTL = 24 * time.Hour
+
+	// SMTP is used to send verification emails. Without a host they are
+	// written to the log instead.
+	SMTP = SMTPConfig{
+		Port: 587,
+		From: "Chat App <no-reply@localhost>",
+	}
+
+	// Connected users without activity for PresenceIdleAfter show as idle,
+	// and as away after PresenceAwayAfter. Changes are picked up every
+	// PresenceSweepInterval, which also clears expired custom statuses.
+	PresenceIdleAfter     = 5 * time.Minute
+	PresenceAwayAfter     = 15 * time.Minute
+	PresenceSweepInterval = 30 * time.Second
+
+	// Typing events are passed on at most once per TypingThrottleInterval
+	// per user and chat. Clients renew them while the user types; an
+	// indicator not renewed within TypingTimeout is ended for them. Blocks,
+	// which hide typing from the other user, are cached for
+	// TypingBlocksTTL.
+	TypingThrottleInterval = 3 * time.Second
+	TypingTimeout          = 10 * time.Second
+	TypingBlocksTTL        = time.Minute
+
+	// Calls ring for CallRingTimeout before unanswered participants count
+	// as missed, and are limited to CallMaxParticipants, as every
+	// participant connects to every other
+	CallRingTimeout     = 45 * time.Second
+	CallMaxParticipants = 8
+
+	// ICE servers handed to call clients. TURN servers are only listed if
+	// TURNSecret is set; it is shared with the TURN server (coturn's
+	// static-auth-secret), and the passwords derived from it are valid for
+	// TURNCredentialTTL.
+	STUNURLs          = []string{"stun:stun.l.google.com:19302"}
+	TURNURLs          = []string{}
+	TURNSecret        = ""
+	TURNCredentialTTL = 12 * time.Hour
+
+	// MessageFilter configures the checks every message goes through before
+	// it is stored. Moderators can override parts of it per chat.
+	MessageFilter = MessageFilterConfig{
+		MaxLength:          4000,
+		BlockedWordsAction: "mask",
+		MaxLinks:           5,
+		LinkFloodAction:    "quarantine",
+		MaxRepeats:         3,
+		RepeatWindow:       time.Minute,
+		RepeatAction:       "reject",
+	}
+
+	// LDAP configures authenticating logins against a directory. Users found
+	// in the directory are provisioned on first login; everyone else falls
+	// back to the password stored in the users table.
+	LDAP = LDAPConfig{
+		URL:               "ldap://localhost:389",
+		UserFilter:        "(mail=%s)",
+		UsernameAttribute: "uid",
+		EmailAttribute:    "mail",
+		GroupAttribute:    "memberOf",
+	}
 )
+
+// OIDCProvider configures an OpenID Connect identity provider
+type OIDCProvider struct {
+	// IssuerURL is used for discovery and must match the issuer in ID tokens
+	IssuerURL    string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	// Scopes defaults to openid, email and profile
+	Scopes []string
+}
+
+// RateLimit is a token bucket: Rate tokens are added per second up to Burst,
+// and every request takes one
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// MessageFilterConfig configures the message filter pipeline. Actions are
+// "allow", "mask", "quarantine" or "reject"; zero limits disable a check.
+type MessageFilterConfig struct {
+	MaxLength int
+
+	BlockedWords       []string
+	BlockedWordsAction string
+
+	// Rules are regular expression checks run after the word list
+	Rules []FilterRule
+
+	MaxLinks        int
+	LinkFloodAction string
+
+	// Senders repeating the same content more than MaxRepeats times within
+	// RepeatWindow get RepeatAction
+	MaxRepeats   int
+	RepeatWindow time.Duration
+	RepeatAction string
+}
+
+// FilterRule is a regular expression message check. Name identifies the
+// rule when chats disable it; Reason is shown to senders of rejected
+// messages.
+type FilterRule struct {
+	Name    string
+	Pattern string
+	Action  string
+	Reason  string
+}
+
+// SMTPConfig configures the outgoing mail server
+type SMTPConfig struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	From     string
+}
+
+// LDAPConfig configures the LDAP authentication backend
+type LDAPConfig struct {
+	Enabled            bool
+	URL                string
+	StartTLS           bool
+	InsecureSkipVerify bool
+
+	// BindDN and BindPassword are the service account used for searches;
+	// leave BindDN empty for anonymous search
+	BindDN       string
+	BindPassword string
+
+	// BaseDN is where users are searched. UserFilter receives the escaped
+	// login as its only %s.
+	BaseDN     string
+	UserFilter string
+
+	UsernameAttribute string
+	EmailAttribute    string
+	// AvatarAttribute holds an image URL, e.g. labeledURI; empty to skip
+	AvatarAttribute string
+
+	// GroupAttribute lists the user's group DNs on the user entry. Set
+	// GroupFilter instead (e.g. "(member=%s)", receiving the user DN) for
+	// directories without memberOf; groups are then searched in GroupBaseDN.
+	GroupAttribute string
+	GroupBaseDN    string
+	GroupFilter    string
+
+	// GroupChats maps group DNs to the name of the group chat their members
+	// are kept in. Groups not listed here are not synced.
+	GroupChats map[string]string
+}
+
+// Argon2Params are the argon2id cost parameters. Memory is in KiB.
+type Argon2Params struct {
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
@@ -3,15 +3,23 @@ package config
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"log"
 	"time"
 
-	_ "github.com/go-sql-driver/mysql"
+	"github.com/go-sql-driver/mysql"
 )
 
 var DB *sql.DB
 
+// IsDuplicateKey reports whether err is MySQL rejecting a row that collides
+// with a unique index
+func IsDuplicateKey(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && mysqlErr.Number == 1062
+}
+
 // InitDB initializes the database connection
 func InitDB() {
 	var err error
@@ -67,6 +75,19 @@ func createTables() error {
 			email VARCHAR(255) UNIQUE NOT NULL,
 			password VARCHAR(255) NOT NULL,
 			avatar VARCHAR(255),
+			display_name VARCHAR(100),
+			bio TEXT,
+			status_text VARCHAR(140),
+			status_expires_at TIMESTAMP NULL,
+			presence VARCHAR(16) NOT NULL DEFAULT 'online',
+			connection_id VARCHAR(36) NULL,
+			totp_secret VARCHAR(64),
+			totp_enabled BOOLEAN DEFAULT false,
+			totp_last_step BIGINT DEFAULT 0,
+			role VARCHAR(16) NOT NULL DEFAULT 'user',
+			suspended_at TIMESTAMP NULL,
+			deletion_scheduled_at TIMESTAMP NULL,
+			deleted_at TIMESTAMP NULL,
 			is_online BOOLEAN DEFAULT false,
 			last_seen TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
 			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
@@ -82,6 +103,7 @@ func createTables() error {
 			id VARCHAR(36) PRIMARY KEY,
 			name VARCHAR(255),
 			is_group BOOLEAN DEFAULT false,
+			ldap_group VARCHAR(255) UNIQUE,
 			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 		)
 	`)
@@ -112,7 +134,11 @@ func createTables() error {
 			sender_id VARCHAR(36),
 			content TEXT NOT NULL,
 			is_read BOOLEAN DEFAULT false,
+			quarantined BOOLEAN NOT NULL DEFAULT false,
 			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			edited_at TIMESTAMP NULL,
+			kind VARCHAR(16) NOT NULL DEFAULT 'text',
+			call_id VARCHAR(36) NULL,
 			FOREIGN KEY (chat_id) REFERENCES chats(id) ON DELETE CASCADE,
 			FOREIGN KEY (sender_id) REFERENCES users(id) ON DELETE CASCADE
 		)
@@ -121,5 +147,318 @@ func createTables() error {
 		return fmt.Errorf("error creating messages table: %v", err)
 	}
 
+	// Two-factor recovery codes table
+	_, err = DB.Exec(`
+		CREATE TABLE IF NOT EXISTS recovery_codes (
+			id VARCHAR(36) PRIMARY KEY,
+			user_id VARCHAR(36) NOT NULL,
+			code_hash VARCHAR(64) NOT NULL,
+			used_at TIMESTAMP NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			UNIQUE KEY (user_id, code_hash),
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("error creating recovery_codes table: %v", err)
+	}
+
+	// External identities (single sign-on) linked to users
+	_, err = DB.Exec(`
+		CREATE TABLE IF NOT EXISTS user_identities (
+			provider VARCHAR(64) NOT NULL,
+			subject VARCHAR(255) NOT NULL,
+			user_id VARCHAR(36) NOT NULL,
+			email VARCHAR(255),
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (provider, subject),
+			UNIQUE KEY (user_id, provider),
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("error creating user_identities table: %v", err)
+	}
+
+	// Failed login counters, used when LoginAttemptStore is "database"
+	_, err = DB.Exec(`
+		CREATE TABLE IF NOT EXISTS login_attempts (
+			attempt_key VARCHAR(320) PRIMARY KEY,
+			failures INT NOT NULL DEFAULT 0,
+			last_failure TIMESTAMP NOT NULL,
+			locked_until TIMESTAMP NULL
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("error creating login_attempts table: %v", err)
+	}
+
+	// Rate limit buckets, used when RateLimitStore is "database"
+	_, err = DB.Exec(`
+		CREATE TABLE IF NOT EXISTS rate_limits (
+			bucket_key VARCHAR(255) PRIMARY KEY,
+			tokens DOUBLE NOT NULL,
+			updated_at TIMESTAMP(6) NOT NULL
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("error creating rate_limits table: %v", err)
+	}
+
+	// Pending single sign-on requests, used when OIDCStateStore is
+	// "database"
+	_, err = DB.Exec(`
+		CREATE TABLE IF NOT EXISTS oidc_auth_requests (
+			state VARCHAR(64) PRIMARY KEY,
+			provider VARCHAR(100) NOT NULL,
+			nonce VARCHAR(64) NOT NULL,
+			code_verifier VARCHAR(128) NOT NULL,
+			link_user_id VARCHAR(36) NOT NULL DEFAULT '',
+			binding_hash CHAR(64) NOT NULL,
+			expires_at TIMESTAMP NOT NULL,
+			KEY (expires_at)
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("error creating oidc_auth_requests table: %v", err)
+	}
+
+	// Blocks between users
+	_, err = DB.Exec(`
+		CREATE TABLE IF NOT EXISTS blocks (
+			blocker_id VARCHAR(36) NOT NULL,
+			blocked_id VARCHAR(36) NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (blocker_id, blocked_id),
+			KEY (blocked_id),
+			FOREIGN KEY (blocker_id) REFERENCES users(id) ON DELETE CASCADE,
+			FOREIGN KEY (blocked_id) REFERENCES users(id) ON DELETE CASCADE
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("error creating blocks table: %v", err)
+	}
+
+	// Reported messages. The message content and sender are copied so the
+	// report survives the message being deleted.
+	_, err = DB.Exec(`
+		CREATE TABLE IF NOT EXISTS message_reports (
+			id VARCHAR(36) PRIMARY KEY,
+			message_id VARCHAR(36) NOT NULL,
+			chat_id VARCHAR(36) NOT NULL,
+			sender_id VARCHAR(36) NOT NULL,
+			reporter_id VARCHAR(36),
+			reason VARCHAR(32) NOT NULL,
+			details TEXT,
+			content TEXT NOT NULL,
+			status VARCHAR(16) NOT NULL DEFAULT 'open',
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			resolved_at TIMESTAMP NULL,
+			UNIQUE KEY (message_id, reporter_id),
+			KEY (status, created_at)
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("error creating message_reports table: %v", err)
+	}
+
+	// Every moderation decision, kept as an audit trail
+	_, err = DB.Exec(`
+		CREATE TABLE IF NOT EXISTS moderation_actions (
+			id VARCHAR(36) PRIMARY KEY,
+			report_id VARCHAR(36) NOT NULL,
+			moderator_id VARCHAR(36) NOT NULL,
+			action VARCHAR(32) NOT NULL,
+			note TEXT,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			KEY (report_id)
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("error creating moderation_actions table: %v", err)
+	}
+
+	// Warnings issued to users by moderators
+	_, err = DB.Exec(`
+		CREATE TABLE IF NOT EXISTS user_warnings (
+			id VARCHAR(36) PRIMARY KEY,
+			user_id VARCHAR(36) NOT NULL,
+			moderator_id VARCHAR(36) NOT NULL,
+			report_id VARCHAR(36),
+			reason TEXT,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("error creating user_warnings table: %v", err)
+	}
+
+	// Per-chat message filter overrides. NULL columns keep the configured
+	// default; lists are stored newline-separated.
+	_, err = DB.Exec(`
+		CREATE TABLE IF NOT EXISTS chat_filter_settings (
+			chat_id VARCHAR(36) PRIMARY KEY,
+			max_length INT,
+			blocked_words TEXT,
+			blocked_words_action VARCHAR(16),
+			max_links INT,
+			disabled_filters TEXT,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+			FOREIGN KEY (chat_id) REFERENCES chats(id) ON DELETE CASCADE
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("error creating chat_filter_settings table: %v", err)
+	}
+
+	// Audit log. Rows are only ever inserted; each stores the hash of the
+	// previous row so changes to the history can be detected.
+	_, err = DB.Exec(`
+		CREATE TABLE IF NOT EXISTS audit_log (
+			seq BIGINT AUTO_INCREMENT PRIMARY KEY,
+			event_type VARCHAR(64) NOT NULL,
+			actor_id VARCHAR(36) NOT NULL DEFAULT '',
+			target_id VARCHAR(255) NOT NULL DEFAULT '',
+			ip VARCHAR(45) NOT NULL DEFAULT '',
+			details TEXT NOT NULL,
+			created_at TIMESTAMP(6) NOT NULL,
+			prev_hash CHAR(64) NOT NULL,
+			hash CHAR(64) NOT NULL,
+			KEY (event_type, created_at),
+			KEY (actor_id),
+			KEY (target_id)
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("error creating audit_log table: %v", err)
+	}
+
+	// The hash of the last audit_log entry, in a single row that writers
+	// lock to take turns. Logs from before the table existed start from
+	// their last entry.
+	_, err = DB.Exec(`
+		CREATE TABLE IF NOT EXISTS audit_head (
+			id TINYINT PRIMARY KEY,
+			hash CHAR(64) NOT NULL
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("error creating audit_head table: %v", err)
+	}
+	_, err = DB.Exec(`
+		INSERT IGNORE INTO audit_head (id, hash)
+		SELECT 1, COALESCE((SELECT hash FROM audit_log ORDER BY seq DESC LIMIT 1), '')
+	`)
+	if err != nil {
+		return fmt.Errorf("error creating audit_head row: %v", err)
+	}
+
+	// Pending email changes, confirmed by a link sent to the new address
+	_, err = DB.Exec(`
+		CREATE TABLE IF NOT EXISTS email_verifications (
+			token_hash CHAR(64) PRIMARY KEY,
+			user_id VARCHAR(36) NOT NULL,
+			email VARCHAR(255) NOT NULL,
+			expires_at TIMESTAMP NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			KEY (user_id),
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("error creating email_verifications table: %v", err)
+	}
+
+	// Voice and video calls, with each participant's part in them
+	_, err = DB.Exec(`
+		CREATE TABLE IF NOT EXISTS calls (
+			id VARCHAR(36) PRIMARY KEY,
+			chat_id VARCHAR(36) NOT NULL,
+			initiator_id VARCHAR(36) NOT NULL,
+			video BOOLEAN NOT NULL DEFAULT false,
+			state VARCHAR(16) NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			answered_at TIMESTAMP NULL,
+			ended_at TIMESTAMP NULL,
+			KEY (chat_id, state),
+			KEY (state),
+			FOREIGN KEY (chat_id) REFERENCES chats(id) ON DELETE CASCADE,
+			FOREIGN KEY (initiator_id) REFERENCES users(id) ON DELETE CASCADE
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("error creating calls table: %v", err)
+	}
+
+	_, err = DB.Exec(`
+		CREATE TABLE IF NOT EXISTS call_participants (
+			call_id VARCHAR(36),
+			user_id VARCHAR(36),
+			state VARCHAR(16) NOT NULL,
+			joined_at TIMESTAMP NULL,
+			left_at TIMESTAMP NULL,
+			PRIMARY KEY (call_id, user_id),
+			KEY (user_id, state),
+			FOREIGN KEY (call_id) REFERENCES calls(id) ON DELETE CASCADE,
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("error creating call_participants table: %v", err)
+	}
+
+	return upgradeColumns()
+}
+
+// columnUpgrades lists columns added after a table was first released.
+// CREATE TABLE IF NOT EXISTS leaves existing tables untouched, so databases
+// created by older versions pick these up in upgradeColumns.
+var columnUpgrades = []struct {
+	table      string
+	column     string
+	definition string
+}{
+	{"users", "totp_secret", "VARCHAR(64)"},
+	{"users", "totp_enabled", "BOOLEAN DEFAULT false"},
+	{"users", "totp_last_step", "BIGINT DEFAULT 0"},
+	{"chats", "ldap_group", "VARCHAR(255) UNIQUE"},
+	{"users", "role", "VARCHAR(16) NOT NULL DEFAULT 'user'"},
+	{"users", "suspended_at", "TIMESTAMP NULL"},
+	{"messages", "quarantined", "BOOLEAN NOT NULL DEFAULT false"},
+	{"messages", "edited_at", "TIMESTAMP NULL"},
+	{"users", "deletion_scheduled_at", "TIMESTAMP NULL"},
+	{"users", "deleted_at", "TIMESTAMP NULL"},
+	{"users", "display_name", "VARCHAR(100)"},
+	{"users", "bio", "TEXT"},
+	{"users", "status_text", "VARCHAR(140)"},
+	{"users", "status_expires_at", "TIMESTAMP NULL"},
+	{"users", "presence", "VARCHAR(16) NOT NULL DEFAULT 'online'"},
+	{"messages", "kind", "VARCHAR(16) NOT NULL DEFAULT 'text'"},
+	{"messages", "call_id", "VARCHAR(36) NULL"},
+	{"users", "connection_id", "VARCHAR(36) NULL"},
+}
+
+// upgradeColumns adds any column from columnUpgrades that is missing
+func upgradeColumns() error {
+	for _, c := range columnUpgrades {
+		var count int
+		err := DB.QueryRow(`
+			SELECT COUNT(*) FROM information_schema.COLUMNS
+			WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND COLUMN_NAME = ?
+		`, c.table, c.column).Scan(&count)
+		if err != nil {
+			return fmt.Errorf("error checking column %s.%s: %v", c.table, c.column, err)
+		}
+		if count > 0 {
+			continue
+		}
+
+		_, err = DB.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", c.table, c.column, c.definition))
+		if err != nil {
+			return fmt.Errorf("error adding column %s.%s: %v", c.table, c.column, err)
+		}
+	}
+
 	return nil
 }
@@ -0,0 +1,118 @@
+package filter
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Action is what a filter decides to do with a message
+type Action string
+
+const (
+	// Allow lets the message through unchanged
+	Allow Action = "allow"
+	// Mask replaces the offending parts of the message and lets it through
+	Mask Action = "mask"
+	// Quarantine stores the message hidden from other participants until a
+	// moderator reviews it
+	Quarantine Action = "quarantine"
+	// Reject refuses the message
+	Reject Action = "reject"
+)
+
+// severity orders actions so the strictest verdict in a pipeline wins
+var severity = map[Action]int{
+	Allow:      0,
+	Mask:       1,
+	Quarantine: 2,
+	Reject:     3,
+}
+
+// ParseAction validates an action name from configuration
+func ParseAction(name string) (Action, error) {
+	action := Action(name)
+	if _, ok := severity[action]; !ok {
+		return "", fmt.Errorf("unknown filter action %q", name)
+	}
+	return action, nil
+}
+
+// Message is a message about to be stored
+type Message struct {
+	ChatID   string
+	SenderID string
+	Content  string
+}
+
+// Verdict is the outcome of running a message through filters
+type Verdict struct {
+	Action Action
+	// Filter names the filter that decided the action
+	Filter string
+	// Reason explains the action. For rejections it is shown to the sender.
+	Reason string
+	// Content is the message content after masking
+	Content string
+}
+
+// Filter inspects a message. Filters returning Mask must set
+// Verdict.Content to the masked content.
+type Filter interface {
+	Name() string
+	Check(msg Message) Verdict
+}
+
+// Pipeline runs filters in order. Masked content is passed on to later
+// filters; a rejection stops the pipeline.
+type Pipeline []Filter
+
+// Run applies every filter and returns the strictest verdict, with the
+// content as masked by all filters
+func (p Pipeline) Run(msg Message) Verdict {
+	result := Verdict{Action: Allow, Content: msg.Content}
+
+	for _, f := range p {
+		v := f.Check(msg)
+		if v.Action == Mask {
+			msg.Content = v.Content
+			result.Content = v.Content
+		}
+		if severity[v.Action] > severity[result.Action] {
+			result.Action = v.Action
+			result.Filter = f.Name()
+			result.Reason = v.Reason
+		}
+		if v.Action == Reject {
+			break
+		}
+	}
+
+	return result
+}
+
+// Without returns the pipeline minus the named filters
+func (p Pipeline) Without(names []string) Pipeline {
+	if len(names) == 0 {
+		return p
+	}
+
+	kept := make(Pipeline, 0, len(p))
+	for _, f := range p {
+		disabled := false
+		for _, name := range names {
+			if strings.EqualFold(f.Name(), name) {
+				disabled = true
+				break
+			}
+		}
+		if !disabled {
+			kept = append(kept, f)
+		}
+	}
+	return kept
+}
+
+// maskText replaces every character of s with an asterisk
+func maskText(s string) string {
+	return strings.Repeat("*", len([]rune(s)))
+}
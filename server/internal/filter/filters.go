@@ -0,0 +1,188 @@
+package filter
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// MaxLength rejects messages longer than Max characters
+type MaxLength struct {
+	Max int
+}
+
+func (f *MaxLength) Name() string { return "max_length" }
+
+func (f *MaxLength) Check(msg Message) Verdict {
+	if f.Max > 0 && utf8.RuneCountInString(msg.Content) > f.Max {
+		return Verdict{
+			Action: Reject,
+			Reason: fmt.Sprintf("Message must be at most %d characters", f.Max),
+		}
+	}
+	return Verdict{Action: Allow}
+}
+
+// WordList acts on messages containing any of a list of words. Matching is
+// case-insensitive and on whole words only.
+type WordList struct {
+	pattern *regexp.Regexp
+	action  Action
+}
+
+// NewWordList returns nil when there are no words
+func NewWordList(words []string, action Action) *WordList {
+	quoted := make([]string, 0, len(words))
+	for _, word := range words {
+		if word = strings.TrimSpace(word); word != "" {
+			quoted = append(quoted, regexp.QuoteMeta(word))
+		}
+	}
+	if len(quoted) == 0 {
+		return nil
+	}
+
+	return &WordList{
+		pattern: regexp.MustCompile(`(?i)\b(?:` + strings.Join(quoted, "|") + `)\b`),
+		action:  action,
+	}
+}
+
+func (f *WordList) Name() string { return "word_list" }
+
+func (f *WordList) Check(msg Message) Verdict {
+	if !f.pattern.MatchString(msg.Content) {
+		return Verdict{Action: Allow}
+	}
+	return verdictFor(f.action, f.pattern, msg.Content, "Message contains a blocked word")
+}
+
+// Rule acts on messages matching a regular expression
+type Rule struct {
+	name    string
+	pattern *regexp.Regexp
+	action  Action
+	reason  string
+}
+
+// NewRule compiles a rule. name identifies it so chats can disable it.
+func NewRule(name, pattern string, action Action, reason string) (*Rule, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern for rule %q: %v", name, err)
+	}
+	if reason == "" {
+		reason = "Message is not allowed"
+	}
+	return &Rule{name: name, pattern: re, action: action, reason: reason}, nil
+}
+
+func (f *Rule) Name() string { return f.name }
+
+func (f *Rule) Check(msg Message) Verdict {
+	if !f.pattern.MatchString(msg.Content) {
+		return Verdict{Action: Allow}
+	}
+	return verdictFor(f.action, f.pattern, msg.Content, f.reason)
+}
+
+var linkPattern = regexp.MustCompile(`(?i)\b(?:https?://|www\.)\S+`)
+
+// LinkFlood acts on messages with more than MaxLinks links
+type LinkFlood struct {
+	MaxLinks int
+	Action   Action
+}
+
+func (f *LinkFlood) Name() string { return "link_flood" }
+
+func (f *LinkFlood) Check(msg Message) Verdict {
+	if f.MaxLinks <= 0 {
+		return Verdict{Action: Allow}
+	}
+	links := linkPattern.FindAllString(msg.Content, -1)
+	if len(links) <= f.MaxLinks {
+		return Verdict{Action: Allow}
+	}
+	return verdictFor(f.Action, linkPattern, msg.Content,
+		fmt.Sprintf("Messages may contain at most %d links", f.MaxLinks))
+}
+
+// RepeatedContent acts on senders who post the same content more than
+// MaxRepeats times within Window, in any chat. History is kept in process
+// memory, so each server instance counts separately.
+type RepeatedContent struct {
+	MaxRepeats int
+	Window     time.Duration
+	Action     Action
+
+	mutex   sync.Mutex
+	history map[string][]sentMessage
+}
+
+type sentMessage struct {
+	content string
+	at      time.Time
+}
+
+func (f *RepeatedContent) Name() string { return "repeated_content" }
+
+func (f *RepeatedContent) Check(msg Message) Verdict {
+	if f.MaxRepeats <= 0 {
+		return Verdict{Action: Allow}
+	}
+
+	content := strings.ToLower(strings.Join(strings.Fields(msg.Content), " "))
+	now := time.Now()
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.history == nil {
+		f.history = make(map[string][]sentMessage)
+	}
+
+	// Forget messages outside the window, including other senders' so the
+	// map does not grow without bound
+	for sender, sent := range f.history {
+		kept := sent[:0]
+		for _, s := range sent {
+			if now.Sub(s.at) <= f.Window {
+				kept = append(kept, s)
+			}
+		}
+		if len(kept) == 0 {
+			delete(f.history, sender)
+		} else {
+			f.history[sender] = kept
+		}
+	}
+
+	repeats := 0
+	for _, s := range f.history[msg.SenderID] {
+		if s.content == content {
+			repeats++
+		}
+	}
+	f.history[msg.SenderID] = append(f.history[msg.SenderID], sentMessage{content: content, at: now})
+
+	if repeats < f.MaxRepeats {
+		return Verdict{Action: Allow}
+	}
+	if f.Action == Mask {
+		// There is no part of a repeated message to mask
+		return Verdict{Action: Allow}
+	}
+	return Verdict{Action: f.Action, Reason: "You are sending the same message too often"}
+}
+
+// verdictFor builds the verdict for a match of pattern in content
+func verdictFor(action Action, pattern *regexp.Regexp, content, reason string) Verdict {
+	if action == Mask {
+		return Verdict{Action: Mask, Reason: reason, Content: pattern.ReplaceAllStringFunc(content, maskText)}
+	}
+	return Verdict{Action: action, Reason: reason}
+}
@@ -0,0 +1,336 @@
+package handlers
+
+import (
+	"archive/zip"
+	"chat-app/internal/accounts"
+	"chat-app/internal/audit"
+	"chat-app/internal/config"
+	"chat-app/internal/models"
+	"chat-app/internal/password"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+// DeleteAccount schedules the current user's account for deletion after the
+// grace period. Until then the user can log in and cancel with
+// RestoreAccount.
+func DeleteAccount(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(models.User)
+
+	var req models.DeleteAccountRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	var hashedPassword string
+	if err := config.DB.QueryRow("SELECT password FROM users WHERE id = ?", user.ID).Scan(&hashedPassword); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	// Accounts that only sign in through an identity provider have no
+	// password to confirm with
+	if hashedPassword != "" {
+		ok, _, err := password.Verify(req.Password, hashedPassword)
+		if err != nil {
+			http.Error(w, "Error checking password", http.StatusInternalServerError)
+			log.Printf("Error checking password: %v", err)
+			return
+		}
+		if !ok {
+			http.Error(w, "Invalid password", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	scheduledAt, err := accounts.RequestDeletion(user.ID)
+	if err != nil {
+		http.Error(w, "Error scheduling deletion", http.StatusInternalServerError)
+		log.Printf("Error scheduling account deletion: %v", err)
+		return
+	}
+	recordAudit(r, audit.Event{
+		Type:     audit.UserDeletionRequested,
+		TargetID: user.ID,
+		Details:  map[string]interface{}{"scheduledAt": scheduledAt.UTC().Format(time.RFC3339)},
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(models.AccountDeletionResponse{DeletionScheduledAt: scheduledAt})
+}
+
+// RestoreAccount cancels a pending account deletion
+func RestoreAccount(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(models.User)
+
+	if err := accounts.CancelDeletion(user.ID); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	recordAudit(r, audit.Event{Type: audit.UserDeletionCancelled, TargetID: user.ID})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// StartAccountDeletions deletes accounts whose grace period has run out,
+// checking every interval until the process exits
+func StartAccountDeletions(interval time.Duration) {
+	go func() {
+		for {
+			deleted, err := accounts.DeleteDue()
+			for _, userID := range deleted {
+				recordAudit(nil, audit.Event{
+					Type:     audit.UserDeleted,
+					TargetID: userID,
+					Details:  map[string]interface{}{"reason": "requested"},
+				})
+			}
+			if err != nil {
+				log.Printf("Error deleting accounts: %v", err)
+			}
+			time.Sleep(interval)
+		}
+	}()
+}
+
+type exportProfile struct {
+	ID                  string           `json:"id"`
+	Username            string           `json:"username"`
+	Email               string           `json:"email"`
+	Avatar              string           `json:"avatar,omitempty"`
+	Role                string           `json:"role"`
+	TwoFactorEnabled    bool             `json:"twoFactorEnabled"`
+	CreatedAt           time.Time        `json:"createdAt"`
+	LastSeen            time.Time        `json:"lastSeen"`
+	DeletionScheduledAt *time.Time       `json:"deletionScheduledAt,omitempty"`
+	Identities          []exportIdentity `json:"identities"`
+	BlockedUserIDs      []string         `json:"blockedUserIds"`
+}
+
+type exportIdentity struct {
+	Provider string    `json:"provider"`
+	Email    string    `json:"email,omitempty"`
+	LinkedAt time.Time `json:"linkedAt"`
+}
+
+type exportChat struct {
+	ID           string              `json:"id"`
+	Name         string              `json:"name,omitempty"`
+	IsGroup      bool                `json:"isGroup"`
+	CreatedAt    time.Time           `json:"createdAt"`
+	JoinedAt     time.Time           `json:"joinedAt"`
+	Participants []exportParticipant `json:"participants"`
+}
+
+type exportParticipant struct {
+	ID       string `json:"id"`
+	Username string `json:"username"`
+}
+
+// ExportAccount sends the current user's data as a ZIP of JSON files: their
+// profile, their chats and every message in those chats they can see
+func ExportAccount(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(models.User)
+
+	// Load everything small up front so errors can still get a proper
+	// response; messages are streamed afterwards
+	profile, err := loadExportProfile(user.ID)
+	if err != nil {
+		http.Error(w, "Error exporting profile", http.StatusInternalServerError)
+		log.Printf("Error exporting profile: %v", err)
+		return
+	}
+	chatList, err := loadExportChats(user.ID)
+	if err != nil {
+		http.Error(w, "Error exporting chats", http.StatusInternalServerError)
+		log.Printf("Error exporting chats: %v", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition",
+		fmt.Sprintf(`attachment; filename="chat-export-%s.zip"`, time.Now().Format("2006-01-02")))
+
+	archive := zip.NewWriter(w)
+	if err := writeExportFile(archive, "profile.json", profile); err != nil {
+		log.Printf("Error writing export: %v", err)
+		return
+	}
+	if err := writeExportFile(archive, "chats.json", chatList); err != nil {
+		log.Printf("Error writing export: %v", err)
+		return
+	}
+	if err := writeExportMessages(archive, user.ID); err != nil {
+		// Headers are gone; leaving the archive unfinished makes the
+		// download fail instead of looking complete
+		log.Printf("Error writing export messages: %v", err)
+		return
+	}
+	if err := archive.Close(); err != nil {
+		log.Printf("Error finishing export: %v", err)
+	}
+}
+
+func writeExportFile(archive *zip.Writer, name string, v interface{}) error {
+	f, err := archive.Create(name)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(f)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+// writeExportMessages streams messages.json one message at a time
+func writeExportMessages(archive *zip.Writer, userID string) error {
+	f, err := archive.Create("messages.json")
+	if err != nil {
+		return err
+	}
+
+	rows, err := config.DB.Query(`
+		SELECT m.id, m.chat_id, m.sender_id, m.content, m.is_read, m.created_at
+		FROM messages m
+		JOIN chat_participants cp ON cp.chat_id = m.chat_id AND cp.user_id = ?
+		WHERE m.quarantined = false OR m.sender_id = ?
+		ORDER BY m.chat_id, m.created_at
+	`, userID, userID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	if _, err := io.WriteString(f, "[\n"); err != nil {
+		return err
+	}
+	first := true
+	for rows.Next() {
+		var msg models.Message
+		if err := rows.Scan(&msg.ID, &msg.ChatID, &msg.SenderID, &msg.Content, &msg.IsRead, &msg.Timestamp); err != nil {
+			return err
+		}
+		data, err := json.Marshal(msg)
+		if err != nil {
+			return err
+		}
+		if !first {
+			if _, err := io.WriteString(f, ",\n"); err != nil {
+				return err
+			}
+		}
+		first = false
+		if _, err := f.Write(data); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	_, err = io.WriteString(f, "\n]\n")
+	return err
+}
+
+func loadExportProfile(userID string) (exportProfile, error) {
+	var profile exportProfile
+	var avatar sql.NullString
+	var deletionScheduledAt sql.NullTime
+
+	err := config.DB.QueryRow(`
+		SELECT id, username, email, avatar, role, totp_enabled, created_at, last_seen, deletion_scheduled_at
+		FROM users WHERE id = ?
+	`, userID).Scan(
+		&profile.ID, &profile.Username, &profile.Email, &avatar, &profile.Role,
+		&profile.TwoFactorEnabled, &profile.CreatedAt, &profile.LastSeen, &deletionScheduledAt,
+	)
+	if err != nil {
+		return profile, err
+	}
+	profile.Avatar = avatar.String
+	if deletionScheduledAt.Valid {
+		profile.DeletionScheduledAt = &deletionScheduledAt.Time
+	}
+
+	rows, err := config.DB.Query(`
+		SELECT provider, COALESCE(email, ''), created_at FROM user_identities WHERE user_id = ?
+	`, userID)
+	if err != nil {
+		return profile, err
+	}
+	defer rows.Close()
+
+	profile.Identities = []exportIdentity{}
+	for rows.Next() {
+		var identity exportIdentity
+		if err := rows.Scan(&identity.Provider, &identity.Email, &identity.LinkedAt); err != nil {
+			return profile, err
+		}
+		profile.Identities = append(profile.Identities, identity)
+	}
+	if err := rows.Err(); err != nil {
+		return profile, err
+	}
+
+	profile.BlockedUserIDs, err = blockedByUser(userID)
+	return profile, err
+}
+
+// blockedByUser returns the IDs of users userID has blocked
+func blockedByUser(userID string) ([]string, error) {
+	rows, err := config.DB.Query("SELECT blocked_id FROM blocks WHERE blocker_id = ?", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []string{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+func loadExportChats(userID string) ([]exportChat, error) {
+	rows, err := config.DB.Query(`
+		SELECT c.id, COALESCE(c.name, ''), c.is_group, c.created_at, mine.joined_at, u.id, u.username
+		FROM chat_participants mine
+		JOIN chats c ON c.id = mine.chat_id
+		JOIN chat_participants cp ON cp.chat_id = c.id
+		JOIN users u ON u.id = cp.user_id
+		WHERE mine.user_id = ?
+		ORDER BY c.created_at, c.id
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	chatList := []exportChat{}
+	for rows.Next() {
+		var chat exportChat
+		var participant exportParticipant
+		err := rows.Scan(&chat.ID, &chat.Name, &chat.IsGroup, &chat.CreatedAt, &chat.JoinedAt,
+			&participant.ID, &participant.Username)
+		if err != nil {
+			return nil, err
+		}
+
+		// Rows of a chat are adjacent thanks to the ORDER BY
+		if n := len(chatList); n > 0 && chatList[n-1].ID == chat.ID {
+			chatList[n-1].Participants = append(chatList[n-1].Participants, participant)
+			continue
+		}
+		chat.Participants = []exportParticipant{participant}
+		chatList = append(chatList, chat)
+	}
+	return chatList, rows.Err()
+}
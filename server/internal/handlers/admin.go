@@ -0,0 +1,207 @@
+package handlers
+
+import (
+	"chat-app/internal/accounts"
+	"chat-app/internal/audit"
+	"chat-app/internal/chats"
+	"chat-app/internal/config"
+	"chat-app/internal/hub"
+	"chat-app/internal/models"
+	"chat-app/internal/store"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// AdminListUsers lists all users with their role and suspension state
+func AdminListUsers(w http.ResponseWriter, r *http.Request) {
+	limit, offset := pagination(r)
+
+	users, err := accounts.List(limit, offset)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		log.Printf("Error listing users: %v", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(users)
+}
+
+// AdminSetRole changes a user's role
+func AdminSetRole(w http.ResponseWriter, r *http.Request) {
+	targetID := chi.URLParam(r, "id")
+
+	var req models.SetRoleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	if !rejectSelf(w, r, targetID) {
+		return
+	}
+
+	err := accounts.SetRole(targetID, req.Role)
+	if err == nil {
+		recordAudit(r, audit.Event{
+			Type:     audit.UserRoleChanged,
+			TargetID: targetID,
+			Details:  map[string]interface{}{"role": req.Role},
+		})
+	}
+	writeAccountResult(w, err)
+}
+
+// AdminSuspendUser suspends a user and closes their connection
+func AdminSuspendUser(w http.ResponseWriter, r *http.Request) {
+	targetID := chi.URLParam(r, "id")
+	if !rejectSelf(w, r, targetID) {
+		return
+	}
+
+	err := accounts.Suspend(targetID)
+	if err == nil {
+		recordSuspension(r, targetID, "admin")
+	}
+	writeAccountResult(w, err)
+}
+
+// AdminUnsuspendUser lifts a suspension
+func AdminUnsuspendUser(w http.ResponseWriter, r *http.Request) {
+	targetID := chi.URLParam(r, "id")
+
+	err := accounts.Unsuspend(targetID)
+	if err == nil {
+		recordAudit(r, audit.Event{Type: audit.UserUnsuspended, TargetID: targetID})
+	}
+	writeAccountResult(w, err)
+}
+
+// AdminDeleteUser deletes a user
+func AdminDeleteUser(w http.ResponseWriter, r *http.Request) {
+	targetID := chi.URLParam(r, "id")
+	if !rejectSelf(w, r, targetID) {
+		return
+	}
+
+	err := accounts.Delete(targetID)
+	if err == nil {
+		recordAudit(r, audit.Event{Type: audit.UserDeleted, TargetID: targetID})
+	}
+	writeAccountResult(w, err)
+}
+
+// AdminUnlockLogin clears a login lockout caused by failed attempts
+func AdminUnlockLogin(w http.ResponseWriter, r *http.Request) {
+	targetID := chi.URLParam(r, "id")
+
+	var email string
+	err := config.DB.QueryRow("SELECT email FROM users WHERE id = ?", targetID).Scan(&email)
+	if err == sql.ErrNoRows {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	if err := UnlockLogin(email); err != nil {
+		http.Error(w, "Error unlocking login", http.StatusInternalServerError)
+		log.Printf("Error unlocking login: %v", err)
+		return
+	}
+	recordAudit(r, audit.Event{Type: audit.LoginUnlocked, TargetID: targetID})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// AdminListChats lists chats with participant and message counts. Message
+// contents are deliberately not included.
+func AdminListChats(w http.ResponseWriter, r *http.Request) {
+	limit, offset := pagination(r)
+
+	chatList, err := chats.ListMetadata(limit, offset)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		log.Printf("Error listing chats: %v", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(chatList)
+}
+
+// AdminListConnections lists the IDs of users connected over WebSocket to
+// this server
+func AdminListConnections(w http.ResponseWriter, r *http.Request) {
+	userIDs := make([]string, 0)
+	for userID := range store.GetAllConnections() {
+		userIDs = append(userIDs, userID)
+	}
+	sort.Strings(userIDs)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(userIDs)
+}
+
+// AdminConnectionStats returns queue metrics for every WebSocket connection
+// on this server
+func AdminConnectionStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(store.GetConnectionStats())
+}
+
+// AdminDisconnect force-closes a user's WebSocket connection on whichever
+// instance holds it. The client may reconnect; suspend the user to keep
+// them out.
+func AdminDisconnect(w http.ResponseWriter, r *http.Request) {
+	hub.Disconnect(chi.URLParam(r, "userId"))
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// rejectSelf stops admins from suspending, deleting or demoting themselves,
+// which could leave nobody able to administer the system
+func rejectSelf(w http.ResponseWriter, r *http.Request, targetID string) bool {
+	user := r.Context().Value("user").(models.User)
+	if user.ID == targetID {
+		http.Error(w, "Admins cannot change their own account here", http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+func writeAccountResult(w http.ResponseWriter, err error) {
+	switch err {
+	case nil:
+		w.WriteHeader(http.StatusNoContent)
+	case accounts.ErrNotFound:
+		http.Error(w, "User not found", http.StatusNotFound)
+	case accounts.ErrInvalidRole:
+		http.Error(w, "Invalid role", http.StatusBadRequest)
+	default:
+		log.Printf("Error updating account: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+	}
+}
+
+// pagination reads limit and offset query parameters, defaulting to the
+// first 100 rows
+func pagination(r *http.Request) (int, int) {
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 || limit > 500 {
+		limit = 100
+	}
+	offset, err := strconv.Atoi(r.URL.Query().Get("offset"))
+	if err != nil || offset < 0 {
+		offset = 0
+	}
+	return limit, offset
+}
@@ -2,17 +2,23 @@
 package handlers
 
 import (
+	"chat-app/internal/accounts"
+	"chat-app/internal/audit"
 	"chat-app/internal/config"
+	"chat-app/internal/ldapauth"
+	"chat-app/internal/middleware"
 	"chat-app/internal/models"
+	"chat-app/internal/password"
 	"chat-app/internal/store"
 	"database/sql"
 	"encoding/json"
+	"errors"
+	"log"
 	"net/http"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
 	"github.com/google/uuid"
-	"golang.org/x/crypto/bcrypt"
 )
 
 func Register(w http.ResponseWriter, r *http.Request) {
@@ -38,7 +44,17 @@ func Register(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	if err := password.Validate(req.Password, req.Username, req.Email); err != nil {
+		if policyErr, ok := err.(*password.PolicyError); ok {
+			http.Error(w, policyErr.Reason, http.StatusBadRequest)
+			return
+		}
+		log.Printf("Error checking password policy: %v", err)
+		http.Error(w, "Error checking password", http.StatusInternalServerError)
+		return
+	}
+
+	hashedPassword, err := password.Hash(req.Password)
 	if err != nil {
 		http.Error(w, "Error hashing password", http.StatusInternalServerError)
 		return
@@ -49,20 +65,26 @@ func Register(w http.ResponseWriter, r *http.Request) {
 	_, err = config.DB.Exec(`
 		INSERT INTO users (id, username, email, password, is_online, last_seen, created_at)
 		VALUES (?, ?, ?, ?, true, NOW(), NOW())
-	`, userID, req.Username, req.Email, string(hashedPassword))
+	`, userID, req.Username, req.Email, hashedPassword)
 	if err != nil {
 		http.Error(w, "Error creating user", http.StatusInternalServerError)
 		return
 	}
+	recordAudit(r, audit.Event{
+		Type:     audit.UserRegistered,
+		ActorID:  userID,
+		TargetID: userID,
+		Details:  map[string]interface{}{"email": req.Email},
+	})
 
 	var user models.User
 	var avatar sql.NullString
 	
 	err = config.DB.QueryRow(`
-		SELECT id, username, email, avatar, is_online, last_seen, created_at 
+		SELECT id, username, email, avatar, role, is_online, last_seen, created_at 
 		FROM users WHERE id = ?
 	`, userID).Scan(
-		&user.ID, &user.Username, &user.Email, &avatar,
+		&user.ID, &user.Username, &user.Email, &avatar, &user.Role,
 		&user.IsOnline, &user.LastSeen, &user.CreatedAt,
 	)
 	if err != nil {
@@ -95,52 +117,221 @@ func Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	accountKey := normalizeEmail(req.Email)
+	ipKey := middleware.ClientIP(r)
+	if !checkLoginAllowed(w, ipAttempts, ipKey) || !checkLoginAllowed(w, accountAttempts, accountKey) {
+		return
+	}
+
+	user, err := authenticatePassword(req.Email, req.Password)
+	if err != nil {
+		if err == errInvalidCredentials {
+			recordLoginFailure(accountAttempts, accountKey)
+			recordLoginFailure(ipAttempts, ipKey)
+			recordAudit(r, audit.Event{
+				Type:    audit.LoginFailed,
+				Details: map[string]interface{}{"email": accountKey, "method": "password"},
+			})
+			http.Error(w, "Invalid email or password", http.StatusUnauthorized)
+		} else if err == errDirectoryUnavailable {
+			http.Error(w, "Directory unavailable, try again later", http.StatusServiceUnavailable)
+		} else {
+			log.Printf("Error authenticating user: %v", err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	// Only the account counter is reset; one valid login must not clear the
+	// failures an address has racked up against other accounts
+	recordLoginSuccess(accountAttempts, accountKey)
+
+	finishPasswordLogin(w, r, user)
+}
+
+var (
+	errInvalidCredentials   = errors.New("invalid email or password")
+	errDirectoryUnavailable = errors.New("directory unavailable")
+)
+
+// authenticatePassword checks an email and password against the directory
+// (when enabled) and the users table. Only accounts never linked to the
+// directory may use a local password, so directory users can't log in
+// while it is down or after they were removed from it.
+func authenticatePassword(email, plaintext string) (models.User, error) {
+	var ldapErr error
+	if config.LDAP.Enabled {
+		user, err := loginWithLDAP(email, plaintext)
+		switch err {
+		case nil:
+			return user, nil
+		case ldapauth.ErrInvalidCredentials:
+			return models.User{}, errInvalidCredentials
+		case ldapauth.ErrUserNotFound:
+			// Not a directory user, or no longer one; see below
+			ldapErr = err
+		default:
+			// Local accounts stay usable while the directory is unreachable
+			log.Printf("LDAP authentication error: %v", err)
+			ldapErr = errDirectoryUnavailable
+		}
+	}
+
 	var user models.User
 	var hashedPassword string
 	var avatar sql.NullString
 	
 	err := config.DB.QueryRow(`
-		SELECT id, username, email, password, avatar, is_online, last_seen, created_at 
+		SELECT id, username, email, password, avatar, role, is_online, last_seen, created_at 
 		FROM users WHERE email = ?
-	`, req.Email).Scan(
-		&user.ID, &user.Username, &user.Email, &hashedPassword, &avatar,
+	`, email).Scan(
+		&user.ID, &user.Username, &user.Email, &hashedPassword, &avatar, &user.Role,
 		&user.IsOnline, &user.LastSeen, &user.CreatedAt,
 	)
+	if err == sql.ErrNoRows {
+		if ldapErr == errDirectoryUnavailable {
+			// Possibly a directory user who hasn't logged in yet
+			return models.User{}, ldapErr
+		}
+		return models.User{}, errInvalidCredentials
+	}
 	if err != nil {
-		http.Error(w, "Invalid email or password", http.StatusUnauthorized)
-		return
+		return models.User{}, err
+	}
+
+	if ldapErr != nil {
+		linked, err := hasIdentity(user.ID, ldapProvider)
+		if err != nil {
+			return models.User{}, err
+		}
+		if linked {
+			if ldapErr == ldapauth.ErrUserNotFound {
+				return models.User{}, errInvalidCredentials
+			}
+			return models.User{}, ldapErr
+		}
 	}
 
 	if avatar.Valid {
 		user.Avatar = avatar.String
 	}
 
-	if err := bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(req.Password)); err != nil {
-		http.Error(w, "Invalid email or password", http.StatusUnauthorized)
+	ok, needsRehash, err := password.Verify(plaintext, hashedPassword)
+	if err != nil {
+		return models.User{}, err
+	}
+	if !ok {
+		return models.User{}, errInvalidCredentials
+	}
+
+	// Upgrade hashes made with an old algorithm or cost while we have the
+	// plaintext; a failure here shouldn't stop the login
+	if needsRehash {
+		if rehashed, err := password.Hash(plaintext); err != nil {
+			log.Printf("Error rehashing password for %s: %v", user.ID, err)
+		} else if _, err := config.DB.Exec("UPDATE users SET password = ? WHERE id = ?", rehashed, user.ID); err != nil {
+			log.Printf("Error storing rehashed password for %s: %v", user.ID, err)
+		}
+	}
+
+	return user, nil
+}
+
+// finishPasswordLogin completes a login whose password has been checked.
+// Users with two-factor authentication get a short-lived challenge token
+// instead of a session; it is exchanged at /api/auth/2fa/verify.
+func finishPasswordLogin(w http.ResponseWriter, r *http.Request, user models.User) {
+	totpEnabled, err := twoFactorEnabled(user.ID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
 		return
 	}
 
-	_, err = config.DB.Exec("UPDATE users SET is_online = true, last_seen = NOW() WHERE id = ?", user.ID)
+	if totpEnabled {
+		challengeToken := generateChallengeToken(user.ID, "password")
+		if challengeToken == "" {
+			http.Error(w, "Error generating challenge", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(models.TwoFactorChallengeResponse{
+			TwoFactorRequired: true,
+			ChallengeToken:    challengeToken,
+		})
+		return
+	}
+
+	completeLogin(w, r, user, "password")
+}
+
+// twoFactorEnabled reports whether logins by the user need a second factor
+func twoFactorEnabled(userID string) (bool, error) {
+	var enabled bool
+	err := config.DB.QueryRow("SELECT totp_enabled FROM users WHERE id = ?", userID).Scan(&enabled)
+	return enabled, err
+}
+
+// completeLogin marks the user online, issues a session token and writes the
+// login response
+func completeLogin(w http.ResponseWriter, r *http.Request, user models.User, method string) {
+	response, err := startSession(r, user, method)
+	if err == errAccountSuspended {
+		http.Error(w, "Account suspended", http.StatusForbidden)
+		return
+	}
 	if err != nil {
 		http.Error(w, "Database error", http.StatusInternalServerError)
 		return
 	}
 
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+var errAccountSuspended = errors.New("account suspended")
+
+// startSession marks the user online and issues a session token. Every login
+// method ends here, so this is where suspended accounts are turned away and
+// logins are audited.
+func startSession(r *http.Request, user models.User, method string) (models.LoginResponse, error) {
+	suspended, err := accounts.IsSuspended(user.ID)
+	if err != nil {
+		return models.LoginResponse{}, err
+	}
+	if suspended {
+		recordAudit(r, audit.Event{
+			Type:     audit.LoginFailed,
+			TargetID: user.ID,
+			Details:  map[string]interface{}{"method": method, "reason": "suspended"},
+		})
+		return models.LoginResponse{}, errAccountSuspended
+	}
+
+	_, err = config.DB.Exec("UPDATE users SET is_online = (presence != 'invisible'), last_seen = NOW() WHERE id = ?", user.ID)
+	if err != nil {
+		return models.LoginResponse{}, err
+	}
+
 	user.IsOnline = true
 	user.LastSeen = time.Now()
 
 	token := generateToken(user.ID)
-
-	response := models.LoginResponse{
-		User:  user,
-		Token: token,
-	}
 	
 	// Add user to the in-memory store for WebSocket
 	store.AddUser(user)
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+	recordAudit(r, audit.Event{
+		Type:     audit.LoginSucceeded,
+		ActorID:  user.ID,
+		TargetID: user.ID,
+		Details:  map[string]interface{}{"method": method},
+	})
+
+	return models.LoginResponse{
+		User:  user,
+		Token: token,
+	}, nil
 }
 
 func generateToken(userID string) string {
@@ -156,3 +347,23 @@ func generateToken(userID string) string {
 
 	return tokenString
 }
+
+// generateChallengeToken issues the token returned by Login when a second
+// factor is still required. The purpose claim keeps it from being accepted
+// as a session token by the Auth middleware; method is the first factor,
+// recorded with the login once the second one is checked.
+func generateChallengeToken(userID, method string) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"user_id": userID,
+		"purpose": challengePurpose,
+		"method":  method,
+		"exp":     time.Now().Add(config.TwoFactorChallengeTTL).Unix(),
+	})
+
+	tokenString, err := token.SignedString(config.JWTSecret)
+	if err != nil {
+		return ""
+	}
+
+	return tokenString
+}
@@ -0,0 +1,171 @@
+package handlers
+
+import (
+	"chat-app/internal/config"
+	"chat-app/internal/models"
+	"chat-app/internal/presence"
+	"chat-app/internal/protocol"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// BlockUser stops another user from starting or messaging direct chats with
+// the current user, and hides presence and typing between the two
+func BlockUser(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(models.User)
+	blockedID := chi.URLParam(r, "id")
+
+	if blockedID == user.ID {
+		http.Error(w, "You cannot block yourself", http.StatusBadRequest)
+		return
+	}
+
+	var count int
+	err := config.DB.QueryRow("SELECT COUNT(*) FROM users WHERE id = ?", blockedID).Scan(&count)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if count == 0 {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	_, err = config.DB.Exec(`
+		INSERT IGNORE INTO blocks (blocker_id, blocked_id, created_at)
+		VALUES (?, ?, NOW())
+	`, user.ID, blockedID)
+	if err != nil {
+		http.Error(w, "Error blocking user", http.StatusInternalServerError)
+		log.Printf("Error blocking user: %v", err)
+		return
+	}
+
+	// Each side stops seeing the other online or typing straight away
+	forgetTypingBlocks(user.ID, blockedID)
+	sendStatusTo(blockedID, protocol.StatusEvent{UserID: user.ID, Presence: presence.Offline})
+	sendStatusTo(user.ID, protocol.StatusEvent{UserID: blockedID, Presence: presence.Offline})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// UnblockUser removes a block
+func UnblockUser(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(models.User)
+	blockedID := chi.URLParam(r, "id")
+
+	_, err := config.DB.Exec("DELETE FROM blocks WHERE blocker_id = ? AND blocked_id = ?", user.ID, blockedID)
+	if err != nil {
+		http.Error(w, "Error unblocking user", http.StatusInternalServerError)
+		log.Printf("Error unblocking user: %v", err)
+		return
+	}
+
+	forgetTypingBlocks(user.ID, blockedID)
+
+	// Restore presence unless the other user still blocks this one
+	if blocked, err := isBlockedBetween(user.ID, blockedID); err == nil && !blocked {
+		sendStatusTo(user.ID, userStatusEvent(blockedID))
+		sendStatusTo(blockedID, userStatusEvent(user.ID))
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetBlockedUsers lists the users the current user has blocked
+func GetBlockedUsers(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(models.User)
+
+	rows, err := config.DB.Query(`
+		SELECT u.id, u.username, u.avatar
+		FROM blocks b
+		JOIN users u ON u.id = b.blocked_id
+		WHERE b.blocker_id = ?
+		ORDER BY b.created_at DESC
+	`, user.ID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	users := []models.User{}
+	for rows.Next() {
+		var blocked models.User
+		var avatar sql.NullString
+		if err := rows.Scan(&blocked.ID, &blocked.Username, &avatar); err != nil {
+			http.Error(w, "Error scanning users", http.StatusInternalServerError)
+			return
+		}
+		if avatar.Valid {
+			blocked.Avatar = avatar.String
+		}
+		users = append(users, blocked)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(users)
+}
+
+// isBlockedBetween reports whether either user has blocked the other
+func isBlockedBetween(userA, userB string) (bool, error) {
+	var count int
+	err := config.DB.QueryRow(`
+		SELECT COUNT(*) FROM blocks
+		WHERE (blocker_id = ? AND blocked_id = ?) OR (blocker_id = ? AND blocked_id = ?)
+	`, userA, userB, userB, userA).Scan(&count)
+	return count > 0, err
+}
+
+// blockedUserIDs returns everyone the user has blocked or is blocked by
+func blockedUserIDs(userID string) (map[string]bool, error) {
+	rows, err := config.DB.Query(`
+		SELECT blocked_id FROM blocks WHERE blocker_id = ?
+		UNION
+		SELECT blocker_id FROM blocks WHERE blocked_id = ?
+	`, userID, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	blocked := make(map[string]bool)
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		blocked[id] = true
+	}
+	return blocked, rows.Err()
+}
+
+// isBlockedInDirectChat reports whether a block stands between the sender
+// and the other participant of a one-to-one chat. Group chats are not
+// affected by blocks.
+func isBlockedInDirectChat(chatID, senderID string) (bool, error) {
+	var count int
+	err := config.DB.QueryRow(`
+		SELECT COUNT(*)
+		FROM chats c
+		JOIN chat_participants cp ON cp.chat_id = c.id AND cp.user_id != ?
+		JOIN blocks b ON (b.blocker_id = ? AND b.blocked_id = cp.user_id)
+			OR (b.blocker_id = cp.user_id AND b.blocked_id = ?)
+		WHERE c.id = ? AND c.is_group = false
+	`, senderID, senderID, senderID, chatID).Scan(&count)
+	return count > 0, err
+}
+
+// sendStatusTo tells one user about another user's status
+func sendStatusTo(recipientID string, status protocol.StatusEvent) {
+	msgJSON, _ := json.Marshal(WSMessage{
+		Type:    "status",
+		Payload: status,
+	})
+
+	sendEventToUsers([]string{recipientID}, "status:"+status.UserID, msgJSON)
+}
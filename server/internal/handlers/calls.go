@@ -0,0 +1,591 @@
+package handlers
+
+import (
+	"chat-app/internal/config"
+	"chat-app/internal/models"
+	"chat-app/internal/protocol"
+	"crypto/hmac"
+	"crypto/sha1"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+)
+
+// Call states. Participants are ringing, accepted, declined, missed or
+// left; the call itself is ringing until someone answers, accepted while
+// it lasts and then declined, missed or ended.
+const (
+	callRinging  = "ringing"
+	callAccepted = "accepted"
+	callDeclined = "declined"
+	callMissed   = "missed"
+	callEnded    = "ended"
+	callLeft     = "left"
+)
+
+var (
+	errCallNotFound   = &messageError{http.StatusNotFound, "not_found", "Call not found"}
+	errCallInProgress = &messageError{http.StatusConflict, "call_in_progress", "A call is already in progress in this chat"}
+	errCallState      = &messageError{http.StatusConflict, "invalid_state", "The call can't do that in its current state"}
+	errNobodyToCall   = &messageError{http.StatusBadRequest, "invalid_request", "There is nobody else in this chat"}
+	errCallTooLarge   = &messageError{http.StatusBadRequest, "too_many_participants", "The chat has too many participants for a call"}
+	errInvalidSignal  = &messageError{http.StatusBadRequest, "invalid_request", "Offers and answers need sdp, ICE signals a candidate"}
+	errSignalTarget   = &messageError{http.StatusNotFound, "not_found", "Recipient is not in this call"}
+)
+
+// GetICEServers returns the STUN and TURN servers for calls. TURN
+// credentials follow the TURN REST API convention: the username is the
+// expiry time and user ID, and the password an HMAC of it with the secret
+// shared with the TURN server.
+func GetICEServers(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(models.User)
+
+	resp := models.ICEServersResponse{ICEServers: []models.ICEServer{}}
+	if len(config.STUNURLs) > 0 {
+		resp.ICEServers = append(resp.ICEServers, models.ICEServer{URLs: config.STUNURLs})
+	}
+	if len(config.TURNURLs) > 0 && config.TURNSecret != "" {
+		expiresAt := time.Now().Add(config.TURNCredentialTTL).Truncate(time.Second)
+		username := strconv.FormatInt(expiresAt.Unix(), 10) + ":" + user.ID
+
+		mac := hmac.New(sha1.New, []byte(config.TURNSecret))
+		mac.Write([]byte(username))
+
+		resp.ICEServers = append(resp.ICEServers, models.ICEServer{
+			URLs:       config.TURNURLs,
+			Username:   username,
+			Credential: base64.StdEncoding.EncodeToString(mac.Sum(nil)),
+		})
+		resp.ExpiresAt = &expiresAt
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// GetCall returns a call the current user was part of, e.g. for a call
+// record in a chat
+func GetCall(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(models.User)
+
+	call, err := loadCallFor(user.ID, chi.URLParam(r, "id"))
+	if err != nil {
+		writeMessageError(w, err, "Error loading call")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(call)
+}
+
+// startCall rings the other participants of a chat
+func startCall(userID, chatID string, video bool) (models.Call, error) {
+	if err := checkCanPost(userID, chatID); err != nil {
+		return models.Call{}, err
+	}
+
+	rows, err := config.DB.Query("SELECT user_id FROM chat_participants WHERE chat_id = ?", chatID)
+	if err != nil {
+		return models.Call{}, err
+	}
+	var participantIDs []string
+	for rows.Next() {
+		var pid string
+		if err := rows.Scan(&pid); err != nil {
+			rows.Close()
+			return models.Call{}, err
+		}
+		participantIDs = append(participantIDs, pid)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return models.Call{}, err
+	}
+	if len(participantIDs) < 2 {
+		return models.Call{}, errNobodyToCall
+	}
+	if len(participantIDs) > config.CallMaxParticipants {
+		return models.Call{}, errCallTooLarge
+	}
+
+	callID := uuid.New().String()
+	tx, err := config.DB.Begin()
+	if err != nil {
+		return models.Call{}, err
+	}
+	defer tx.Rollback()
+
+	// Locking the chat row makes concurrent starts in the same chat take
+	// turns, so only the first finds no active call
+	var lockedID string
+	if err := tx.QueryRow("SELECT id FROM chats WHERE id = ? FOR UPDATE", chatID).Scan(&lockedID); err != nil {
+		return models.Call{}, err
+	}
+	var active int
+	err = tx.QueryRow(`
+		SELECT COUNT(*) FROM calls WHERE chat_id = ? AND state IN ('ringing', 'accepted')
+	`, chatID).Scan(&active)
+	if err != nil {
+		return models.Call{}, err
+	}
+	if active > 0 {
+		return models.Call{}, errCallInProgress
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO calls (id, chat_id, initiator_id, video, state, created_at)
+		VALUES (?, ?, ?, ?, 'ringing', NOW())
+	`, callID, chatID, userID, video)
+	if err != nil {
+		return models.Call{}, err
+	}
+
+	// The caller is in the call from the start
+	for _, pid := range participantIDs {
+		if pid == userID {
+			_, err = tx.Exec(`
+				INSERT INTO call_participants (call_id, user_id, state, joined_at)
+				VALUES (?, ?, 'accepted', NOW())
+			`, callID, pid)
+		} else {
+			_, err = tx.Exec(`
+				INSERT INTO call_participants (call_id, user_id, state)
+				VALUES (?, ?, 'ringing')
+			`, callID, pid)
+		}
+		if err != nil {
+			return models.Call{}, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return models.Call{}, err
+	}
+
+	call, err := loadCall(callID)
+	if err != nil {
+		return call, err
+	}
+	notifyCall(call, userID)
+	return call, nil
+}
+
+// acceptCall joins a ringing participant to the call
+func acceptCall(userID, callID string) (models.Call, error) {
+	if _, err := loadCallFor(userID, callID); err != nil {
+		return models.Call{}, err
+	}
+
+	res, err := config.DB.Exec(`
+		UPDATE call_participants cp
+		JOIN calls c ON c.id = cp.call_id
+		SET cp.state = 'accepted', cp.joined_at = NOW()
+		WHERE cp.call_id = ? AND cp.user_id = ? AND cp.state = 'ringing'
+		AND c.state IN ('ringing', 'accepted')
+	`, callID, userID)
+	if err != nil {
+		return models.Call{}, err
+	}
+	if affected, _ := res.RowsAffected(); affected == 0 {
+		return models.Call{}, errCallState
+	}
+
+	_, err = config.DB.Exec(`
+		UPDATE calls SET state = 'accepted', answered_at = NOW() WHERE id = ? AND state = 'ringing'
+	`, callID)
+	if err != nil {
+		return models.Call{}, err
+	}
+
+	call, err := loadCall(callID)
+	if err != nil {
+		return call, err
+	}
+	notifyCall(call, userID)
+	return call, nil
+}
+
+// declineCall turns down a ringing call
+func declineCall(userID, callID string) (models.Call, error) {
+	if _, err := loadCallFor(userID, callID); err != nil {
+		return models.Call{}, err
+	}
+
+	res, err := config.DB.Exec(`
+		UPDATE call_participants SET state = 'declined'
+		WHERE call_id = ? AND user_id = ? AND state = 'ringing'
+	`, callID, userID)
+	if err != nil {
+		return models.Call{}, err
+	}
+	if affected, _ := res.RowsAffected(); affected == 0 {
+		return models.Call{}, errCallState
+	}
+	return settleCall(callID, userID)
+}
+
+// endCall leaves a call. A caller hanging up before anyone answered
+// cancels it, and it ends for everyone once fewer than two are left.
+func endCall(userID, callID string) (models.Call, error) {
+	call, err := loadCallFor(userID, callID)
+	if err != nil {
+		return call, err
+	}
+	if call.State != callRinging && call.State != callAccepted {
+		return call, errCallState
+	}
+
+	if call.State == callRinging && call.InitiatorID == userID {
+		_, err = config.DB.Exec(`
+			UPDATE call_participants SET state = 'missed'
+			WHERE call_id = ? AND state = 'ringing'
+		`, callID)
+		if err != nil {
+			return call, err
+		}
+	}
+
+	// Hanging up on a call that is still ringing declines it
+	_, err = config.DB.Exec(`
+		UPDATE call_participants
+		SET left_at = IF(state = 'accepted', NOW(), left_at),
+			state = IF(state = 'accepted', 'left', 'declined')
+		WHERE call_id = ? AND user_id = ? AND state IN ('accepted', 'ringing')
+	`, callID, userID)
+	if err != nil {
+		return call, err
+	}
+	return settleCall(callID, userID)
+}
+
+// leaveCalls takes a disconnected user out of the calls they were in, as
+// they can no longer be signalled
+func leaveCalls(userID string) {
+	rows, err := config.DB.Query(`
+		SELECT cp.call_id
+		FROM call_participants cp
+		JOIN calls c ON c.id = cp.call_id
+		WHERE cp.user_id = ? AND cp.state = 'accepted' AND c.state IN ('ringing', 'accepted')
+	`, userID)
+	if err != nil {
+		log.Printf("Error loading calls: %v", err)
+		return
+	}
+	var callIDs []string
+	for rows.Next() {
+		var callID string
+		if err := rows.Scan(&callID); err == nil {
+			callIDs = append(callIDs, callID)
+		}
+	}
+	rows.Close()
+
+	for _, callID := range callIDs {
+		if _, err := endCall(userID, callID); err != nil && err != errCallState {
+			log.Printf("Error leaving call %s: %v", callID, err)
+		}
+	}
+}
+
+// settleCall ends the call if too few participants are left, records it in
+// the chat, and tells the participants except excludeUserID where it
+// stands
+func settleCall(callID, excludeUserID string) (models.Call, error) {
+	call, err := loadCall(callID)
+	if err != nil {
+		return call, err
+	}
+	if call.State != callRinging && call.State != callAccepted {
+		return call, nil
+	}
+
+	counts := make(map[string]int)
+	for _, p := range call.Participants {
+		counts[p.State]++
+	}
+
+	var final string
+	switch {
+	case call.State == callRinging && counts[callRinging] == 0:
+		// Nobody answered. It was declined if everyone called said no.
+		final = callMissed
+		if counts[callDeclined] > 0 && counts[callMissed] == 0 {
+			final = callDeclined
+		}
+	case call.State == callAccepted && counts[callAccepted] < 2:
+		final = callEnded
+	}
+
+	if final == "" {
+		notifyCall(call, excludeUserID)
+		return call, nil
+	}
+
+	// Only one request gets to finish the call
+	res, err := config.DB.Exec(`
+		UPDATE calls SET state = ?, ended_at = NOW() WHERE id = ? AND state = ?
+	`, final, callID, call.State)
+	if err != nil {
+		return call, err
+	}
+	if affected, _ := res.RowsAffected(); affected == 0 {
+		return loadCall(callID)
+	}
+
+	_, err = config.DB.Exec(`
+		UPDATE call_participants
+		SET left_at = IF(state = 'accepted', NOW(), left_at),
+			state = IF(state = 'accepted', 'left', 'missed')
+		WHERE call_id = ? AND state IN ('accepted', 'ringing')
+	`, callID)
+	if err != nil {
+		return call, err
+	}
+
+	if call, err = loadCall(callID); err != nil {
+		return call, err
+	}
+	if err := postCallRecord(call); err != nil {
+		log.Printf("Error recording call %s: %v", callID, err)
+	}
+	notifyCall(call, excludeUserID)
+	return call, nil
+}
+
+// postCallRecord adds a finished call to its chat as a message from the
+// caller
+func postCallRecord(call models.Call) error {
+	kind := "voice call"
+	if call.Video {
+		kind = "video call"
+	}
+
+	var content string
+	switch call.State {
+	case callMissed:
+		content = "Missed " + kind
+	case callDeclined:
+		content = "Declined " + kind
+	default:
+		content = "Ended " + kind
+		if call.AnsweredAt != nil && call.EndedAt != nil {
+			content = fmt.Sprintf("%s, %s", content, call.EndedAt.Sub(*call.AnsweredAt).Round(time.Second))
+		}
+	}
+
+	messageID := uuid.New().String()
+	_, err := config.DB.Exec(`
+		INSERT INTO messages (id, chat_id, sender_id, content, is_read, kind, call_id, created_at)
+		VALUES (?, ?, ?, ?, false, 'call', ?, NOW())
+	`, messageID, call.ChatID, call.InitiatorID, content, call.ID)
+	if err != nil {
+		return err
+	}
+
+	msg, err := loadMessage(messageID)
+	if err != nil {
+		return err
+	}
+	broadcastToChat(call.ChatID, "", "message", msg)
+	return nil
+}
+
+// signalCall relays a WebRTC offer, answer or ICE candidate to another
+// participant of a call that hasn't finished
+func signalCall(userID string, cmd protocol.CallSignalCommand) error {
+	switch cmd.Type {
+	case protocol.SignalOffer, protocol.SignalAnswer:
+		if cmd.SDP == "" {
+			return errInvalidSignal
+		}
+	case protocol.SignalICE:
+		if len(cmd.Candidate) == 0 {
+			return errInvalidSignal
+		}
+	default:
+		return errInvalidSignal
+	}
+
+	call, err := loadCallFor(userID, cmd.CallID)
+	if err != nil {
+		return err
+	}
+	if call.State != callRinging && call.State != callAccepted {
+		return errCallState
+	}
+
+	found := false
+	for _, p := range call.Participants {
+		if p.UserID == cmd.ToUserID && p.UserID != userID &&
+			(p.State == callRinging || p.State == callAccepted) {
+			found = true
+		}
+	}
+	if !found {
+		return errSignalTarget
+	}
+
+	msgJSON, _ := json.Marshal(WSMessage{
+		Type: "call_signal",
+		Payload: protocol.CallSignalEvent{
+			CallID:     cmd.CallID,
+			FromUserID: userID,
+			Type:       cmd.Type,
+			SDP:        cmd.SDP,
+			Candidate:  cmd.Candidate,
+		},
+	})
+	sendToUsers([]string{cmd.ToUserID}, msgJSON)
+	return nil
+}
+
+// notifyCall sends the call's state to its participants except
+// excludeUserID, whichever chats they are subscribed to
+func notifyCall(call models.Call, excludeUserID string) {
+	msgJSON, _ := json.Marshal(WSMessage{
+		Type:    "call",
+		Payload: call,
+	})
+
+	var userIDs []string
+	for _, p := range call.Participants {
+		if p.UserID != excludeUserID {
+			userIDs = append(userIDs, p.UserID)
+		}
+	}
+	sendToUsers(userIDs, msgJSON)
+}
+
+// loadCallFor loads a call the user is a participant of
+func loadCallFor(userID, callID string) (models.Call, error) {
+	call, err := loadCall(callID)
+	if err == sql.ErrNoRows {
+		return call, errCallNotFound
+	}
+	if err != nil {
+		return call, err
+	}
+	for _, p := range call.Participants {
+		if p.UserID == userID {
+			return call, nil
+		}
+	}
+	return models.Call{}, errCallNotFound
+}
+
+func loadCall(callID string) (models.Call, error) {
+	var call models.Call
+	var answeredAt, endedAt sql.NullTime
+	err := config.DB.QueryRow(`
+		SELECT id, chat_id, initiator_id, video, state, created_at, answered_at, ended_at
+		FROM calls WHERE id = ?
+	`, callID).Scan(
+		&call.ID, &call.ChatID, &call.InitiatorID, &call.Video,
+		&call.State, &call.CreatedAt, &answeredAt, &endedAt,
+	)
+	if err != nil {
+		return call, err
+	}
+	if answeredAt.Valid {
+		call.AnsweredAt = &answeredAt.Time
+	}
+	if endedAt.Valid {
+		call.EndedAt = &endedAt.Time
+	}
+
+	rows, err := config.DB.Query(`
+		SELECT user_id, state, joined_at, left_at
+		FROM call_participants WHERE call_id = ?
+		ORDER BY user_id
+	`, callID)
+	if err != nil {
+		return call, err
+	}
+	defer rows.Close()
+
+	call.Participants = []models.CallParticipant{}
+	for rows.Next() {
+		var p models.CallParticipant
+		var joinedAt, leftAt sql.NullTime
+		if err := rows.Scan(&p.UserID, &p.State, &joinedAt, &leftAt); err != nil {
+			return call, err
+		}
+		if joinedAt.Valid {
+			p.JoinedAt = &joinedAt.Time
+		}
+		if leftAt.Valid {
+			p.LeftAt = &leftAt.Time
+		}
+		call.Participants = append(call.Participants, p)
+	}
+	return call, rows.Err()
+}
+
+// StartCallSweeper periodically marks participants who let a call ring for
+// longer than config.CallRingTimeout as having missed it
+func StartCallSweeper() {
+	go func() {
+		ticker := time.NewTicker(config.CallRingTimeout / 5)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			callIDs, err := expireRingingCalls()
+			if err != nil {
+				log.Printf("Error expiring calls: %v", err)
+			}
+			for _, callID := range callIDs {
+				if _, err := settleCall(callID, ""); err != nil {
+					log.Printf("Error settling call %s: %v", callID, err)
+				}
+			}
+		}
+	}()
+}
+
+// expireRingingCalls marks participants still ringing after the timeout as
+// missed and returns the affected calls. created_at is set with NOW(), so
+// the cutoff is computed by the database too.
+func expireRingingCalls() ([]string, error) {
+	rows, err := config.DB.Query(`
+		SELECT DISTINCT cp.call_id
+		FROM call_participants cp
+		JOIN calls c ON c.id = cp.call_id
+		WHERE cp.state = 'ringing' AND c.created_at < NOW() - INTERVAL ? SECOND
+	`, int(config.CallRingTimeout/time.Second))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var callIDs []string
+	for rows.Next() {
+		var callID string
+		if err := rows.Scan(&callID); err != nil {
+			return nil, err
+		}
+		callIDs = append(callIDs, callID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, callID := range callIDs {
+		_, err := config.DB.Exec(`
+			UPDATE call_participants SET state = 'missed'
+			WHERE call_id = ? AND state = 'ringing'
+		`, callID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return callIDs, nil
+}
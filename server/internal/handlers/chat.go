@@ -2,10 +2,10 @@
 package handlers
 
 import (
+	"chat-app/internal/audit"
 	"chat-app/internal/config"
+	"chat-app/internal/hub"
 	"chat-app/internal/models"
-	"chat-app/internal/store"
-	
 	"encoding/json"
 	"fmt"
 	"log"
@@ -30,6 +30,7 @@ func GetChats(w http.ResponseWriter, r *http.Request) {
 				WHERE m.chat_id = c.id 
 				AND m.sender_id != ? 
 				AND m.is_read = false
+				AND m.quarantined = false
 			) as unread_count,
 			(
 				SELECT JSON_OBJECT(
@@ -42,6 +43,7 @@ func GetChats(w http.ResponseWriter, r *http.Request) {
 				)
 				FROM messages m
 				WHERE m.chat_id = c.id
+				AND (m.quarantined = false OR m.sender_id = ?)
 				ORDER BY m.created_at DESC
 				LIMIT 1
 			) as last_message
@@ -57,7 +59,7 @@ func GetChats(w http.ResponseWriter, r *http.Request) {
 			FROM chat_participants 
 			WHERE user_id = ?
 		)
-	`, user.ID, user.ID, user.ID)
+	`, user.ID, user.ID, user.ID, user.ID)
 	
 	if err != nil {
 		http.Error(w, "Database error", http.StatusInternalServerError)
@@ -140,6 +142,16 @@ func CreateChat(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, fmt.Sprintf("Invalid participant ID: %s", participantID), http.StatusBadRequest)
 			return
 		}
+
+		blocked, err := isBlockedBetween(user.ID, participantID)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if blocked {
+			http.Error(w, "You cannot start a chat with this user", http.StatusForbidden)
+			return
+		}
 	}
 
 	chatID := uuid.New().String()
@@ -184,6 +196,15 @@ func CreateChat(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	for _, participantID := range append(req.ParticipantIDs, user.ID) {
+		recordAudit(r, audit.Event{
+			Type:     audit.ChatMemberAdded,
+			TargetID: chatID,
+			Details:  map[string]interface{}{"userId": participantID},
+		})
+		hub.JoinChat(participantID, chatID)
+	}
+
 	// Get chat with participants
 	var chat ChatResponse
 	err = config.DB.QueryRow(`
@@ -240,79 +261,63 @@ func SendMessage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if req.Content == "" {
-		http.Error(w, "Message content is required", http.StatusBadRequest)
+	newMessage, err := sendChatMessage(user.ID, chatID, req.Content)
+	if err != nil {
+		writeMessageError(w, err, "Error sending message")
 		return
 	}
 
-	// Verify chat exists and user is participant
-	var count int
-	err := config.DB.QueryRow(`
-		SELECT COUNT(*) FROM chat_participants 
-		WHERE chat_id = ? AND user_id = ?
-	`, chatID, user.ID).Scan(&count)
-	if err != nil || count == 0 {
-		http.Error(w, "Chat not found or user not participant", http.StatusNotFound)
-		return
+	w.Header().Set("Content-Type", "application/json")
+	// Quarantined messages are accepted but not delivered yet
+	if newMessage.Quarantined {
+		w.WriteHeader(http.StatusAccepted)
 	}
+	json.NewEncoder(w).Encode(newMessage)
+}
 
-	// Insert message
-	messageID := uuid.New().String()
-	_, err = config.DB.Exec(`
-		INSERT INTO messages (id, chat_id, sender_id, content, is_read, created_at)
-		VALUES (?, ?, ?, ?, false, NOW())
-	`, messageID, chatID, user.ID, req.Content)
-	if err != nil {
-		http.Error(w, "Error sending message", http.StatusInternalServerError)
+// EditMessage replaces the content of one of the user's own messages
+func EditMessage(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(models.User)
+
+	var req models.SendMessageRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
 		return
 	}
 
-	// Get message with timestamp
-	var newMessage models.Message
-	err = config.DB.QueryRow(`
-		SELECT id, chat_id, sender_id, content, is_read, created_at
-		FROM messages WHERE id = ?
-	`, messageID).Scan(
-		&newMessage.ID, &newMessage.ChatID, &newMessage.SenderID,
-		&newMessage.Content, &newMessage.IsRead, &newMessage.Timestamp,
-	)
+	msg, err := editChatMessage(user.ID, chi.URLParam(r, "id"), chi.URLParam(r, "messageId"), req.Content)
 	if err != nil {
-		http.Error(w, "Error retrieving message", http.StatusInternalServerError)
+		writeMessageError(w, err, "Error editing message")
 		return
 	}
 
-	// Get chat participants for broadcasting
-	rows, err := config.DB.Query(`
-		SELECT user_id FROM chat_participants WHERE chat_id = ? AND user_id != ?
-	`, chatID, user.ID)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(msg)
+}
+
+// DeleteMessage deletes one of the user's own messages
+func DeleteMessage(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(models.User)
+
+	err := deleteChatMessage(user.ID, chi.URLParam(r, "id"), chi.URLParam(r, "messageId"))
 	if err != nil {
-		http.Error(w, "Error getting participants", http.StatusInternalServerError)
+		writeMessageError(w, err, "Error deleting message")
 		return
 	}
-	defer rows.Close()
 
-	var participantIDs []string
-	for rows.Next() {
-		var participantID string
-		if err := rows.Scan(&participantID); err != nil {
-			continue
-		}
-		participantIDs = append(participantIDs, participantID)
-	}
+	w.WriteHeader(http.StatusNoContent)
+}
 
-	// Broadcast to all participants via WebSocket
-	for _, pid := range participantIDs {
-		if conn, exists := store.GetConnection(pid); exists {
-			msgJSON, _ := json.Marshal(map[string]interface{}{
-				"type":    "message",
-				"payload": newMessage,
-			})
-			conn.Send <- msgJSON
-		}
+// MarkChatRead marks everything others sent to the chat as read
+func MarkChatRead(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(models.User)
+
+	if err := markChatRead(user.ID, chi.URLParam(r, "id")); err != nil {
+		writeMessageError(w, err, "Error marking messages as read")
+		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(newMessage)
+	w.WriteHeader(http.StatusNoContent)
 }
 
 func GetMessages(w http.ResponseWriter, r *http.Request) {
@@ -330,13 +335,13 @@ func GetMessages(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Get messages for the chat
+	// Get messages for the chat, hiding other users' quarantined messages
 	rows, err := config.DB.Query(`
-		SELECT id, chat_id, sender_id, content, is_read, created_at
+		SELECT `+messageColumns+`
 		FROM messages 
-		WHERE chat_id = ?
+		WHERE chat_id = ? AND (quarantined = false OR sender_id = ?)
 		ORDER BY created_at ASC
-	`, chatID)
+	`, chatID, user.ID)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Error retrieving messages: %v", err), http.StatusInternalServerError)
 		return
@@ -345,11 +350,7 @@ func GetMessages(w http.ResponseWriter, r *http.Request) {
 
 	var messages []models.Message
 	for rows.Next() {
-		var msg models.Message
-		err := rows.Scan(
-			&msg.ID, &msg.ChatID, &msg.SenderID,
-			&msg.Content, &msg.IsRead, &msg.Timestamp,
-		)
+		msg, err := scanMessage(rows)
 		if err != nil {
 			http.Error(w, fmt.Sprintf("Error scanning message: %v", err), http.StatusInternalServerError)
 			return
@@ -358,12 +359,7 @@ func GetMessages(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Mark all unread messages from others as read
-	_, err = config.DB.Exec(`
-		UPDATE messages
-		SET is_read = true
-		WHERE chat_id = ? AND sender_id != ? AND is_read = false
-	`, chatID, user.ID)
-	if err != nil {
+	if err := markChatRead(user.ID, chatID); err != nil {
 		log.Printf("Error marking messages as read: %v", err)
 	}
 
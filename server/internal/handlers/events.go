@@ -0,0 +1,384 @@
+package handlers
+
+import (
+	"chat-app/internal/config"
+	"chat-app/internal/models"
+	"chat-app/internal/protocol"
+	"chat-app/internal/store"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// bufferedEvent is a frame kept for clients resuming from Last-Event-ID
+type bufferedEvent struct {
+	seq     int64
+	frame   []byte
+	typ     string
+	payload json.RawMessage
+}
+
+// eventSession stands in for a WebSocket for clients reading /api/events.
+// It registers a connection like /ws does and keeps the frames delivered to
+// it so that requests can come and go without losing events. Like a second
+// WebSocket, a new session replaces the user's current connection.
+type eventSession struct {
+	id     string
+	userID string
+	conn   *store.WebSocketConnection
+
+	mutex  sync.Mutex
+	events []bufferedEvent
+	// lastSeq is the sequence number of the newest event
+	lastSeq int64
+	// changed is closed and replaced whenever an event is added or the
+	// session closes
+	changed    chan struct{}
+	closed     bool
+	readers    int
+	lastActive time.Time
+}
+
+var (
+	eventSessions      = make(map[string]*eventSession)
+	eventSessionsMutex = &sync.Mutex{}
+)
+
+// openEventSession returns the user's session and the sequence number to
+// read after. A fresh session is started if the user has none on this
+// instance. resync is set if the events after lastEventID can't be
+// replayed, in which case reading starts from the newest event.
+func openEventSession(userID, lastEventID string) (s *eventSession, after int64, resync bool) {
+	eventSessionsMutex.Lock()
+	s, ok := eventSessions[userID]
+	if ok && s.isClosed() {
+		ok = false
+	}
+	if !ok {
+		s = &eventSession{
+			id:         uuid.New().String(),
+			userID:     userID,
+			conn:       store.NewWebSocketConnection(),
+			changed:    make(chan struct{}),
+			lastActive: time.Now(),
+		}
+		eventSessions[userID] = s
+	}
+	eventSessionsMutex.Unlock()
+
+	if !ok {
+		registerConnection(userID, s.conn)
+		go s.pump()
+		log.Printf("User %s connected via event stream", userID)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if lastEventID == "" {
+		// Everything a new session has received is news to the client
+		if ok {
+			after = s.lastSeq
+		}
+		return s, after, false
+	}
+
+	sessionID, seq, err := parseEventID(lastEventID)
+	if err != nil || sessionID != s.id || seq > s.lastSeq || seq < s.oldestSeq()-1 {
+		return s, s.lastSeq, true
+	}
+	return s, seq, false
+}
+
+// parseEventID splits an event ID into its session and sequence number
+func parseEventID(id string) (string, int64, error) {
+	i := strings.LastIndex(id, ":")
+	if i < 0 {
+		return "", 0, fmt.Errorf("invalid event ID %q", id)
+	}
+	seq, err := strconv.ParseInt(id[i+1:], 10, 64)
+	return id[:i], seq, err
+}
+
+func (s *eventSession) eventID(seq int64) string {
+	return s.id + ":" + strconv.FormatInt(seq, 10)
+}
+
+// oldestSeq is the sequence number of the oldest buffered event. It is
+// called with mutex held.
+func (s *eventSession) oldestSeq() int64 {
+	if len(s.events) == 0 {
+		return s.lastSeq + 1
+	}
+	return s.events[0].seq
+}
+
+func (s *eventSession) isClosed() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.closed
+}
+
+// since returns the events after seq and a channel closed when there are
+// more. missed is set if events after seq were already dropped from the
+// buffer.
+func (s *eventSession) since(seq int64) (events []bufferedEvent, missed bool, changed <-chan struct{}, closed bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if seq < s.oldestSeq()-1 {
+		missed = true
+		seq = s.lastSeq
+	}
+	for _, ev := range s.events {
+		if ev.seq > seq {
+			events = append(events, ev)
+		}
+	}
+	return events, missed, s.changed, s.closed
+}
+
+// attach and detach count the requests reading from the session, which
+// is kept open while there are any
+func (s *eventSession) attach() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.readers++
+	s.lastActive = time.Now()
+}
+
+func (s *eventSession) detach() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.readers--
+	s.lastActive = time.Now()
+}
+
+// add buffers a frame, dropping the oldest once the buffer is full
+func (s *eventSession) add(frame []byte) {
+	var f struct {
+		Type    string          `json:"type"`
+		Payload json.RawMessage `json:"payload"`
+	}
+	if err := json.Unmarshal(frame, &f); err != nil {
+		log.Printf("Error decoding event for user %s: %v", s.userID, err)
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.lastSeq++
+	s.events = append(s.events, bufferedEvent{seq: s.lastSeq, frame: frame, typ: f.Type, payload: f.Payload})
+	if len(s.events) > config.EventBufferSize {
+		s.events = s.events[len(s.events)-config.EventBufferSize:]
+	}
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+func (s *eventSession) close() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.closed {
+		s.closed = true
+		close(s.changed)
+	}
+}
+
+// idle reports whether no request has read from the session for
+// config.EventSessionTimeout
+func (s *eventSession) idle() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.readers == 0 && time.Since(s.lastActive) > config.EventSessionTimeout
+}
+
+// pump does for a session what writePump does for a WebSocket, buffering
+// frames instead of writing them. It ends when the connection is closed,
+// e.g. by a new session or WebSocket, or when the session goes idle.
+func (s *eventSession) pump() {
+	ticker := time.NewTicker(config.EventSessionTimeout / 4)
+	defer func() {
+		ticker.Stop()
+		s.close()
+		unregisterConnection(s.userID, s.conn)
+
+		eventSessionsMutex.Lock()
+		if eventSessions[s.userID] == s {
+			delete(eventSessions, s.userID)
+		}
+		eventSessionsMutex.Unlock()
+	}()
+
+	for {
+		select {
+		case frame, ok := <-s.conn.Send:
+			if !ok {
+				return
+			}
+			s.add(frame)
+		case <-s.conn.Pending():
+			for _, frame := range s.conn.TakePending() {
+				s.add(frame)
+			}
+		case <-ticker.C:
+			if s.idle() {
+				return
+			}
+		case <-s.conn.Done():
+			return
+		}
+	}
+}
+
+// StreamEvents sends the current user's events as Server-Sent Events. Each
+// event's data is the frame /ws would send, and its ID can be sent back in
+// the Last-Event-ID header to resume.
+func StreamEvents(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(models.User)
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	s, after, resync := openEventSession(user.ID, r.Header.Get("Last-Event-ID"))
+	s.attach()
+	defer s.detach()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	// Keep nginx from buffering the stream
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	if resync {
+		writeResyncEvent(w, s, after)
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(config.EventHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		events, missed, changed, closed := s.since(after)
+		if missed {
+			after = s.lastEventSeq()
+			writeResyncEvent(w, s, after)
+		}
+		for _, ev := range events {
+			fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", s.eventID(ev.seq), ev.typ, ev.frame)
+			after = ev.seq
+		}
+		flusher.Flush()
+
+		// The client reconnects and gets a new session
+		if closed {
+			return
+		}
+
+		select {
+		case <-changed:
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": heartbeat\n\n")
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func (s *eventSession) lastEventSeq() int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.lastSeq
+}
+
+func writeResyncEvent(w http.ResponseWriter, s *eventSession, seq int64) {
+	data, _ := json.Marshal(WSMessage{Type: "resync", Payload: protocol.ResyncEvent{}})
+	fmt.Fprintf(w, "id: %s\nevent: resync\ndata: %s\n\n", s.eventID(seq), data)
+}
+
+// PollEvents returns the current user's events after lastEventId, which
+// can also be sent as the Last-Event-ID header. If there are none it waits
+// up to timeout seconds, at most config.LongPollTimeout, for one.
+func PollEvents(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(models.User)
+
+	lastEventID := r.URL.Query().Get("lastEventId")
+	if lastEventID == "" {
+		lastEventID = r.Header.Get("Last-Event-ID")
+	}
+
+	timeout := config.LongPollTimeout
+	if t := r.URL.Query().Get("timeout"); t != "" {
+		seconds, err := strconv.Atoi(t)
+		if err != nil || seconds < 0 {
+			http.Error(w, "Invalid timeout", http.StatusBadRequest)
+			return
+		}
+		if d := time.Duration(seconds) * time.Second; d < timeout {
+			timeout = d
+		}
+	}
+
+	s, after, resync := openEventSession(user.ID, lastEventID)
+	s.attach()
+	defer s.detach()
+
+	resp := models.EventsResponse{Events: []models.Event{}}
+	if resync {
+		resp.Events = append(resp.Events, resyncEvent(s, after))
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+wait:
+	for {
+		events, missed, changed, closed := s.since(after)
+		if missed {
+			after = s.lastEventSeq()
+			resp.Events = append(resp.Events, resyncEvent(s, after))
+		}
+		for _, ev := range events {
+			resp.Events = append(resp.Events, models.Event{
+				ID:      s.eventID(ev.seq),
+				Type:    ev.typ,
+				Payload: ev.payload,
+			})
+			after = ev.seq
+		}
+		if len(resp.Events) > 0 || closed {
+			break
+		}
+
+		select {
+		case <-changed:
+		case <-timer.C:
+			break wait
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	resp.LastEventID = s.eventID(after)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func resyncEvent(s *eventSession, seq int64) models.Event {
+	payload, _ := json.Marshal(protocol.ResyncEvent{})
+	return models.Event{ID: s.eventID(seq), Type: "resync", Payload: payload}
+}
@@ -0,0 +1,218 @@
+package handlers
+
+import (
+	"chat-app/internal/config"
+	"chat-app/internal/filter"
+	"chat-app/internal/models"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+)
+
+var (
+	// defaultFilters is the pipeline built from config.MessageFilter
+	defaultFilters filter.Pipeline
+
+	// Shared by every pipeline so per-chat overrides do not reset the
+	// repeated content history
+	repeatFilter *filter.RepeatedContent
+	ruleFilters  []filter.Filter
+)
+
+// InitMessageFilters builds the message filter pipeline from the
+// configuration and fails on invalid actions or patterns
+func InitMessageFilters() error {
+	cfg := config.MessageFilter
+
+	repeatAction, err := filter.ParseAction(cfg.RepeatAction)
+	if err != nil {
+		return err
+	}
+	repeatFilter = &filter.RepeatedContent{
+		MaxRepeats: cfg.MaxRepeats,
+		Window:     cfg.RepeatWindow,
+		Action:     repeatAction,
+	}
+
+	ruleFilters = nil
+	for _, rule := range cfg.Rules {
+		action, err := filter.ParseAction(rule.Action)
+		if err != nil {
+			return err
+		}
+		f, err := filter.NewRule(rule.Name, rule.Pattern, action, rule.Reason)
+		if err != nil {
+			return err
+		}
+		ruleFilters = append(ruleFilters, f)
+	}
+
+	defaultFilters, err = buildFilters(models.ChatFilterSettings{})
+	return err
+}
+
+// buildFilters assembles the pipeline for a chat's settings on top of the
+// configuration
+func buildFilters(settings models.ChatFilterSettings) (filter.Pipeline, error) {
+	cfg := config.MessageFilter
+
+	maxLength := cfg.MaxLength
+	if settings.MaxLength != nil {
+		maxLength = *settings.MaxLength
+	}
+	maxLinks := cfg.MaxLinks
+	if settings.MaxLinks != nil {
+		maxLinks = *settings.MaxLinks
+	}
+	wordsAction := cfg.BlockedWordsAction
+	if settings.BlockedWordsAction != "" {
+		wordsAction = settings.BlockedWordsAction
+	}
+
+	wordAction, err := filter.ParseAction(wordsAction)
+	if err != nil {
+		return nil, err
+	}
+	linkAction, err := filter.ParseAction(cfg.LinkFloodAction)
+	if err != nil {
+		return nil, err
+	}
+
+	pipeline := filter.Pipeline{&filter.MaxLength{Max: maxLength}}
+
+	words := append(append([]string{}, cfg.BlockedWords...), settings.BlockedWords...)
+	if wordList := filter.NewWordList(words, wordAction); wordList != nil {
+		pipeline = append(pipeline, wordList)
+	}
+
+	pipeline = append(pipeline, ruleFilters...)
+	pipeline = append(pipeline,
+		&filter.LinkFlood{MaxLinks: maxLinks, Action: linkAction},
+		repeatFilter,
+	)
+
+	return pipeline.Without(settings.DisabledFilters), nil
+}
+
+// filtersForChat returns the pipeline for a chat, applying its overrides
+func filtersForChat(chatID string) (filter.Pipeline, error) {
+	settings, found, err := loadChatFilterSettings(chatID)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return defaultFilters, nil
+	}
+	return buildFilters(settings)
+}
+
+// quarantineMessage files a report for a message held back by a filter so
+// it shows up in the moderation queue
+func quarantineMessage(msg models.Message, verdict filter.Verdict) error {
+	_, err := config.DB.Exec(`
+		INSERT INTO message_reports
+			(id, message_id, chat_id, sender_id, reason, details, content, status, created_at)
+		VALUES (?, ?, ?, ?, 'filter', ?, ?, 'open', NOW())
+	`, uuid.New().String(), msg.ID, msg.ChatID, msg.SenderID,
+		fmt.Sprintf("%s: %s", verdict.Filter, verdict.Reason), msg.Content)
+	return err
+}
+
+// GetChatFilters returns a chat's filter overrides
+func GetChatFilters(w http.ResponseWriter, r *http.Request) {
+	settings, _, err := loadChatFilterSettings(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		log.Printf("Error loading chat filter settings: %v", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(settings)
+}
+
+// UpdateChatFilters replaces a chat's filter overrides
+func UpdateChatFilters(w http.ResponseWriter, r *http.Request) {
+	chatID := chi.URLParam(r, "id")
+
+	var settings models.ChatFilterSettings
+	if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if settings.BlockedWordsAction != "" {
+		if _, err := filter.ParseAction(settings.BlockedWordsAction); err != nil {
+			http.Error(w, "Invalid blocked words action", http.StatusBadRequest)
+			return
+		}
+	}
+	if (settings.MaxLength != nil && *settings.MaxLength < 0) || (settings.MaxLinks != nil && *settings.MaxLinks < 0) {
+		http.Error(w, "Limits must not be negative", http.StatusBadRequest)
+		return
+	}
+
+	var count int
+	if err := config.DB.QueryRow("SELECT COUNT(*) FROM chats WHERE id = ?", chatID).Scan(&count); err != nil || count == 0 {
+		http.Error(w, "Chat not found", http.StatusNotFound)
+		return
+	}
+
+	_, err := config.DB.Exec(`
+		REPLACE INTO chat_filter_settings
+			(chat_id, max_length, blocked_words, blocked_words_action, max_links, disabled_filters)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, chatID, settings.MaxLength, nullString(strings.Join(settings.BlockedWords, "\n")),
+		nullString(settings.BlockedWordsAction), settings.MaxLinks,
+		nullString(strings.Join(settings.DisabledFilters, "\n")))
+	if err != nil {
+		http.Error(w, "Error saving filter settings", http.StatusInternalServerError)
+		log.Printf("Error saving chat filter settings: %v", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func loadChatFilterSettings(chatID string) (models.ChatFilterSettings, bool, error) {
+	var settings models.ChatFilterSettings
+	var maxLength, maxLinks sql.NullInt64
+	var words, wordsAction, disabled sql.NullString
+
+	err := config.DB.QueryRow(`
+		SELECT max_length, blocked_words, blocked_words_action, max_links, disabled_filters
+		FROM chat_filter_settings WHERE chat_id = ?
+	`, chatID).Scan(&maxLength, &words, &wordsAction, &maxLinks, &disabled)
+	if err == sql.ErrNoRows {
+		return settings, false, nil
+	}
+	if err != nil {
+		return settings, false, err
+	}
+
+	if maxLength.Valid {
+		n := int(maxLength.Int64)
+		settings.MaxLength = &n
+	}
+	if maxLinks.Valid {
+		n := int(maxLinks.Int64)
+		settings.MaxLinks = &n
+	}
+	settings.BlockedWords = splitLines(words.String)
+	settings.BlockedWordsAction = wordsAction.String
+	settings.DisabledFilters = splitLines(disabled.String)
+
+	return settings, true, nil
+}
+
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, "\n")
+}
@@ -0,0 +1,118 @@
+package handlers
+
+import (
+	"chat-app/internal/config"
+	"chat-app/internal/models"
+	"database/sql"
+	"errors"
+	"log"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+var errEmailNotVerified = errors.New("email address is not verified by the identity provider")
+
+// externalIdentity is a user as described by an outside authentication
+// source such as an OpenID Connect provider or an LDAP directory
+type externalIdentity struct {
+	Provider      string
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Username      string
+	Avatar        string
+	// SyncProfile overwrites the stored username, email and avatar with the
+	// values from the source on every login
+	SyncProfile bool
+}
+
+// userForIdentity finds the user an identity belongs to. Unknown identities
+// are linked to the user with the same verified email, or a new user is
+// created for them.
+func userForIdentity(identity externalIdentity) (models.User, error) {
+	var userID string
+	err := config.DB.QueryRow(`
+		SELECT user_id FROM user_identities WHERE provider = ? AND subject = ?
+	`, identity.Provider, identity.Subject).Scan(&userID)
+	if err == nil {
+		if identity.SyncProfile {
+			syncIdentityProfile(userID, identity)
+		}
+		return loadUser(userID)
+	}
+	if err != sql.ErrNoRows {
+		return models.User{}, err
+	}
+
+	if identity.Email == "" || !identity.EmailVerified {
+		return models.User{}, errEmailNotVerified
+	}
+
+	tx, err := config.DB.Begin()
+	if err != nil {
+		return models.User{}, err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow("SELECT id FROM users WHERE email = ? FOR UPDATE", identity.Email).Scan(&userID)
+	if err == sql.ErrNoRows {
+		userID = uuid.New().String()
+
+		username := identity.Username
+		if username == "" {
+			username = strings.SplitN(identity.Email, "@", 2)[0]
+		}
+
+		// An empty password hash never matches, so these users can only sign
+		// in through their identity provider until they set a password
+		_, err = tx.Exec(`
+			INSERT INTO users (id, username, email, password, avatar, is_online, last_seen, created_at)
+			VALUES (?, ?, ?, '', ?, false, NOW(), NOW())
+		`, userID, username, identity.Email, nullString(identity.Avatar))
+	}
+	if err != nil {
+		return models.User{}, err
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO user_identities (provider, subject, user_id, email, created_at)
+		VALUES (?, ?, ?, ?, NOW())
+	`, identity.Provider, identity.Subject, userID, identity.Email)
+	if err != nil {
+		return models.User{}, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return models.User{}, err
+	}
+
+	if identity.SyncProfile {
+		syncIdentityProfile(userID, identity)
+	}
+	return loadUser(userID)
+}
+
+// syncIdentityProfile copies profile fields from an authoritative source.
+// Failures are logged rather than failing the login.
+func syncIdentityProfile(userID string, identity externalIdentity) {
+	if identity.Username != "" {
+		if _, err := config.DB.Exec("UPDATE users SET username = ? WHERE id = ?", identity.Username, userID); err != nil {
+			log.Printf("Error syncing username for %s: %v", userID, err)
+		}
+	}
+	if identity.Email != "" {
+		// The email may already belong to another account
+		if _, err := config.DB.Exec("UPDATE users SET email = ? WHERE id = ?", identity.Email, userID); err != nil {
+			log.Printf("Error syncing email for %s: %v", userID, err)
+		}
+	}
+	if _, err := config.DB.Exec("UPDATE users SET avatar = ? WHERE id = ?", nullString(identity.Avatar), userID); err != nil {
+		log.Printf("Error syncing avatar for %s: %v", userID, err)
+	}
+}
+
+// nullString stores empty strings as NULL
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
@@ -0,0 +1,148 @@
+package handlers
+
+import (
+	"chat-app/internal/audit"
+	"chat-app/internal/config"
+	"chat-app/internal/hub"
+	"chat-app/internal/ldapauth"
+	"chat-app/internal/models"
+	"database/sql"
+	"log"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+const ldapProvider = "ldap"
+
+// loginWithLDAP authenticates against the directory and returns the
+// provisioned local user. ldapauth.ErrUserNotFound tells the caller to try a
+// local account instead.
+func loginWithLDAP(email, password string) (models.User, error) {
+	entry, err := ldapauth.Authenticate(email, password)
+	if err != nil {
+		return models.User{}, err
+	}
+
+	// The directory is the source of truth for its users, so their email
+	// counts as verified and profile fields are refreshed on every login
+	user, err := userForIdentity(externalIdentity{
+		Provider:      ldapProvider,
+		Subject:       entry.DN,
+		Email:         entry.Email,
+		EmailVerified: true,
+		Username:      entry.Username,
+		Avatar:        entry.Avatar,
+		SyncProfile:   true,
+	})
+	if err != nil {
+		return models.User{}, err
+	}
+
+	if err := syncLDAPGroups(user.ID, entry.Groups); err != nil {
+		// Group chats catch up on the next login
+		log.Printf("Error syncing directory groups for %s: %v", user.ID, err)
+	}
+
+	return user, nil
+}
+
+// hasIdentity reports whether the user has an identity from provider linked
+func hasIdentity(userID, provider string) (bool, error) {
+	var count int
+	err := config.DB.QueryRow(`
+		SELECT COUNT(*) FROM user_identities WHERE user_id = ? AND provider = ?
+	`, userID, provider).Scan(&count)
+	return count > 0, err
+}
+
+// syncLDAPGroups keeps the user's membership of directory-backed group chats
+// in line with their directory groups. Only groups listed in
+// config.LDAP.GroupChats are considered.
+func syncLDAPGroups(userID string, groups []string) error {
+	for groupDN, chatName := range config.LDAP.GroupChats {
+		member := false
+		for _, g := range groups {
+			if strings.EqualFold(g, groupDN) {
+				member = true
+				break
+			}
+		}
+
+		if !member {
+			var chatID string
+			err := config.DB.QueryRow(`
+				SELECT c.id FROM chats c
+				JOIN chat_participants cp ON cp.chat_id = c.id AND cp.user_id = ?
+				WHERE c.ldap_group = ?
+			`, userID, groupDN).Scan(&chatID)
+			if err == sql.ErrNoRows {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+
+			_, err = config.DB.Exec("DELETE FROM chat_participants WHERE chat_id = ? AND user_id = ?", chatID, userID)
+			if err != nil {
+				return err
+			}
+			recordAudit(nil, audit.Event{
+				Type:     audit.ChatMemberRemoved,
+				TargetID: chatID,
+				Details:  map[string]interface{}{"userId": userID, "source": "ldap", "group": groupDN},
+			})
+			hub.LeaveChat(userID, chatID)
+			continue
+		}
+
+		chatID, err := ldapGroupChat(groupDN, chatName)
+		if err != nil {
+			return err
+		}
+
+		res, err := config.DB.Exec(`
+			INSERT IGNORE INTO chat_participants (chat_id, user_id, joined_at)
+			VALUES (?, ?, NOW())
+		`, chatID, userID)
+		if err != nil {
+			return err
+		}
+		if added, _ := res.RowsAffected(); added > 0 {
+			recordAudit(nil, audit.Event{
+				Type:     audit.ChatMemberAdded,
+				TargetID: chatID,
+				Details:  map[string]interface{}{"userId": userID, "source": "ldap", "group": groupDN},
+			})
+			hub.JoinChat(userID, chatID)
+		}
+	}
+
+	return nil
+}
+
+// ldapGroupChat returns the group chat for a directory group, creating it
+// the first time a member logs in
+func ldapGroupChat(groupDN, chatName string) (string, error) {
+	var chatID string
+	err := config.DB.QueryRow("SELECT id FROM chats WHERE ldap_group = ?", groupDN).Scan(&chatID)
+	if err == nil {
+		return chatID, nil
+	}
+	if err != sql.ErrNoRows {
+		return "", err
+	}
+
+	// INSERT IGNORE lets concurrent first logins race on the unique
+	// ldap_group column; whichever insert wins is read back below
+	_, err = config.DB.Exec(`
+		INSERT IGNORE INTO chats (id, name, is_group, ldap_group, created_at)
+		VALUES (?, ?, true, ?, NOW())
+	`, uuid.New().String(), chatName, groupDN)
+	if err != nil {
+		return "", err
+	}
+
+	err = config.DB.QueryRow("SELECT id FROM chats WHERE ldap_group = ?", groupDN).Scan(&chatID)
+	return chatID, err
+}
@@ -0,0 +1,330 @@
+package handlers
+
+import (
+	"chat-app/internal/config"
+	"chat-app/internal/filter"
+	"chat-app/internal/hub"
+	"chat-app/internal/models"
+	"chat-app/internal/protocol"
+	"chat-app/internal/store"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// messageError is a message or call command the client got wrong. The REST
+// handlers reply with status and the WebSocket commands with code.
+type messageError struct {
+	status  int
+	code    string
+	message string
+}
+
+func (e *messageError) Error() string {
+	return e.message
+}
+
+var (
+	errEmptyMessage    = &messageError{http.StatusBadRequest, "invalid_request", "Message content is required"}
+	errChatNotFound    = &messageError{http.StatusNotFound, "not_found", "Chat not found or user not participant"}
+	errMessageNotFound = &messageError{http.StatusNotFound, "not_found", "Message not found"}
+	errNotSender       = &messageError{http.StatusForbidden, "forbidden", "Only the sender can change a message"}
+	errMessageBlocked  = &messageError{http.StatusForbidden, "blocked", "You cannot message this user"}
+	errUnderReview     = &messageError{http.StatusConflict, "under_review", "Message is awaiting review"}
+	errSystemMessage   = &messageError{http.StatusForbidden, "forbidden", "Call records can't be changed"}
+)
+
+// writeMessageError replies to a REST request with a message command error.
+// Anything other than a messageError is logged and reported as fallback.
+func writeMessageError(w http.ResponseWriter, err error, fallback string) {
+	var merr *messageError
+	if errors.As(err, &merr) {
+		http.Error(w, merr.message, merr.status)
+		return
+	}
+	log.Printf("%s: %v", fallback, err)
+	http.Error(w, fallback, http.StatusInternalServerError)
+}
+
+// sendChatMessage checks, filters and stores a message and delivers it to
+// the other participants. Quarantined messages are stored but only
+// delivered once a moderator releases them.
+func sendChatMessage(userID, chatID, content string) (models.Message, error) {
+	if content == "" {
+		return models.Message{}, errEmptyMessage
+	}
+	if err := checkCanPost(userID, chatID); err != nil {
+		return models.Message{}, err
+	}
+
+	verdict, err := runMessageFilters(userID, chatID, content)
+	if err != nil {
+		return models.Message{}, err
+	}
+	quarantined := verdict.Action == filter.Quarantine
+
+	messageID := uuid.New().String()
+	_, err = config.DB.Exec(`
+		INSERT INTO messages (id, chat_id, sender_id, content, is_read, quarantined, created_at)
+		VALUES (?, ?, ?, ?, false, ?, NOW())
+	`, messageID, chatID, userID, verdict.Content, quarantined)
+	if err != nil {
+		return models.Message{}, err
+	}
+
+	msg, err := loadMessage(messageID)
+	if err != nil {
+		return msg, err
+	}
+
+	// Quarantined messages wait for a moderator instead of being delivered
+	if quarantined {
+		if err := quarantineMessage(msg, verdict); err != nil {
+			log.Printf("Error reporting quarantined message: %v", err)
+		}
+		return msg, nil
+	}
+
+	broadcastToChat(chatID, userID, "message", msg)
+	// Sending ends typing, whatever the client says next
+	stopTyping(userID, chatID)
+	return msg, nil
+}
+
+// editChatMessage replaces the content of one of the user's own messages.
+// The new content goes through the filters like a new message would.
+func editChatMessage(userID, chatID, messageID, content string) (models.Message, error) {
+	if content == "" {
+		return models.Message{}, errEmptyMessage
+	}
+
+	msg, err := loadOwnMessage(userID, chatID, messageID)
+	if err != nil {
+		return msg, err
+	}
+	if msg.Quarantined {
+		return msg, errUnderReview
+	}
+	if err := checkCanPost(userID, chatID); err != nil {
+		return msg, err
+	}
+
+	verdict, err := runMessageFilters(userID, chatID, content)
+	if err != nil {
+		return msg, err
+	}
+	quarantined := verdict.Action == filter.Quarantine
+
+	_, err = config.DB.Exec(`
+		UPDATE messages SET content = ?, quarantined = ?, edited_at = NOW() WHERE id = ?
+	`, verdict.Content, quarantined, messageID)
+	if err != nil {
+		return msg, err
+	}
+
+	msg, err = loadMessage(messageID)
+	if err != nil {
+		return msg, err
+	}
+
+	// An edit that needs review disappears for everyone else until a
+	// moderator releases it
+	if quarantined {
+		if err := quarantineMessage(msg, verdict); err != nil {
+			log.Printf("Error reporting quarantined message: %v", err)
+		}
+		broadcastToChat(chatID, userID, "message_deleted", protocol.MessageDeletedEvent{
+			ChatID:    chatID,
+			MessageID: messageID,
+		})
+		return msg, nil
+	}
+
+	broadcastToChat(chatID, userID, "message_edited", msg)
+	return msg, nil
+}
+
+// deleteChatMessage deletes one of the user's own messages
+func deleteChatMessage(userID, chatID, messageID string) error {
+	if _, err := loadOwnMessage(userID, chatID, messageID); err != nil {
+		return err
+	}
+	return removeMessage(chatID, messageID)
+}
+
+// removeMessage deletes a message, resolves its open reports and tells the
+// chat
+func removeMessage(chatID, messageID string) error {
+	if _, err := config.DB.Exec("DELETE FROM messages WHERE id = ?", messageID); err != nil {
+		return err
+	}
+
+	_, err := config.DB.Exec(`
+		UPDATE message_reports SET status = 'actioned', resolved_at = NOW()
+		WHERE message_id = ? AND status = 'open'
+	`, messageID)
+	if err != nil {
+		return err
+	}
+
+	broadcastToChat(chatID, "", "message_deleted", protocol.MessageDeletedEvent{
+		ChatID:    chatID,
+		MessageID: messageID,
+	})
+	return nil
+}
+
+// markChatRead marks the messages others sent to a chat as read and, if
+// there were any, tells the other participants
+func markChatRead(userID, chatID string) error {
+	ok, err := isChatParticipant(chatID, userID)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errChatNotFound
+	}
+
+	res, err := config.DB.Exec(`
+		UPDATE messages
+		SET is_read = true
+		WHERE chat_id = ? AND sender_id != ? AND is_read = false
+	`, chatID, userID)
+	if err != nil {
+		return err
+	}
+	if affected, _ := res.RowsAffected(); affected == 0 {
+		return nil
+	}
+
+	broadcastToChat(chatID, userID, "messages_read", protocol.MessagesReadEvent{
+		ChatID: chatID,
+		UserID: userID,
+		ReadAt: time.Now(),
+	})
+	return nil
+}
+
+// checkCanPost makes sure the user is in the chat and, for one-to-one
+// chats, that no block stands in the way
+func checkCanPost(userID, chatID string) error {
+	ok, err := isChatParticipant(chatID, userID)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errChatNotFound
+	}
+
+	blocked, err := isBlockedInDirectChat(chatID, userID)
+	if err != nil {
+		return err
+	}
+	if blocked {
+		return errMessageBlocked
+	}
+	return nil
+}
+
+// runMessageFilters runs the chat's content filters, turning a rejection
+// into an error for the client
+func runMessageFilters(userID, chatID, content string) (filter.Verdict, error) {
+	filters, err := filtersForChat(chatID)
+	if err != nil {
+		return filter.Verdict{}, err
+	}
+
+	verdict := filters.Run(filter.Message{ChatID: chatID, SenderID: userID, Content: content})
+	if verdict.Action == filter.Reject {
+		return verdict, &messageError{http.StatusBadRequest, "rejected", verdict.Reason}
+	}
+	return verdict, nil
+}
+
+func isChatParticipant(chatID, userID string) (bool, error) {
+	var count int
+	err := config.DB.QueryRow(`
+		SELECT COUNT(*) FROM chat_participants
+		WHERE chat_id = ? AND user_id = ?
+	`, chatID, userID).Scan(&count)
+	return count > 0, err
+}
+
+// loadOwnMessage loads a message the user sent to a chat they are still in
+func loadOwnMessage(userID, chatID, messageID string) (models.Message, error) {
+	msg, err := loadMessage(messageID)
+	if err == sql.ErrNoRows || (err == nil && msg.ChatID != chatID) {
+		return msg, errMessageNotFound
+	}
+	if err != nil {
+		return msg, err
+	}
+	if msg.SenderID != userID {
+		return msg, errNotSender
+	}
+	if msg.Kind != "text" {
+		return msg, errSystemMessage
+	}
+
+	ok, err := isChatParticipant(chatID, userID)
+	if err != nil {
+		return msg, err
+	}
+	if !ok {
+		return msg, errChatNotFound
+	}
+	return msg, nil
+}
+
+func loadMessage(messageID string) (models.Message, error) {
+	row := config.DB.QueryRow(`SELECT `+messageColumns+` FROM messages WHERE id = ?`, messageID)
+	return scanMessage(row)
+}
+
+// messageColumns are the columns scanMessage reads, in order
+const messageColumns = `id, chat_id, sender_id, content, is_read, quarantined, created_at, edited_at, kind, call_id`
+
+func scanMessage(row scanner) (models.Message, error) {
+	var msg models.Message
+	var editedAt sql.NullTime
+	var callID sql.NullString
+	err := row.Scan(
+		&msg.ID, &msg.ChatID, &msg.SenderID,
+		&msg.Content, &msg.IsRead, &msg.Quarantined, &msg.Timestamp, &editedAt,
+		&msg.Kind, &callID,
+	)
+	if editedAt.Valid {
+		msg.EditedAt = &editedAt.Time
+	}
+	msg.CallID = callID.String
+	return msg, err
+}
+
+// broadcastToChat sends an event to the chat's participants except
+// excludeUserID. New messages reach clients subscribed to other chats as a
+// "chat_activity" summary; other events don't reach them at all.
+func broadcastToChat(chatID, excludeUserID, eventType string, payload interface{}) {
+	msgJSON, _ := json.Marshal(WSMessage{
+		Type:    eventType,
+		Payload: payload,
+	})
+
+	var summaryJSON []byte
+	if msg, ok := payload.(models.Message); ok && eventType == "message" {
+		summaryJSON, _ = json.Marshal(WSMessage{
+			Type: "chat_activity",
+			Payload: protocol.ChatActivityEvent{
+				ChatID:    chatID,
+				MessageID: msg.ID,
+				SenderID:  msg.SenderID,
+				Timestamp: msg.Timestamp,
+			},
+		})
+	}
+	hub.SendToChat(chatID, []string{excludeUserID}, msgJSON, summaryJSON, store.PriorityNormal, "")
+}
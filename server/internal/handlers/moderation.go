@@ -0,0 +1,460 @@
+package handlers
+
+import (
+	"chat-app/internal/accounts"
+	"chat-app/internal/audit"
+	"chat-app/internal/config"
+	"chat-app/internal/models"
+	"chat-app/internal/protocol"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+)
+
+// Report reasons users can choose from
+var reportReasons = map[string]bool{
+	"spam":       true,
+	"harassment": true,
+	"hate":       true,
+	"violence":   true,
+	"sexual":     true,
+	"self_harm":  true,
+	"other":      true,
+}
+
+// Moderation actions
+const (
+	actionDismiss       = "dismiss"
+	actionDeleteMessage = "delete_message"
+	actionWarn          = "warn"
+	actionSuspendSender = "suspend_sender"
+	actionRelease       = "release"
+)
+
+// Report statuses. Reports start open and are resolved by a moderator
+// action, once.
+var reportStatuses = map[string]bool{
+	"open":      true,
+	"actioned":  true,
+	"dismissed": true,
+}
+
+// reportContextSize is the number of messages shown before and after the
+// reported one
+const reportContextSize = 5
+
+const reportColumns = `id, message_id, chat_id, sender_id, reporter_id, reason, details, content, status, created_at, resolved_at`
+
+// ReportMessage flags a message for moderator review
+func ReportMessage(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(models.User)
+	chatID := chi.URLParam(r, "id")
+	messageID := chi.URLParam(r, "messageId")
+
+	var req models.ReportMessageRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if !reportReasons[req.Reason] {
+		http.Error(w, "Invalid report reason", http.StatusBadRequest)
+		return
+	}
+
+	// Only participants can report, and only messages in that chat
+	var senderID, content string
+	err := config.DB.QueryRow(`
+		SELECT m.sender_id, m.content
+		FROM messages m
+		JOIN chat_participants cp ON cp.chat_id = m.chat_id AND cp.user_id = ?
+		WHERE m.id = ? AND m.chat_id = ?
+	`, user.ID, messageID, chatID).Scan(&senderID, &content)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if senderID == user.ID {
+		http.Error(w, "You cannot report your own message", http.StatusBadRequest)
+		return
+	}
+
+	reportID := uuid.New().String()
+	res, err := config.DB.Exec(`
+		INSERT IGNORE INTO message_reports
+			(id, message_id, chat_id, sender_id, reporter_id, reason, details, content, status, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, 'open', NOW())
+	`, reportID, messageID, chatID, senderID, user.ID, req.Reason, nullString(req.Details), content)
+	if err != nil {
+		http.Error(w, "Error reporting message", http.StatusInternalServerError)
+		log.Printf("Error reporting message: %v", err)
+		return
+	}
+	if affected, _ := res.RowsAffected(); affected == 0 {
+		http.Error(w, "You have already reported this message", http.StatusConflict)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+}
+
+// GetReports lists reports for moderators, oldest first, filtered by status
+// (open by default)
+func GetReports(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	if status == "" {
+		status = "open"
+	}
+	if !reportStatuses[status] {
+		http.Error(w, "Invalid report status", http.StatusBadRequest)
+		return
+	}
+	limit, offset := pagination(r)
+
+	rows, err := config.DB.Query(`
+		SELECT `+reportColumns+`
+		FROM message_reports
+		WHERE status = ?
+		ORDER BY created_at
+		LIMIT ? OFFSET ?
+	`, status, limit, offset)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	reports := []models.MessageReport{}
+	for rows.Next() {
+		report, err := scanReport(rows)
+		if err != nil {
+			http.Error(w, "Error scanning reports", http.StatusInternalServerError)
+			return
+		}
+		reports = append(reports, report)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reports)
+}
+
+// GetReport returns a report with surrounding messages and its action history
+func GetReport(w http.ResponseWriter, r *http.Request) {
+	report, err := loadReport(chi.URLParam(r, "reportId"))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Report not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	detail := models.ReportDetail{MessageReport: report}
+
+	detail.Context, err = reportContext(report)
+	if err != nil {
+		http.Error(w, "Error retrieving context", http.StatusInternalServerError)
+		log.Printf("Error retrieving report context: %v", err)
+		return
+	}
+
+	detail.Actions, err = reportActions(report.ID)
+	if err != nil {
+		http.Error(w, "Error retrieving actions", http.StatusInternalServerError)
+		log.Printf("Error retrieving report actions: %v", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(detail)
+}
+
+// GetModerationActions lists every moderation decision, newest first
+func GetModerationActions(w http.ResponseWriter, r *http.Request) {
+	limit, offset := pagination(r)
+
+	rows, err := config.DB.Query(`
+		SELECT id, report_id, moderator_id, action, COALESCE(note, ''), created_at
+		FROM moderation_actions
+		ORDER BY created_at DESC
+		LIMIT ? OFFSET ?
+	`, limit, offset)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	actions := []models.ModerationAction{}
+	for rows.Next() {
+		var a models.ModerationAction
+		if err := rows.Scan(&a.ID, &a.ReportID, &a.ModeratorID, &a.Action, &a.Note, &a.CreatedAt); err != nil {
+			http.Error(w, "Error scanning actions", http.StatusInternalServerError)
+			return
+		}
+		actions = append(actions, a)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(actions)
+}
+
+// TakeModerationAction applies a moderator's decision to a report and
+// records it
+func TakeModerationAction(w http.ResponseWriter, r *http.Request) {
+	moderator := r.Context().Value("user").(models.User)
+
+	var req models.ModerationActionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	report, err := loadReport(chi.URLParam(r, "reportId"))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Report not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	status := "actioned"
+	switch req.Action {
+	case actionDismiss, actionRelease:
+		status = "dismissed"
+	case actionDeleteMessage, actionWarn:
+	case actionSuspendSender:
+		if !canSuspend(moderator, report.SenderID) {
+			http.Error(w, "Only admins can suspend moderators and admins", http.StatusForbidden)
+			return
+		}
+	default:
+		http.Error(w, "Invalid action", http.StatusBadRequest)
+		return
+	}
+
+	// Claim the report before acting on it, so a report two moderators
+	// handle at once is only acted on by one of them
+	res, err := config.DB.Exec(`
+		UPDATE message_reports SET status = ?, resolved_at = NOW() WHERE id = ? AND status = 'open'
+	`, status, report.ID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if affected, _ := res.RowsAffected(); affected == 0 {
+		http.Error(w, "Report has already been resolved", http.StatusConflict)
+		return
+	}
+
+	switch req.Action {
+	case actionRelease:
+		// The filter was wrong; deliver the quarantined message
+		err = releaseMessage(report)
+	case actionDeleteMessage:
+		err = deleteReportedMessage(report)
+		if err == nil {
+			recordAudit(r, audit.Event{
+				Type:     audit.MessageDeleted,
+				TargetID: report.MessageID,
+				Details:  map[string]interface{}{"chatId": report.ChatID, "senderId": report.SenderID, "reportId": report.ID},
+			})
+		}
+	case actionWarn:
+		err = warnUser(report, moderator.ID, req.Note)
+	case actionSuspendSender:
+		err = accounts.Suspend(report.SenderID)
+		if err == nil {
+			recordSuspension(r, report.SenderID, "moderation")
+		}
+	}
+	if err != nil {
+		// Put the report back in the queue for another try
+		if _, reopenErr := config.DB.Exec(`
+			UPDATE message_reports SET status = 'open', resolved_at = NULL WHERE id = ?
+		`, report.ID); reopenErr != nil {
+			log.Printf("Error reopening report %s: %v", report.ID, reopenErr)
+		}
+		if err == accounts.ErrNotFound {
+			http.Error(w, "Sender no longer exists", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Error applying action", http.StatusInternalServerError)
+		log.Printf("Error applying moderation action %s: %v", req.Action, err)
+		return
+	}
+
+	_, err = config.DB.Exec(`
+		INSERT INTO moderation_actions (id, report_id, moderator_id, action, note, created_at)
+		VALUES (?, ?, ?, ?, ?, NOW())
+	`, uuid.New().String(), report.ID, moderator.ID, req.Action, nullString(req.Note))
+	if err != nil {
+		http.Error(w, "Error recording action", http.StatusInternalServerError)
+		log.Printf("Error recording moderation action: %v", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deleteReportedMessage removes the message and tells the chat. Other open
+// reports of the same message are resolved along with it.
+func deleteReportedMessage(report models.MessageReport) error {
+	return removeMessage(report.ChatID, report.MessageID)
+}
+
+// releaseMessage delivers a message held back by the content filters
+func releaseMessage(report models.MessageReport) error {
+	res, err := config.DB.Exec(`
+		UPDATE messages SET quarantined = false WHERE id = ? AND quarantined = true
+	`, report.MessageID)
+	if err != nil {
+		return err
+	}
+	if affected, _ := res.RowsAffected(); affected == 0 {
+		// Already released or deleted
+		return nil
+	}
+
+	msg, err := loadMessage(report.MessageID)
+	if err != nil {
+		return err
+	}
+
+	broadcastToChat(msg.ChatID, msg.SenderID, "message", msg)
+	return nil
+}
+
+// warnUser records a warning and notifies the sender if they are connected
+func warnUser(report models.MessageReport, moderatorID, note string) error {
+	_, err := config.DB.Exec(`
+		INSERT INTO user_warnings (id, user_id, moderator_id, report_id, reason, created_at)
+		VALUES (?, ?, ?, ?, ?, NOW())
+	`, uuid.New().String(), report.SenderID, moderatorID, report.ID, nullString(note))
+	if err != nil {
+		return err
+	}
+
+	msgJSON, _ := json.Marshal(WSMessage{
+		Type: "warning",
+		Payload: protocol.WarningEvent{
+			MessageID: report.MessageID,
+			Reason:    report.Reason,
+			Note:      note,
+		},
+	})
+	sendToUsers([]string{report.SenderID}, msgJSON)
+	return nil
+}
+
+// canSuspend keeps moderators from suspending other staff
+func canSuspend(actor models.User, targetID string) bool {
+	if actor.Role == accounts.RoleAdmin {
+		return true
+	}
+	var role string
+	if err := config.DB.QueryRow("SELECT role FROM users WHERE id = ?", targetID).Scan(&role); err != nil {
+		// Let the suspension itself report a missing user
+		return err == sql.ErrNoRows
+	}
+	return role == accounts.RoleUser
+}
+
+func loadReport(reportID string) (models.MessageReport, error) {
+	row := config.DB.QueryRow(`SELECT `+reportColumns+` FROM message_reports WHERE id = ?`, reportID)
+	return scanReport(row)
+}
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanReport(row scanner) (models.MessageReport, error) {
+	var report models.MessageReport
+	var reporterID, details sql.NullString
+	var resolvedAt sql.NullTime
+
+	err := row.Scan(
+		&report.ID, &report.MessageID, &report.ChatID, &report.SenderID, &reporterID,
+		&report.Reason, &details, &report.Content, &report.Status, &report.CreatedAt, &resolvedAt,
+	)
+	if err != nil {
+		return report, err
+	}
+
+	report.ReporterID = reporterID.String
+	report.Details = details.String
+	if resolvedAt.Valid {
+		report.ResolvedAt = &resolvedAt.Time
+	}
+	return report, nil
+}
+
+// reportContext returns up to reportContextSize messages either side of the
+// reported message, in order. Once the message is deleted the window is
+// centred on the time of the report instead.
+func reportContext(report models.MessageReport) ([]models.Message, error) {
+	anchor := report.CreatedAt
+	err := config.DB.QueryRow("SELECT created_at FROM messages WHERE id = ?", report.MessageID).Scan(&anchor)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	rows, err := config.DB.Query(`
+		(SELECT `+messageColumns+`
+		FROM messages WHERE chat_id = ? AND created_at <= ?
+		ORDER BY created_at DESC LIMIT ?)
+		UNION
+		(SELECT `+messageColumns+`
+		FROM messages WHERE chat_id = ? AND created_at > ?
+		ORDER BY created_at ASC LIMIT ?)
+		ORDER BY created_at ASC
+	`, report.ChatID, anchor, reportContextSize+1,
+		report.ChatID, anchor, reportContextSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages := []models.Message{}
+	for rows.Next() {
+		msg, err := scanMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, msg)
+	}
+	return messages, rows.Err()
+}
+
+func reportActions(reportID string) ([]models.ModerationAction, error) {
+	rows, err := config.DB.Query(`
+		SELECT id, report_id, moderator_id, action, COALESCE(note, ''), created_at
+		FROM moderation_actions WHERE report_id = ?
+		ORDER BY created_at
+	`, reportID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	actions := []models.ModerationAction{}
+	for rows.Next() {
+		var a models.ModerationAction
+		if err := rows.Scan(&a.ID, &a.ReportID, &a.ModeratorID, &a.Action, &a.Note, &a.CreatedAt); err != nil {
+			return nil, err
+		}
+		actions = append(actions, a)
+	}
+	return actions, rows.Err()
+}
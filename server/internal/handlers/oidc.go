@@ -0,0 +1,308 @@
+package handlers
+
+import (
+	"chat-app/internal/audit"
+	"chat-app/internal/config"
+	"chat-app/internal/models"
+	"chat-app/internal/oidc"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+var errIdentityLinked = errors.New("this identity is already linked to another account")
+
+// oidcBindingCookie ties an authorization request to the browser that
+// started it. Without it anyone could start a sign-in or link and have
+// someone else's browser finish it with their identity.
+const (
+	oidcBindingCookie = "oidc_binding"
+	oidcCookiePath    = "/api/auth/oidc/"
+)
+
+// GetOIDCProviders lists the configured single sign-on providers
+func GetOIDCProviders(w http.ResponseWriter, r *http.Request) {
+	names := make([]string, 0, len(config.OIDCProviders))
+	for name := range config.OIDCProviders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(names)
+}
+
+// OIDCLogin redirects the browser to the provider's sign-in page
+func OIDCLogin(w http.ResponseWriter, r *http.Request) {
+	authURL, err := beginOIDC(w, r, "")
+	if err != nil {
+		writeOIDCError(w, err)
+		return
+	}
+
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// LinkOIDCIdentity starts linking a provider to the current user's account.
+// The SPA calls this with its Bearer token and navigates to the returned URL.
+// The request must be sent with credentials so the browser keeps the binding
+// cookie the callback checks.
+func LinkOIDCIdentity(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(models.User)
+
+	authURL, err := beginOIDC(w, r, user.ID)
+	if err != nil {
+		writeOIDCError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(models.OIDCAuthorizationResponse{AuthorizationURL: authURL})
+}
+
+// UnlinkOIDCIdentity removes a linked provider from the current user. Users
+// without a password must keep at least one identity to be able to log in.
+func UnlinkOIDCIdentity(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(models.User)
+	provider := chi.URLParam(r, "provider")
+
+	var hashedPassword string
+	var identities int
+	err := config.DB.QueryRow(`
+		SELECT u.password, (SELECT COUNT(*) FROM user_identities WHERE user_id = u.id)
+		FROM users u WHERE u.id = ?
+	`, user.ID).Scan(&hashedPassword, &identities)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if hashedPassword == "" && identities <= 1 {
+		http.Error(w, "Cannot unlink the only way to sign in to this account", http.StatusBadRequest)
+		return
+	}
+
+	res, err := config.DB.Exec("DELETE FROM user_identities WHERE user_id = ? AND provider = ?", user.ID, provider)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if affected, _ := res.RowsAffected(); affected == 0 {
+		http.Error(w, "Identity not linked", http.StatusNotFound)
+		return
+	}
+	recordAudit(r, audit.Event{
+		Type:     audit.IdentityUnlinked,
+		TargetID: user.ID,
+		Details:  map[string]interface{}{"provider": provider},
+	})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// OIDCCallback handles the provider's redirect back after sign-in. The result
+// is passed to the frontend in the URL fragment so the token never reaches
+// server logs through a query string. Users with two-factor authentication
+// get a challengeToken instead, to exchange at /api/auth/2fa/verify.
+func OIDCCallback(w http.ResponseWriter, r *http.Request) {
+	providerName := chi.URLParam(r, "provider")
+	query := r.URL.Query()
+
+	// The binding is single use like the state it belongs to
+	var binding string
+	if cookie, err := r.Cookie(oidcBindingCookie); err == nil {
+		binding = cookie.Value
+	}
+	clearBindingCookie(w)
+
+	if providerError := query.Get("error"); providerError != "" {
+		redirectToFrontend(w, r, url.Values{"error": {providerError}})
+		return
+	}
+
+	authReq, ok, err := oidc.TakeAuth(query.Get("state"))
+	if err != nil {
+		log.Printf("Error loading single sign-on request: %v", err)
+		redirectToFrontend(w, r, url.Values{"error": {"authentication_failed"}})
+		return
+	}
+	if !ok || authReq.Provider != providerName || !authReq.BoundTo(binding) {
+		redirectToFrontend(w, r, url.Values{"error": {"invalid_state"}})
+		return
+	}
+
+	provider, err := oidc.GetProvider(r.Context(), providerName)
+	if err != nil {
+		log.Printf("Error loading identity provider %s: %v", providerName, err)
+		redirectToFrontend(w, r, url.Values{"error": {"provider_unavailable"}})
+		return
+	}
+
+	claims, err := provider.Exchange(r.Context(), query.Get("code"), authReq.CodeVerifier, authReq.Nonce)
+	if err != nil {
+		log.Printf("Error completing sign-in with %s: %v", providerName, err)
+		redirectToFrontend(w, r, url.Values{"error": {"authentication_failed"}})
+		return
+	}
+
+	if authReq.LinkUserID != "" {
+		if err := linkIdentity(providerName, claims, authReq.LinkUserID); err != nil {
+			if err != errIdentityLinked {
+				log.Printf("Error linking identity: %v", err)
+			}
+			redirectToFrontend(w, r, url.Values{"error": {"link_failed"}})
+			return
+		}
+		recordAudit(r, audit.Event{
+			Type:     audit.IdentityLinked,
+			ActorID:  authReq.LinkUserID,
+			TargetID: authReq.LinkUserID,
+			Details:  map[string]interface{}{"provider": providerName},
+		})
+		redirectToFrontend(w, r, url.Values{"linked": {providerName}})
+		return
+	}
+
+	user, err := userForIdentity(externalIdentity{
+		Provider:      providerName,
+		Subject:       claims.Subject,
+		Email:         claims.Email,
+		EmailVerified: claims.EmailVerified,
+		Username:      usernameFromClaims(claims),
+		Avatar:        claims.Picture,
+	})
+	if err != nil {
+		if err == errEmailNotVerified {
+			redirectToFrontend(w, r, url.Values{"error": {"email_not_verified"}})
+			return
+		}
+		log.Printf("Error resolving user for identity: %v", err)
+		redirectToFrontend(w, r, url.Values{"error": {"authentication_failed"}})
+		return
+	}
+
+	// Single sign-on is only the first factor, whether the account was
+	// created through it or linked to a password account by email
+	method := "oidc:" + providerName
+	totpEnabled, err := twoFactorEnabled(user.ID)
+	if err != nil {
+		log.Printf("Error checking two-factor authentication: %v", err)
+		redirectToFrontend(w, r, url.Values{"error": {"authentication_failed"}})
+		return
+	}
+	if totpEnabled {
+		challengeToken := generateChallengeToken(user.ID, method)
+		if challengeToken == "" {
+			redirectToFrontend(w, r, url.Values{"error": {"authentication_failed"}})
+			return
+		}
+		redirectToFrontend(w, r, url.Values{"challengeToken": {challengeToken}})
+		return
+	}
+
+	response, err := startSession(r, user, method)
+	if err == errAccountSuspended {
+		redirectToFrontend(w, r, url.Values{"error": {"account_suspended"}})
+		return
+	}
+	if err != nil {
+		log.Printf("Error starting session: %v", err)
+		redirectToFrontend(w, r, url.Values{"error": {"authentication_failed"}})
+		return
+	}
+
+	redirectToFrontend(w, r, url.Values{"token": {response.Token}})
+}
+
+// beginOIDC records a new authorization request, binds it to the browser
+// with a cookie and returns the provider URL
+func beginOIDC(w http.ResponseWriter, r *http.Request, linkUserID string) (string, error) {
+	providerName := chi.URLParam(r, "provider")
+
+	provider, err := oidc.GetProvider(r.Context(), providerName)
+	if err != nil {
+		return "", err
+	}
+
+	binding, err := oidc.NewBinding()
+	if err != nil {
+		return "", err
+	}
+	state, nonce, challenge, err := oidc.BeginAuth(providerName, linkUserID, binding)
+	if err != nil {
+		return "", err
+	}
+
+	// Lax is still sent on the top-level redirect back from the provider
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcBindingCookie,
+		Value:    binding,
+		Path:     oidcCookiePath,
+		MaxAge:   int(config.OIDCStateTTL.Seconds()),
+		Secure:   strings.HasPrefix(config.OIDCProviders[providerName].RedirectURL, "https://"),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	return provider.AuthCodeURL(state, nonce, challenge), nil
+}
+
+func clearBindingCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcBindingCookie,
+		Path:     oidcCookiePath,
+		MaxAge:   -1,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func writeOIDCError(w http.ResponseWriter, err error) {
+	if err == oidc.ErrUnknownProvider {
+		http.Error(w, "Unknown identity provider", http.StatusNotFound)
+		return
+	}
+	log.Printf("Error starting single sign-on: %v", err)
+	http.Error(w, "Identity provider unavailable", http.StatusBadGateway)
+}
+
+func redirectToFrontend(w http.ResponseWriter, r *http.Request, values url.Values) {
+	http.Redirect(w, r, config.OIDCFrontendURL+"#"+values.Encode(), http.StatusFound)
+}
+
+// linkIdentity attaches an identity to an existing account
+func linkIdentity(provider string, claims *oidc.Claims, userID string) error {
+	var existing string
+	err := config.DB.QueryRow(`
+		SELECT user_id FROM user_identities WHERE provider = ? AND subject = ?
+	`, provider, claims.Subject).Scan(&existing)
+	if err == nil {
+		if existing == userID {
+			return nil
+		}
+		return errIdentityLinked
+	}
+	if err != sql.ErrNoRows {
+		return err
+	}
+
+	// Replace any other identity from the same provider for this user
+	_, err = config.DB.Exec(`
+		REPLACE INTO user_identities (provider, subject, user_id, email, created_at)
+		VALUES (?, ?, ?, ?, NOW())
+	`, provider, claims.Subject, userID, claims.Email)
+	return err
+}
+
+func usernameFromClaims(claims *oidc.Claims) string {
+	if claims.Username != "" {
+		return claims.Username
+	}
+	return claims.Name
+}
@@ -0,0 +1,241 @@
+package handlers
+
+import (
+	"chat-app/internal/config"
+	"chat-app/internal/hub"
+	"chat-app/internal/models"
+	"chat-app/internal/presence"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// presenceError is a problem with a presence request the client can fix
+type presenceError struct {
+	message string
+}
+
+func (e presenceError) Error() string {
+	return e.message
+}
+
+// SetPresence changes the current user's chosen presence state and custom
+// status
+func SetPresence(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(models.User)
+
+	var req models.SetPresenceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	resp, err := applyPresence(user.ID, req)
+	if err != nil {
+		var perr presenceError
+		if errors.As(err, &perr) {
+			http.Error(w, perr.message, http.StatusBadRequest)
+			return
+		}
+		http.Error(w, "Error updating presence", http.StatusInternalServerError)
+		log.Printf("Error updating presence: %v", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// applyPresence saves a presence change and tells the user's chat peers.
+// It is shared by the REST endpoint and the "set_presence" WebSocket frame.
+func applyPresence(userID string, req models.SetPresenceRequest) (models.PresenceResponse, error) {
+	var resp models.PresenceResponse
+
+	if req.State != "" && !presence.ValidChoice(req.State) {
+		return resp, presenceError{"State must be one of online, away, dnd or invisible"}
+	}
+
+	var statusText string
+	if req.StatusText != nil {
+		statusText = strings.TrimSpace(*req.StatusText)
+		if utf8.RuneCountInString(statusText) > maxStatusTextLength {
+			return resp, presenceError{fmt.Sprintf("Status text must be at most %d characters", maxStatusTextLength)}
+		}
+		if req.StatusExpiresAt != nil && !req.StatusExpiresAt.After(time.Now()) {
+			return resp, presenceError{"Status expiry must be in the future"}
+		}
+	} else if req.StatusExpiresAt != nil {
+		return resp, presenceError{"Status expiry requires status text"}
+	}
+
+	if req.State != "" {
+		if _, err := config.DB.Exec("UPDATE users SET presence = ? WHERE id = ?", req.State, userID); err != nil {
+			return resp, err
+		}
+	}
+
+	if req.StatusText != nil {
+		var expiresAt interface{}
+		if statusText != "" && req.StatusExpiresAt != nil {
+			expiresAt = *req.StatusExpiresAt
+		}
+		_, err := config.DB.Exec(`
+			UPDATE users SET status_text = ?, status_expires_at = ? WHERE id = ?
+		`, nullString(statusText), expiresAt, userID)
+		if err != nil {
+			return resp, err
+		}
+		broadcastUserStatus(userID)
+	}
+
+	// The user's connection may be on another instance. Applying the state
+	// here too keeps the reply below current when it is on this one.
+	if req.State != "" {
+		setPresenceChoice(userID, req.State)
+		hub.SetPresence(userID, req.State)
+	}
+
+	return loadPresence(userID)
+}
+
+// setPresenceChoice applies a chosen state if the user is connected to this
+// instance and tells their peers if what they see changed
+func setPresenceChoice(userID, state string) {
+	if !presence.SetChoice(userID, state) {
+		return
+	}
+
+	// Invisible users are stored as offline so REST listings agree with
+	// what the WebSocket peers see
+	_, err := config.DB.Exec("UPDATE users SET is_online = ? WHERE id = ?", state != presence.Invisible, userID)
+	if err != nil {
+		log.Printf("Error updating online status: %v", err)
+	}
+	broadcastUserStatus(userID)
+}
+
+// loadPresence returns the user's own presence. For users connected to
+// another instance, idle detection isn't known here and their chosen state
+// is returned.
+func loadPresence(userID string) (models.PresenceResponse, error) {
+	var resp models.PresenceResponse
+	var choice string
+	var isOnline bool
+	var statusText sql.NullString
+	var expiresAt sql.NullTime
+
+	err := config.DB.QueryRow(`
+		SELECT presence, is_online, status_text, status_expires_at FROM users WHERE id = ?
+	`, userID).Scan(&choice, &isOnline, &statusText, &expiresAt)
+	if err != nil {
+		return resp, err
+	}
+
+	switch _, local := presence.Visible(userID); {
+	case local:
+		resp.State = presence.State(userID)
+	case choice == presence.Invisible:
+		resp.State = presence.Invisible
+	case isOnline:
+		resp.State = choice
+	default:
+		resp.State = presence.Offline
+	}
+	if !expiresAt.Valid || expiresAt.Time.After(time.Now()) {
+		resp.StatusText = statusText.String
+		if expiresAt.Valid {
+			resp.StatusExpiresAt = &expiresAt.Time
+		}
+	}
+	return resp, nil
+}
+
+// loadPresenceChoice returns the state the user last chose explicitly
+func loadPresenceChoice(userID string) (string, error) {
+	var choice string
+	err := config.DB.QueryRow("SELECT presence FROM users WHERE id = ?", userID).Scan(&choice)
+	return choice, err
+}
+
+// visiblePresence returns what other users see for userID. Users connected
+// to another server fall back to the stored online flag.
+func visiblePresence(userID string, isOnline bool) string {
+	if state, ok := presence.Visible(userID); ok {
+		return state
+	}
+	if isOnline {
+		return presence.Online
+	}
+	return presence.Offline
+}
+
+// StartPresenceSweeper periodically moves inactive users to idle or away
+// and clears custom statuses that have expired
+func StartPresenceSweeper() {
+	go func() {
+		ticker := time.NewTicker(config.PresenceSweepInterval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			changed := make(map[string]bool)
+			for _, userID := range presence.Sweep() {
+				changed[userID] = true
+			}
+
+			expired, err := clearExpiredStatuses()
+			if err != nil {
+				log.Printf("Error clearing expired statuses: %v", err)
+			}
+			for _, userID := range expired {
+				changed[userID] = true
+			}
+
+			for userID := range changed {
+				broadcastUserStatus(userID)
+			}
+		}
+	}()
+}
+
+// clearExpiredStatuses removes custom statuses past their expiry and
+// returns the affected users. Expiry times are set by clients and checked
+// against this server's clock when set, so the same clock expires them.
+func clearExpiredStatuses() ([]string, error) {
+	now := time.Now()
+	rows, err := config.DB.Query(`
+		SELECT id FROM users WHERE status_expires_at <= ?
+	`, now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var userIDs []string
+	for rows.Next() {
+		var userID string
+		if err := rows.Scan(&userID); err != nil {
+			return nil, err
+		}
+		userIDs = append(userIDs, userID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, userID := range userIDs {
+		_, err := config.DB.Exec(`
+			UPDATE users SET status_text = NULL, status_expires_at = NULL
+			WHERE id = ? AND status_expires_at <= ?
+		`, userID, now)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return userIDs, nil
+}
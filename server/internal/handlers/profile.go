@@ -0,0 +1,434 @@
+package handlers
+
+import (
+	"chat-app/internal/audit"
+	"chat-app/internal/avatar"
+	"chat-app/internal/config"
+	"chat-app/internal/mail"
+	"chat-app/internal/models"
+	"chat-app/internal/password"
+	"chat-app/internal/presence"
+	"chat-app/internal/store"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	netmail "net/mail"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+)
+
+// Profile field limits, in characters
+const (
+	maxUsernameLength    = 50
+	maxDisplayNameLength = 100
+	maxBioLength         = 500
+	maxStatusTextLength  = 140
+)
+
+// GetProfile returns the current user's full profile
+func GetProfile(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(models.User)
+
+	profile, err := loadUser(user.ID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	profile.Presence = presence.State(user.ID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(profile)
+}
+
+// UpdateProfile changes the username, display name, bio or status text.
+// Empty strings clear the optional fields.
+func UpdateProfile(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(models.User)
+
+	var req models.UpdateProfileRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	var sets []string
+	var args []interface{}
+
+	if req.Username != nil {
+		username := strings.TrimSpace(*req.Username)
+		if username == "" {
+			http.Error(w, "Username is required", http.StatusBadRequest)
+			return
+		}
+		if utf8.RuneCountInString(username) > maxUsernameLength {
+			http.Error(w, fmt.Sprintf("Username must be at most %d characters", maxUsernameLength), http.StatusBadRequest)
+			return
+		}
+		sets = append(sets, "username = ?")
+		args = append(args, username)
+	}
+
+	for _, field := range []struct {
+		value  *string
+		column string
+		name   string
+		max    int
+	}{
+		{req.DisplayName, "display_name", "Display name", maxDisplayNameLength},
+		{req.Bio, "bio", "Bio", maxBioLength},
+		{req.StatusText, "status_text", "Status text", maxStatusTextLength},
+	} {
+		if field.value == nil {
+			continue
+		}
+		value := strings.TrimSpace(*field.value)
+		if utf8.RuneCountInString(value) > field.max {
+			http.Error(w, fmt.Sprintf("%s must be at most %d characters", field.name, field.max), http.StatusBadRequest)
+			return
+		}
+		sets = append(sets, field.column+" = ?")
+		args = append(args, nullString(value))
+	}
+	// A status set here doesn't expire; use PUT /api/me/presence for that
+	if req.StatusText != nil {
+		sets = append(sets, "status_expires_at = NULL")
+	}
+
+	if len(sets) > 0 {
+		args = append(args, user.ID)
+		_, err := config.DB.Exec("UPDATE users SET "+strings.Join(sets, ", ")+" WHERE id = ?", args...)
+		if err != nil {
+			http.Error(w, "Error updating profile", http.StatusInternalServerError)
+			log.Printf("Error updating profile: %v", err)
+			return
+		}
+	}
+
+	profile, err := profileChanged(user.ID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(profile)
+}
+
+// UploadAvatar replaces the current user's avatar with the uploaded image,
+// sent as the "avatar" field of a multipart form
+func UploadAvatar(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(models.User)
+
+	r.Body = http.MaxBytesReader(w, r.Body, config.AvatarMaxUploadBytes)
+	file, _, err := r.FormFile("avatar")
+	if err != nil {
+		http.Error(w, fmt.Sprintf("An image up to %d MB is required in the avatar field", config.AvatarMaxUploadBytes>>20),
+			http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	images, err := avatar.Process(file, config.AvatarSizes)
+	if err == avatar.ErrUnsupportedFormat || err == avatar.ErrTooLarge {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error processing image", http.StatusInternalServerError)
+		log.Printf("Error processing avatar: %v", err)
+		return
+	}
+
+	if err := os.MkdirAll(config.AvatarDir, 0755); err != nil {
+		http.Error(w, "Error storing avatar", http.StatusInternalServerError)
+		log.Printf("Error creating avatar directory: %v", err)
+		return
+	}
+
+	// A new name per upload keeps cached old avatars from being shown
+	base := user.ID + "-" + uuid.New().String()[:8]
+	for size, data := range images {
+		name := fmt.Sprintf("%s-%d.jpg", base, size)
+		if err := os.WriteFile(filepath.Join(config.AvatarDir, name), data, 0644); err != nil {
+			http.Error(w, "Error storing avatar", http.StatusInternalServerError)
+			log.Printf("Error writing avatar: %v", err)
+			return
+		}
+	}
+
+	avatarURL := fmt.Sprintf("/avatars/%s-%d.jpg", base, config.AvatarSizes[0])
+	if _, err := config.DB.Exec("UPDATE users SET avatar = ? WHERE id = ?", avatarURL, user.ID); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	removeOldAvatars(user.ID, base)
+
+	profile, err := profileChanged(user.ID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(profile)
+}
+
+// DeleteAvatar removes the current user's avatar
+func DeleteAvatar(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(models.User)
+
+	if _, err := config.DB.Exec("UPDATE users SET avatar = NULL WHERE id = ?", user.ID); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	removeOldAvatars(user.ID, "")
+
+	if _, err := profileChanged(user.ID); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ServeAvatar serves stored avatar images. Directory listings are not
+// offered.
+func ServeAvatar(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/avatars/")
+	if name == "" || strings.ContainsAny(name, `/\`) || !strings.HasSuffix(name, ".jpg") {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	http.ServeFile(w, r, filepath.Join(config.AvatarDir, name))
+}
+
+// removeOldAvatars deletes a user's stored avatar files except those named
+// with keep. Failures only leave unused files behind.
+func removeOldAvatars(userID, keep string) {
+	files, err := filepath.Glob(filepath.Join(config.AvatarDir, userID+"-*.jpg"))
+	if err != nil {
+		return
+	}
+	for _, f := range files {
+		if keep != "" && strings.HasPrefix(filepath.Base(f), keep+"-") {
+			continue
+		}
+		if err := os.Remove(f); err != nil {
+			log.Printf("Error removing old avatar: %v", err)
+		}
+	}
+}
+
+// profileChanged refreshes the cached user and tells everyone sharing a
+// chat with them about the new profile
+func profileChanged(userID string) (models.User, error) {
+	user, err := loadUser(userID)
+	if err != nil {
+		return user, err
+	}
+
+	// The cached copy keeps the online state the middleware relies on
+	if cached, ok := store.GetUser(userID); ok {
+		user.IsOnline = cached.IsOnline
+		store.AddUser(user)
+	}
+
+	peerIDs, err := chatPeerIDs(userID)
+	if err != nil {
+		log.Printf("Error getting chat participants: %v", err)
+		return user, nil
+	}
+	msgJSON, _ := json.Marshal(WSMessage{
+		Type: "profile_updated",
+		Payload: models.PublicProfile{
+			ID:          user.ID,
+			Username:    user.Username,
+			DisplayName: user.DisplayName,
+			Bio:         user.Bio,
+			StatusText:  user.StatusText,
+			Avatar:      user.Avatar,
+		},
+	})
+	sendEventToUsers(peerIDs, "profile:"+userID, msgJSON)
+
+	return user, nil
+}
+
+// ChangeEmail starts an email change by sending a confirmation link to the
+// new address. The address only changes once the link is followed.
+func ChangeEmail(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(models.User)
+
+	var req models.ChangeEmailRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	address, err := netmail.ParseAddress(strings.TrimSpace(req.Email))
+	if err != nil || address.Name != "" {
+		http.Error(w, "Invalid email address", http.StatusBadRequest)
+		return
+	}
+	email := address.Address
+
+	var hashedPassword, currentEmail string
+	err = config.DB.QueryRow("SELECT password, email FROM users WHERE id = ?", user.ID).Scan(&hashedPassword, &currentEmail)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if hashedPassword != "" {
+		ok, _, err := password.Verify(req.Password, hashedPassword)
+		if err != nil {
+			http.Error(w, "Error checking password", http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			http.Error(w, "Invalid password", http.StatusUnauthorized)
+			return
+		}
+	}
+	if strings.EqualFold(email, currentEmail) {
+		http.Error(w, "This is already your email address", http.StatusBadRequest)
+		return
+	}
+
+	taken, err := emailTaken(email)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if taken {
+		http.Error(w, "Email is already in use", http.StatusBadRequest)
+		return
+	}
+
+	token, err := newVerificationToken()
+	if err != nil {
+		http.Error(w, "Error creating verification", http.StatusInternalServerError)
+		return
+	}
+
+	// Only the latest requested change can be confirmed
+	if _, err := config.DB.Exec("DELETE FROM email_verifications WHERE user_id = ?", user.ID); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	_, err = config.DB.Exec(`
+		INSERT INTO email_verifications (token_hash, user_id, email, expires_at, created_at)
+		VALUES (?, ?, ?, NOW() + INTERVAL ? SECOND, NOW())
+	`, hashVerificationToken(token), user.ID, email, int(config.EmailVerificationTTL/time.Second))
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		log.Printf("Error storing email verification: %v", err)
+		return
+	}
+
+	link := config.EmailVerificationURL + "?" + url.Values{"token": {token}}.Encode()
+	body := fmt.Sprintf("Follow this link to confirm %s as the email address of your account:\n\n%s\n\n"+
+		"The link expires in %s. If you did not ask for this, ignore this email.",
+		email, link, config.EmailVerificationTTL)
+	if err := mail.Send(email, "Confirm your new email address", body); err != nil {
+		http.Error(w, "Error sending verification email", http.StatusInternalServerError)
+		log.Printf("Error sending verification email: %v", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// VerifyEmail completes an email change with the token from the
+// confirmation link. The old address is told about the change.
+func VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	var req models.VerifyEmailRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	var userID, email string
+	var expired bool
+	err := config.DB.QueryRow(`
+		SELECT user_id, email, expires_at <= NOW() FROM email_verifications WHERE token_hash = ?
+	`, hashVerificationToken(req.Token)).Scan(&userID, &email, &expired)
+	if err == sql.ErrNoRows || (err == nil && expired) {
+		http.Error(w, "Invalid or expired link", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	var oldEmail string
+	if err := config.DB.QueryRow("SELECT email FROM users WHERE id = ?", userID).Scan(&oldEmail); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	// The unique index catches an address taken since the link was sent
+	if _, err := config.DB.Exec("UPDATE users SET email = ? WHERE id = ?", email, userID); err != nil {
+		if config.IsDuplicateKey(err) {
+			http.Error(w, "Email is already in use", http.StatusConflict)
+			return
+		}
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		log.Printf("Error changing email: %v", err)
+		return
+	}
+	if _, err := config.DB.Exec("DELETE FROM email_verifications WHERE user_id = ?", userID); err != nil {
+		log.Printf("Error deleting email verifications: %v", err)
+	}
+	store.RemoveUser(userID)
+
+	recordAudit(r, audit.Event{
+		Type:     audit.EmailChanged,
+		ActorID:  userID,
+		TargetID: userID,
+		Details:  map[string]interface{}{"from": oldEmail, "to": email},
+	})
+
+	body := fmt.Sprintf("The email address of your account was changed to %s. "+
+		"If you did not do this, contact an administrator.", email)
+	if err := mail.Send(oldEmail, "Your email address was changed", body); err != nil {
+		log.Printf("Error sending email change notice: %v", err)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func emailTaken(email string) (bool, error) {
+	var count int
+	err := config.DB.QueryRow("SELECT COUNT(*) FROM users WHERE email = ?", email).Scan(&count)
+	return count > 0, err
+}
+
+func newVerificationToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Tokens are stored hashed so a database leak doesn't allow confirming
+// pending changes
+func hashVerificationToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,331 @@
+package handlers
+
+import (
+	"chat-app/internal/audit"
+	"chat-app/internal/config"
+	"chat-app/internal/models"
+	"chat-app/internal/totp"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/google/uuid"
+)
+
+const challengePurpose = "2fa_challenge"
+
+// EnrollTwoFactor generates a new TOTP secret for the current user. The
+// secret is not enforced until it is confirmed with a valid code.
+func EnrollTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(models.User)
+
+	var enabled bool
+	err := config.DB.QueryRow("SELECT totp_enabled FROM users WHERE id = ?", user.ID).Scan(&enabled)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if enabled {
+		http.Error(w, "Two-factor authentication is already enabled", http.StatusBadRequest)
+		return
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		http.Error(w, "Error generating secret", http.StatusInternalServerError)
+		return
+	}
+
+	_, err = config.DB.Exec("UPDATE users SET totp_secret = ?, totp_last_step = 0 WHERE id = ?", secret, user.ID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(models.TwoFactorEnrollResponse{
+		Secret:          secret,
+		ProvisioningURI: totp.ProvisioningURI(config.TOTPIssuer, user.Email, secret),
+	})
+}
+
+// ConfirmTwoFactor enables two-factor authentication once the user proves
+// their authenticator app produces valid codes, and returns the recovery codes
+func ConfirmTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(models.User)
+
+	var req models.TwoFactorCodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	var secret sql.NullString
+	var enabled bool
+	err := config.DB.QueryRow(`
+		SELECT totp_secret, totp_enabled FROM users WHERE id = ?
+	`, user.ID).Scan(&secret, &enabled)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if enabled {
+		http.Error(w, "Two-factor authentication is already enabled", http.StatusBadRequest)
+		return
+	}
+	if !secret.Valid || secret.String == "" {
+		http.Error(w, "Two-factor enrollment has not been started", http.StatusBadRequest)
+		return
+	}
+
+	step, ok := totp.Validate(secret.String, req.Code, time.Now())
+	if !ok {
+		http.Error(w, "Invalid code", http.StatusUnauthorized)
+		return
+	}
+
+	codes, err := replaceRecoveryCodes(user.ID)
+	if err != nil {
+		http.Error(w, "Error generating recovery codes", http.StatusInternalServerError)
+		log.Printf("Error generating recovery codes: %v", err)
+		return
+	}
+
+	_, err = config.DB.Exec(`
+		UPDATE users SET totp_enabled = true, totp_last_step = ? WHERE id = ?
+	`, step, user.ID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	recordAudit(r, audit.Event{Type: audit.TwoFactorEnabled, TargetID: user.ID})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(models.RecoveryCodesResponse{RecoveryCodes: codes})
+}
+
+// DisableTwoFactor turns two-factor authentication off after checking a
+// current TOTP or recovery code
+func DisableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(models.User)
+
+	var req models.TwoFactorCodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	ok, err := checkSecondFactor(user.ID, req.Code)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		log.Printf("Error checking second factor: %v", err)
+		return
+	}
+	if !ok {
+		http.Error(w, "Invalid code", http.StatusUnauthorized)
+		return
+	}
+
+	_, err = config.DB.Exec(`
+		UPDATE users SET totp_enabled = false, totp_secret = NULL, totp_last_step = 0 WHERE id = ?
+	`, user.ID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if _, err := config.DB.Exec("DELETE FROM recovery_codes WHERE user_id = ?", user.ID); err != nil {
+		log.Printf("Error deleting recovery codes: %v", err)
+	}
+	recordAudit(r, audit.Event{Type: audit.TwoFactorDisabled, TargetID: user.ID})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// VerifyTwoFactor exchanges a challenge token from Login and a TOTP or
+// recovery code for a session token
+func VerifyTwoFactor(w http.ResponseWriter, r *http.Request) {
+	var req models.TwoFactorVerifyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	userID, method, ok := parseChallengeToken(req.ChallengeToken)
+	if !ok {
+		http.Error(w, "Invalid or expired challenge", http.StatusUnauthorized)
+		return
+	}
+
+	// Codes are short, so guessing them is throttled like passwords
+	attemptKey := "2fa:" + userID
+	if !checkLoginAllowed(w, accountAttempts, attemptKey) {
+		return
+	}
+
+	ok, err := checkSecondFactor(userID, req.Code)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		log.Printf("Error checking second factor: %v", err)
+		return
+	}
+	if !ok {
+		recordLoginFailure(accountAttempts, attemptKey)
+		recordAudit(r, audit.Event{
+			Type:     audit.LoginFailed,
+			TargetID: userID,
+			Details:  map[string]interface{}{"method": "2fa"},
+		})
+		http.Error(w, "Invalid code", http.StatusUnauthorized)
+		return
+	}
+	recordLoginSuccess(accountAttempts, attemptKey)
+
+	user, err := loadUser(userID)
+	if err != nil {
+		http.Error(w, "Invalid or expired challenge", http.StatusUnauthorized)
+		return
+	}
+
+	completeLogin(w, r, user, method+"+2fa")
+}
+
+// checkSecondFactor accepts either a TOTP code or an unused recovery code.
+// TOTP codes are bound to their time step so each one works only once.
+func checkSecondFactor(userID, code string) (bool, error) {
+	var secret sql.NullString
+	var enabled bool
+	var lastStep int64
+	err := config.DB.QueryRow(`
+		SELECT totp_secret, totp_enabled, totp_last_step FROM users WHERE id = ?
+	`, userID).Scan(&secret, &enabled, &lastStep)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if !enabled || !secret.Valid {
+		return false, nil
+	}
+
+	if step, ok := totp.ValidateAfter(secret.String, code, time.Now(), lastStep); ok {
+		// The step condition makes concurrent use of the same code fail
+		res, err := config.DB.Exec(`
+			UPDATE users SET totp_last_step = ? WHERE id = ? AND totp_last_step < ?
+		`, step, userID, step)
+		if err != nil {
+			return false, err
+		}
+		affected, err := res.RowsAffected()
+		if err != nil {
+			return false, err
+		}
+		return affected == 1, nil
+	}
+
+	res, err := config.DB.Exec(`
+		UPDATE recovery_codes SET used_at = NOW()
+		WHERE user_id = ? AND code_hash = ? AND used_at IS NULL
+	`, userID, hashRecoveryCode(code))
+	if err != nil {
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return affected == 1, nil
+}
+
+// replaceRecoveryCodes discards any existing recovery codes for the user and
+// stores hashes of a fresh set. The plaintext codes are returned once.
+func replaceRecoveryCodes(userID string) ([]string, error) {
+	tx, err := config.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM recovery_codes WHERE user_id = ?", userID); err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, 0, config.RecoveryCodeCount)
+	for i := 0; i < config.RecoveryCodeCount; i++ {
+		code, err := generateRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+		_, err = tx.Exec(`
+			INSERT INTO recovery_codes (id, user_id, code_hash, created_at)
+			VALUES (?, ?, ?, NOW())
+		`, uuid.New().String(), userID, hashRecoveryCode(code))
+		if err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// generateRecoveryCode returns a code formatted as two groups of five
+// characters, e.g. "abcde-fghij"
+func generateRecoveryCode() (string, error) {
+	raw := make([]byte, 7)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	code := strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(raw))[:10]
+	return fmt.Sprintf("%s-%s", code[:5], code[5:]), nil
+}
+
+// hashRecoveryCode normalizes a recovery code so that case, spaces and
+// dashes typed by the user don't matter, then hashes it for storage
+func hashRecoveryCode(code string) string {
+	normalized := strings.ToLower(code)
+	normalized = strings.NewReplacer("-", "", " ", "").Replace(normalized)
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:])
+}
+
+// parseChallengeToken validates a challenge token and returns its user ID
+// and first factor
+func parseChallengeToken(tokenString string) (string, string, bool) {
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return config.JWTSecret, nil
+	})
+	if err != nil || !token.Valid {
+		return "", "", false
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || claims["purpose"] != challengePurpose {
+		return "", "", false
+	}
+
+	userID, ok := claims["user_id"].(string)
+	if !ok {
+		return "", "", false
+	}
+	method, ok := claims["method"].(string)
+	if !ok || method == "" {
+		return "", "", false
+	}
+	return userID, method, true
+}
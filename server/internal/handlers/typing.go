@@ -0,0 +1,146 @@
+package handlers
+
+import (
+	"chat-app/internal/config"
+	"chat-app/internal/hub"
+	"chat-app/internal/protocol"
+	"chat-app/internal/store"
+	"chat-app/internal/typing"
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+)
+
+// typingBlocks caches, by user, the users with a block either way between
+// them, who don't see each other type. Typing frames arrive far more often
+// than blocks change. Changes made on another instance are picked up once
+// config.TypingBlocksTTL has passed.
+type typingBlocks struct {
+	userIDs []string
+	loaded  time.Time
+}
+
+var (
+	typingBlocksCache      = make(map[string]typingBlocks)
+	typingBlocksCacheMutex = &sync.Mutex{}
+)
+
+// handleTyping passes a typing frame on to the chat, throttled
+func handleTyping(userID string, cmd protocol.TypingCommand) {
+	if cmd.IsTyping {
+		if typing.Start(userID, cmd.ChatID) {
+			sendTyping(userID, cmd.ChatID, true)
+		}
+		return
+	}
+	stopTyping(userID, cmd.ChatID)
+}
+
+// stopTyping ends a user's typing indicator in a chat if others were shown
+// one
+func stopTyping(userID, chatID string) {
+	if typing.Stop(userID, chatID) {
+		sendTyping(userID, chatID, false)
+	}
+}
+
+// sendTyping passes a typing state on to the chat's participants connected
+// anywhere, as the hub knows them, except the typist and users with a block
+// either way
+func sendTyping(userID, chatID string, isTyping bool) {
+	// Typing frames come from the user's own connection, so the hub on
+	// this instance knows their chats
+	if !hub.IsMember(userID, chatID) {
+		return
+	}
+	blocked, err := loadTypingBlocks(userID)
+	if err != nil {
+		log.Printf("Error getting blocked users: %v", err)
+		return
+	}
+
+	msgJSON, _ := json.Marshal(WSMessage{
+		Type: "typing",
+		Payload: protocol.TypingEvent{
+			ChatID:   chatID,
+			UserID:   userID,
+			IsTyping: isTyping,
+		},
+	})
+	// Only the latest typing state per chat and user matters
+	exclude := append([]string{userID}, blocked...)
+	hub.SendToChat(chatID, exclude, msgJSON, nil, store.PriorityLow, "typing:"+chatID+":"+userID)
+}
+
+// loadTypingBlocks returns the users with a block either way with userID,
+// from the cache if it is recent enough
+func loadTypingBlocks(userID string) ([]string, error) {
+	typingBlocksCacheMutex.Lock()
+	cached, ok := typingBlocksCache[userID]
+	typingBlocksCacheMutex.Unlock()
+	if ok && time.Since(cached.loaded) < config.TypingBlocksTTL {
+		return cached.userIDs, nil
+	}
+
+	rows, err := config.DB.Query(`
+		SELECT blocked_id FROM blocks WHERE blocker_id = ?
+		UNION
+		SELECT blocker_id FROM blocks WHERE blocked_id = ?
+	`, userID, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	cached = typingBlocks{loaded: time.Now()}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		cached.userIDs = append(cached.userIDs, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	typingBlocksCacheMutex.Lock()
+	typingBlocksCache[userID] = cached
+	typingBlocksCacheMutex.Unlock()
+	return cached.userIDs, nil
+}
+
+// forgetTypingBlocks drops the cached blocks of both users after a block
+// between them was added or removed
+func forgetTypingBlocks(userIDs ...string) {
+	typingBlocksCacheMutex.Lock()
+	defer typingBlocksCacheMutex.Unlock()
+	for _, id := range userIDs {
+		delete(typingBlocksCache, id)
+	}
+}
+
+// StartTypingSweeper periodically ends typing indicators that clients
+// stopped renewing, e.g. because the app was closed mid-sentence, and
+// drops expired blocks from the cache
+func StartTypingSweeper() {
+	go func() {
+		ticker := time.NewTicker(config.TypingTimeout / 4)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			for _, ind := range typing.Sweep() {
+				sendTyping(ind.UserID, ind.ChatID, false)
+			}
+
+			typingBlocksCacheMutex.Lock()
+			for userID, cached := range typingBlocksCache {
+				if time.Since(cached.loaded) >= config.TypingBlocksTTL {
+					delete(typingBlocksCache, userID)
+				}
+			}
+			typingBlocksCacheMutex.Unlock()
+		}
+	}()
+}
@@ -13,6 +13,7 @@ func GetUsers(w http.ResponseWriter, r *http.Request) {
 	rows, err := config.DB.Query(`
 		SELECT id, username, email, avatar, is_online, last_seen
 		FROM users
+		WHERE deleted_at IS NULL
 	`)
 	if err != nil {
 		http.Error(w, "Database error", http.StatusInternalServerError)
@@ -37,6 +38,7 @@ func GetUsers(w http.ResponseWriter, r *http.Request) {
 		if avatar.Valid {
 			user.Avatar = avatar.String
 		}
+		user.Presence = visiblePresence(user.ID, user.IsOnline)
 
 		users = append(users, user)
 	}
@@ -44,3 +46,26 @@ func GetUsers(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(users)
 }
+
+// loadUser reads a single user from the database
+func loadUser(userID string) (models.User, error) {
+	var user models.User
+	var avatar, displayName, bio, statusText sql.NullString
+
+	err := config.DB.QueryRow(`
+		SELECT id, username, email, avatar, display_name, bio, status_text, role, is_online, last_seen, created_at
+		FROM users WHERE id = ?
+	`, userID).Scan(
+		&user.ID, &user.Username, &user.Email, &avatar, &displayName, &bio, &statusText, &user.Role,
+		&user.IsOnline, &user.LastSeen, &user.CreatedAt,
+	)
+	if err != nil {
+		return models.User{}, err
+	}
+
+	user.Avatar = avatar.String
+	user.DisplayName = displayName.String
+	user.Bio = bio.String
+	user.StatusText = statusText.String
+	return user, nil
+}
@@ -3,11 +3,20 @@ package handlers
 
 import (
 	"chat-app/internal/config"
+	"chat-app/internal/hub"
 	"chat-app/internal/models"
+	"chat-app/internal/presence"
+	"chat-app/internal/protocol"
+	"chat-app/internal/ratelimit"
 	"chat-app/internal/store"
+	"chat-app/internal/typing"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"log"
+	"math"
 	"net/http"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
@@ -18,129 +27,523 @@ var upgrader = websocket.Upgrader{
 	CheckOrigin: func(r *http.Request) bool {
 		return true
 	},
+	// The subprotocol is negotiated in HandleWebSocket, which honours the
+	// client's order of preference
+	EnableCompression: config.WebSocketCompression,
 }
 
 type WSMessage struct {
 	Type    string      `json:"type"`
 	Payload interface{} `json:"payload"`
+	// RequestID is set by the client on commands and echoed on the "ack"
+	// or "error" reply
+	RequestID string `json:"requestId,omitempty"`
+}
+
+// GetProtocolSchema describes the WebSocket protocol's commands and events
+func GetProtocolSchema(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(protocol.Schema())
 }
 
 func HandleWebSocket(w http.ResponseWriter, r *http.Request) {
 	user := r.Context().Value("user").(models.User)
 
-	conn, err := upgrader.Upgrade(w, r, nil)
+	// Clients asking only for protocol versions we don't speak are turned
+	// away; clients asking for none get the current version
+	requested := websocket.Subprotocols(r)
+	subprotocol := protocol.Negotiate(requested)
+	if len(requested) > 0 && subprotocol == "" {
+		http.Error(w, "Unsupported WebSocket protocol version", http.StatusBadRequest)
+		return
+	}
+
+	var header http.Header
+	if subprotocol != "" {
+		header = http.Header{"Sec-WebSocket-Protocol": {subprotocol}}
+	}
+	conn, err := upgrader.Upgrade(w, r, header)
 	if err != nil {
 		log.Printf("Error upgrading to WebSocket: %v", err)
 		return
 	}
 
-	wsConn := &store.WebSocketConnection{
-		Send: make(chan []byte, 256),
+	// Compression only applies if the client offered permessage-deflate
+	if err := conn.SetCompressionLevel(config.WebSocketCompressionLevel); err != nil {
+		log.Printf("Error setting WebSocket compression level: %v", err)
 	}
+	enc := protocol.EncodingFor(subprotocol)
 
-	// Store the WebSocket connection for this user
-	store.SetConnection(user.ID, wsConn)
+	wsConn := store.NewWebSocketConnection()
+	registerConnection(user.ID, wsConn)
 	log.Printf("User %s connected via WebSocket", user.ID)
 
-	// Update user's online status in database
+	// Start message handling goroutines
+	go handleWebSocketMessages(user.ID, conn, wsConn, enc)
+	go writePump(user.ID, conn, wsConn, enc)
+}
+
+// registerConnection makes wsConn the user's connection, replacing and
+// closing any other, and marks them online. The queue is shared by /ws and
+// the event stream fallbacks.
+func registerConnection(userID string, wsConn *store.WebSocketConnection) {
+	store.SetConnection(userID, wsConn)
+
+	// Receive what other instances publish for the user and their chats
+	chatIDs, err := userChatIDs(userID)
+	if err != nil {
+		log.Printf("Error loading chats: %v", err)
+	}
+	hub.Register(userID, chatIDs)
+
+	// Start from the state the user chose last time
+	choice, err := loadPresenceChoice(userID)
+	if err != nil {
+		log.Printf("Error loading presence: %v", err)
+	}
+	state := presence.Connect(userID, choice)
+
+	// Update user's online status in database. Invisible users stay offline.
+	// connection_id tells instances whose connection is the latest.
 	_, err = config.DB.Exec(`
 		UPDATE users 
-		SET is_online = true, last_seen = NOW() 
+		SET is_online = ?, last_seen = NOW(), connection_id = ?
 		WHERE id = ?
-	`, user.ID)
+	`, state != presence.Offline, wsConn.ID, userID)
 	if err != nil {
 		log.Printf("Error updating online status: %v", err)
 	}
 
 	// Broadcast user's online status to others
-	broadcastUserStatus(user.ID, true)
-
-	// Start message handling goroutines
-	go handleWebSocketMessages(user.ID, conn, wsConn)
-	go writePump(user.ID, conn, wsConn)
+	broadcastUserStatus(userID)
 }
 
-func handleWebSocketMessages(userID string, conn *websocket.Conn, wsConn *store.WebSocketConnection) {
-	defer func() {
-		conn.Close()
-		store.RemoveConnection(userID)
-
-		// Update user's offline status in database
-		_, err := config.DB.Exec(`
-			UPDATE users 
-			SET is_online = false, last_seen = NOW() 
-			WHERE id = ?
-		`, userID)
-		if err != nil {
-			log.Printf("Error updating offline status: %v", err)
-		}
+func handleWebSocketMessages(userID string, conn *websocket.Conn, wsConn *store.WebSocketConnection, enc protocol.Encoding) {
+	defer unregisterConnection(userID, wsConn)
 
-		broadcastUserStatus(userID, false)
-	}()
+	// Frames over the limit fail the read and end the connection. Pongs
+	// keep pushing the read deadline out, so a peer that has silently gone
+	// away times out after WebSocketPongWait.
+	conn.SetReadLimit(config.WebSocketMaxMessageSize)
+	conn.SetReadDeadline(time.Now().Add(config.WebSocketPongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(config.WebSocketPongWait))
+	})
 
 	for {
-		var wsMsg WSMessage
-		err := conn.ReadJSON(&wsMsg)
+		messageType, data, err := conn.ReadMessage()
 		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				log.Printf("WebSocket read error for user %s: %v", userID, err)
+			}
 			break
 		}
+		conn.SetReadDeadline(time.Now().Add(config.WebSocketPongWait))
 
-		switch wsMsg.Type {
-		case "typing":
-			if data, ok := wsMsg.Payload.(map[string]interface{}); ok {
-				chatID, _ := data["chatId"].(string)
-				isTyping, _ := data["isTyping"].(bool)
-
-				// Get chat participants
-				rows, err := config.DB.Query(`
-					SELECT user_id 
-					FROM chat_participants 
-					WHERE chat_id = ? AND user_id != ?
-				`, chatID, userID)
-				if err != nil {
-					continue
-				}
-				defer rows.Close()
-
-				for rows.Next() {
-					var pid string
-					if err := rows.Scan(&pid); err != nil {
-						continue
-					}
-					if conn, exists := store.GetConnection(pid); exists {
-						msgJSON, _ := json.Marshal(WSMessage{
-							Type: "typing",
-							Payload: map[string]interface{}{
-								"chatId":   chatID,
-								"userId":   userID,
-								"isTyping": isTyping,
-							},
-						})
-						conn.Send <- msgJSON
-					}
+		var frame protocol.Frame
+		var cmd interface{}
+		if (messageType == websocket.BinaryMessage) != enc.Binary() {
+			err = &protocol.Error{Code: protocol.CodeMalformed, Message: "Frame is not in the negotiated encoding"}
+		} else if data, err = enc.Decode(data); err != nil {
+			err = &protocol.Error{Code: protocol.CodeMalformed, Message: "Frame could not be decoded"}
+		} else {
+			frame, cmd, err = protocol.Decode(data)
+		}
+
+		// Drop frames over the per-user limit instead of fanning them out
+		limit := config.WebSocketFrameRateLimit
+		wait, rerr := ratelimit.Take("ws:"+userID, limit.Rate, limit.Burst)
+		if rerr != nil {
+			log.Printf("Error checking WebSocket rate limit: %v", rerr)
+		} else if wait > 0 {
+			sendWSError(wsConn, frame.RequestID, "rate_limited", "Too many messages, slow down", wait)
+			continue
+		}
+
+		if err != nil {
+			perr := err.(*protocol.Error)
+			sendWSError(wsConn, frame.RequestID, perr.Code, perr.Message, 0)
+			continue
+		}
+
+		switch cmd := cmd.(type) {
+		case protocol.ActivityCommand:
+			if presence.Touch(userID) {
+				broadcastUserStatus(userID)
+			}
+
+		case models.SetPresenceRequest:
+			resp, err := applyPresence(userID, cmd)
+			if err != nil {
+				var perr presenceError
+				if errors.As(err, &perr) {
+					sendWSError(wsConn, frame.RequestID, "invalid_presence", perr.message, 0)
+				} else {
+					log.Printf("Error updating presence: %v", err)
+					sendWSError(wsConn, frame.RequestID, "internal_error", "Error updating presence", 0)
 				}
+				continue
 			}
+			sendWSAck(wsConn, frame.RequestID, resp)
+
+		case protocol.SendMessageCommand, protocol.EditMessageCommand,
+			protocol.DeleteMessageCommand, protocol.MarkReadCommand:
+			handleMessageCommand(userID, wsConn, frame.RequestID, cmd)
+
+		case protocol.TypingCommand:
+			handleTyping(userID, cmd)
+
+		case protocol.SubscribeCommand:
+			handleSubscribe(userID, wsConn, frame.RequestID, cmd.ChatIDs)
+
+		case protocol.CallStartCommand, protocol.CallAcceptCommand, protocol.CallDeclineCommand,
+			protocol.CallEndCommand, protocol.CallSignalCommand:
+			handleCallCommand(userID, wsConn, frame.RequestID, cmd)
+
+		case protocol.UnsubscribeCommand:
+			wsConn.Unsubscribe(cmd.ChatIDs)
+			sendWSAck(wsConn, frame.RequestID, protocol.SubscriptionsResult{ChatIDs: wsConn.Subscriptions()})
 		}
 	}
 }
 
-func writePump(userID string, conn *websocket.Conn, wsConn *store.WebSocketConnection) {
-	for {
-		message, ok := <-wsConn.Send
-		if !ok {
-			conn.WriteMessage(websocket.CloseMessage, []byte{})
+// unregisterConnection tears a connection down once its reader has gone.
+// For /ws the write pump sees Send closed, sends a close frame and closes
+// the socket. If the user has already reconnected, on this instance or
+// another, they stay online and in their calls.
+func unregisterConnection(userID string, wsConn *store.WebSocketConnection) {
+	wsConn.CloseSend()
+
+	if !store.RemoveConnection(userID, wsConn) {
+		if _, err := config.DB.Exec("UPDATE users SET last_seen = NOW() WHERE id = ?", userID); err != nil {
+			log.Printf("Error updating last seen: %v", err)
+		}
+		return
+	}
+	presence.Disconnect(userID)
+	hub.Unregister(userID)
+
+	// Nobody should be left watching the user type
+	for _, chatID := range typing.StopAll(userID) {
+		sendTyping(userID, chatID, false)
+	}
+
+	// Update user's offline status in database, unless they have connected
+	// again since, possibly to another instance or over another transport
+	res, err := config.DB.Exec(`
+		UPDATE users 
+		SET is_online = false, last_seen = NOW(), connection_id = NULL
+		WHERE id = ? AND connection_id = ?
+	`, userID, wsConn.ID)
+	if err != nil {
+		log.Printf("Error updating offline status: %v", err)
+	} else if affected, _ := res.RowsAffected(); affected > 0 {
+		// Calls can't be signalled without a connection
+		leaveCalls(userID)
+	}
+
+	broadcastUserStatus(userID)
+}
+
+// chatParticipantIDs returns the participants of a chat except excludeUserID
+func chatParticipantIDs(chatID, excludeUserID string) ([]string, error) {
+	rows, err := config.DB.Query(`
+		SELECT user_id FROM chat_participants WHERE chat_id = ? AND user_id != ?
+	`, chatID, excludeUserID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var participantIDs []string
+	for rows.Next() {
+		var participantID string
+		if err := rows.Scan(&participantID); err != nil {
+			continue
+		}
+		participantIDs = append(participantIDs, participantID)
+	}
+	return participantIDs, rows.Err()
+}
+
+// sendToUsers queues a frame for every listed user, on whichever instance
+// they are connected to. It never waits on a slow client; see
+// store.PriorityNormal.
+func sendToUsers(userIDs []string, msgJSON []byte) {
+	hub.SendToUsers(userIDs, msgJSON, store.PriorityNormal, "")
+}
+
+// sendEventToUsers queues a low priority frame, such as a status update,
+// that supersedes any earlier unsent frame with the same key
+func sendEventToUsers(userIDs []string, key string, msgJSON []byte) {
+	hub.SendToUsers(userIDs, msgJSON, store.PriorityLow, key)
+}
+
+// InitBroker connects to the broker shared with other instances
+func InitBroker() error {
+	if err := hub.Init(); err != nil {
+		return err
+	}
+	hub.OnPresence(setPresenceChoice)
+	return nil
+}
+
+// userChatIDs returns the chats a user is in
+func userChatIDs(userID string) ([]string, error) {
+	rows, err := config.DB.Query("SELECT chat_id FROM chat_participants WHERE user_id = ?", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var chatIDs []string
+	for rows.Next() {
+		var chatID string
+		if err := rows.Scan(&chatID); err != nil {
+			return nil, err
+		}
+		chatIDs = append(chatIDs, chatID)
+	}
+	return chatIDs, rows.Err()
+}
+
+// handleMessageCommand runs a message command with the same checks as the
+// REST endpoints and replies with an "ack" carrying the result, or an
+// "error"
+func handleMessageCommand(userID string, wsConn *store.WebSocketConnection, requestID string, cmd interface{}) {
+	var result interface{}
+	var err error
+	switch cmd := cmd.(type) {
+	case protocol.SendMessageCommand:
+		// Shares the bucket of the REST endpoint's rate limit
+		limit := config.MessageRateLimit
+		wait, rerr := ratelimit.Take("messages:user:"+userID, limit.Rate, limit.Burst)
+		if rerr != nil {
+			log.Printf("Error checking rate limit: %v", rerr)
+		} else if wait > 0 {
+			sendWSError(wsConn, requestID, "rate_limited", "Too many requests", wait)
+			return
+		}
+		result, err = sendChatMessage(userID, cmd.ChatID, cmd.Content)
+	case protocol.EditMessageCommand:
+		result, err = editChatMessage(userID, cmd.ChatID, cmd.MessageID, cmd.Content)
+	case protocol.DeleteMessageCommand:
+		err = deleteChatMessage(userID, cmd.ChatID, cmd.MessageID)
+	case protocol.MarkReadCommand:
+		err = markChatRead(userID, cmd.ChatID)
+	}
+	replyToCommand(wsConn, requestID, result, err)
+}
+
+// handleCallCommand runs a call command and replies with the call's new
+// state, or an "error"
+func handleCallCommand(userID string, wsConn *store.WebSocketConnection, requestID string, cmd interface{}) {
+	var result interface{}
+	var err error
+	switch cmd := cmd.(type) {
+	case protocol.CallStartCommand:
+		result, err = startCall(userID, cmd.ChatID, cmd.Video)
+	case protocol.CallAcceptCommand:
+		result, err = acceptCall(userID, cmd.CallID)
+	case protocol.CallDeclineCommand:
+		result, err = declineCall(userID, cmd.CallID)
+	case protocol.CallEndCommand:
+		result, err = endCall(userID, cmd.CallID)
+	case protocol.CallSignalCommand:
+		err = signalCall(userID, cmd)
+	}
+	replyToCommand(wsConn, requestID, result, err)
+}
+
+// replyToCommand acks a command with its result or reports its error.
+// Anything other than a messageError is logged and reported as internal.
+func replyToCommand(wsConn *store.WebSocketConnection, requestID string, result interface{}, err error) {
+	if err != nil {
+		var merr *messageError
+		if errors.As(err, &merr) {
+			sendWSError(wsConn, requestID, merr.code, merr.message, 0)
 			return
 		}
+		log.Printf("Error handling command: %v", err)
+		sendWSError(wsConn, requestID, "internal_error", "Something went wrong", 0)
+		return
+	}
+	sendWSAck(wsConn, requestID, result)
+}
 
-		err := conn.WriteMessage(websocket.TextMessage, message)
+// handleSubscribe subscribes the connection to chats after checking the
+// user is in each of them. Nothing is subscribed if any check fails.
+func handleSubscribe(userID string, wsConn *store.WebSocketConnection, requestID string, chatIDs []string) {
+	for _, chatID := range chatIDs {
+		if hub.IsMember(userID, chatID) {
+			continue
+		}
+		// Membership is cached when the user connects and kept up to date
+		// through the hub, but a chat created a moment ago may not have
+		// reached it yet
+		ok, err := isChatParticipant(chatID, userID)
 		if err != nil {
+			log.Printf("Error checking chat membership: %v", err)
+			sendWSError(wsConn, requestID, "internal_error", "Something went wrong", 0)
+			return
+		}
+		if !ok {
+			sendWSError(wsConn, requestID, errChatNotFound.code, errChatNotFound.message, 0)
+			return
+		}
+	}
+
+	wsConn.Subscribe(chatIDs)
+	sendWSAck(wsConn, requestID, protocol.SubscriptionsResult{ChatIDs: wsConn.Subscriptions()})
+}
+
+// sendWSAck replies to a command that succeeded
+func sendWSAck(wsConn *store.WebSocketConnection, requestID string, result interface{}) {
+	msgJSON, _ := json.Marshal(WSMessage{
+		Type:      "ack",
+		Payload:   result,
+		RequestID: requestID,
+	})
+	wsConn.Deliver(msgJSON, store.PriorityNormal, "")
+}
+
+// sendWSError tells the client a frame was rejected. The send never blocks
+// the read loop. Errors without a request ID to answer are dropped if the
+// client isn't draining its queue.
+func sendWSError(wsConn *store.WebSocketConnection, requestID, code, message string, retryAfter time.Duration) {
+	payload := protocol.ErrorEvent{
+		Code:    code,
+		Message: message,
+	}
+	if retryAfter > 0 {
+		payload.RetryAfter = int(math.Ceil(retryAfter.Seconds()))
+	}
+
+	msgJSON, _ := json.Marshal(WSMessage{
+		Type:      "error",
+		Payload:   payload,
+		RequestID: requestID,
+	})
+
+	if requestID != "" {
+		wsConn.Deliver(msgJSON, store.PriorityNormal, "")
+		return
+	}
+	wsConn.TrySend(msgJSON)
+}
+
+// writePump is the only writer to conn. It also sends the keepalive pings.
+// Closing the socket on the way out ends the read loop if it is still
+// running.
+func writePump(userID string, conn *websocket.Conn, wsConn *store.WebSocketConnection, enc protocol.Encoding) {
+	ticker := time.NewTicker(config.WebSocketPingInterval)
+	defer func() {
+		ticker.Stop()
+		conn.Close()
+	}()
+
+	for {
+		select {
+		case message, ok := <-wsConn.Send:
+			if !ok {
+				conn.SetWriteDeadline(time.Now().Add(config.WebSocketWriteWait))
+				conn.WriteMessage(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+				return
+			}
+
+			if err := writeFrame(conn, enc, message); err != nil {
+				return
+			}
+		case <-wsConn.Pending():
+			for _, message := range wsConn.TakePending() {
+				if err := writeFrame(conn, enc, message); err != nil {
+					return
+				}
+			}
+		case <-ticker.C:
+			conn.SetWriteDeadline(time.Now().Add(config.WebSocketWriteWait))
+			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		case <-wsConn.Done():
+			// Closed by the server, e.g. an admin disconnecting the user,
+			// the user connecting again elsewhere or the client not keeping
+			// up with its queue
+			conn.SetWriteDeadline(time.Now().Add(config.WebSocketWriteWait))
+			conn.WriteMessage(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.ClosePolicyViolation, wsConn.CloseReason()))
 			return
 		}
 	}
 }
 
-func broadcastUserStatus(userID string, isOnline bool) {
-	// Get all users who have chats with this user
+// writeFrame writes a queued JSON frame in the connection's encoding
+func writeFrame(conn *websocket.Conn, enc protocol.Encoding, frame []byte) error {
+	data, err := enc.Encode(frame)
+	if err != nil {
+		// Skip the frame rather than drop the connection
+		log.Printf("Error encoding WebSocket frame: %v", err)
+		return nil
+	}
+
+	messageType := websocket.TextMessage
+	if enc.Binary() {
+		messageType = websocket.BinaryMessage
+	}
+	conn.SetWriteDeadline(time.Now().Add(config.WebSocketWriteWait))
+	return conn.WriteMessage(messageType, data)
+}
+
+// broadcastUserStatus tells the user's chat peers their presence and custom
+// status. Invisible users are reported as offline.
+func broadcastUserStatus(userID string) {
+	peerIDs, err := chatPeerIDs(userID)
+	if err != nil {
+		log.Printf("Error getting chat participants: %v", err)
+		return
+	}
+
+	msgJSON, _ := json.Marshal(WSMessage{
+		Type:    "status",
+		Payload: userStatusEvent(userID),
+	})
+	sendEventToUsers(peerIDs, "status:"+userID, msgJSON)
+}
+
+// userStatusEvent returns the user's presence and custom status as others
+// see them
+func userStatusEvent(userID string) protocol.StatusEvent {
+	var isOnline bool
+	var statusText string
+	err := config.DB.QueryRow(`
+		SELECT is_online,
+			CASE WHEN status_expires_at IS NULL OR status_expires_at > ?
+				THEN COALESCE(status_text, '') ELSE '' END
+		FROM users WHERE id = ?
+	`, time.Now(), userID).Scan(&isOnline, &statusText)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("Error loading status text: %v", err)
+	}
+
+	state := visiblePresence(userID, isOnline)
+	return protocol.StatusEvent{
+		UserID:     userID,
+		IsOnline:   state != presence.Offline,
+		Presence:   state,
+		StatusText: statusText,
+	}
+}
+
+// chatPeerIDs returns everyone sharing a chat with userID. Users with a
+// block either way are left out since they don't see each other's presence
+// or profile.
+func chatPeerIDs(userID string) ([]string, error) {
+	blocked, err := blockedUserIDs(userID)
+	if err != nil {
+		return nil, err
+	}
+
 	rows, err := config.DB.Query(`
 		SELECT DISTINCT user_id 
 		FROM chat_participants 
@@ -151,26 +554,19 @@ func broadcastUserStatus(userID string, isOnline bool) {
 		) AND user_id != ?
 	`, userID, userID)
 	if err != nil {
-		log.Printf("Error getting chat participants: %v", err)
-		return
+		return nil, err
 	}
 	defer rows.Close()
 
-	msgJSON, _ := json.Marshal(WSMessage{
-		Type: "status",
-		Payload: map[string]interface{}{
-			"userId":   userID,
-			"isOnline": isOnline,
-		},
-	})
-
+	var peerIDs []string
 	for rows.Next() {
 		var pid string
 		if err := rows.Scan(&pid); err != nil {
-			continue
+			return nil, err
 		}
-		if conn, exists := store.GetConnection(pid); exists {
-			conn.Send <- msgJSON
+		if !blocked[pid] {
+			peerIDs = append(peerIDs, pid)
 		}
 	}
+	return peerIDs, rows.Err()
 }
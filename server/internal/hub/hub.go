@@ -0,0 +1,315 @@
+// Package hub routes WebSocket frames to users and chats through the
+// broker, so they reach users whichever instance they are connected to.
+// Every instance subscribes to the user topics of its connected users and
+// to the chat topics of their chats.
+package hub
+
+import (
+	"chat-app/internal/broker"
+	"chat-app/internal/config"
+	"chat-app/internal/store"
+	"encoding/json"
+	"log"
+	"sync"
+)
+
+// Envelope kinds. Besides frames to deliver, user topics carry requests
+// for the instance holding the user's connection.
+const (
+	kindFrame      = "frame"
+	kindDisconnect = "disconnect"
+	kindJoin       = "join"
+	kindLeave      = "leave"
+	kindPresence   = "presence"
+)
+
+// envelope is what travels over the broker
+type envelope struct {
+	Kind     string          `json:"kind"`
+	Frame    json.RawMessage `json:"frame,omitempty"`
+	Priority store.Priority  `json:"priority,omitempty"`
+	Key      string          `json:"key,omitempty"`
+	// Exclude is left out of a chat frame's recipients, usually the
+	// sender
+	Exclude []string `json:"exclude,omitempty"`
+	// ChatID is the chat a frame is about, if any. Clients that aren't
+	// subscribed to it get Summary instead, or nothing.
+	ChatID  string          `json:"chatId,omitempty"`
+	Summary json.RawMessage `json:"summary,omitempty"`
+	State   string          `json:"state,omitempty"`
+}
+
+var (
+	b        broker.Broker
+	initOnce sync.Once
+	initErr  error
+
+	// fallback is the in-process broker used when Init failed
+	fallback     broker.Broker
+	fallbackOnce sync.Once
+
+	mutex       = &sync.Mutex{}
+	userSubs    = make(map[string]func())
+	userChats   = make(map[string]map[string]bool)
+	chatSubs    = make(map[string]func())
+	chatMembers = make(map[string]map[string]bool)
+
+	presenceHandler func(userID, state string)
+)
+
+// Init connects to the broker in config.BrokerURL. Without a call to Init,
+// for example in CLI commands, the first use connects and falls back to the
+// in-process broker on error.
+func Init() error {
+	initOnce.Do(func() {
+		b, initErr = broker.New(config.BrokerURL)
+	})
+	return initErr
+}
+
+// current returns the broker, falling back to in-process delivery once if
+// connecting failed. Both are set under a sync.Once, so callers only read.
+func current() broker.Broker {
+	err := Init()
+	if err == nil {
+		return b
+	}
+	fallbackOnce.Do(func() {
+		log.Printf("Error connecting to broker, using in-process delivery: %v", err)
+		fallback = broker.NewMemory()
+	})
+	return fallback
+}
+
+// OnPresence sets the function applying a presence state chosen through
+// SetPresence on the instance holding the user's connection
+func OnPresence(handler func(userID, state string)) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	presenceHandler = handler
+}
+
+func userTopic(userID string) string {
+	return "chat-app:user:" + userID
+}
+
+func chatTopic(chatID string) string {
+	return "chat-app:chat:" + chatID
+}
+
+// Register subscribes this instance to a newly connected user's topic and
+// their chats. Registering an already registered user only adds chats.
+func Register(userID string, chatIDs []string) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if _, ok := userSubs[userID]; !ok {
+		unsubscribe, err := current().Subscribe(userTopic(userID), func(msg []byte) {
+			handleUserEnvelope(userID, msg)
+		})
+		if err != nil {
+			log.Printf("Error subscribing to user %s: %v", userID, err)
+			return
+		}
+		userSubs[userID] = unsubscribe
+		userChats[userID] = make(map[string]bool)
+	}
+	for _, chatID := range chatIDs {
+		joinLocked(userID, chatID)
+	}
+}
+
+// Unregister drops the subscriptions kept for a user who disconnected
+func Unregister(userID string) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	unsubscribe, ok := userSubs[userID]
+	if !ok {
+		return
+	}
+	unsubscribe()
+	delete(userSubs, userID)
+
+	for chatID := range userChats[userID] {
+		leaveLocked(userID, chatID)
+	}
+	delete(userChats, userID)
+}
+
+// joinLocked adds a registered user to a chat's local members, subscribing
+// to the chat on its first member. It is called with mutex held.
+func joinLocked(userID, chatID string) {
+	chats, ok := userChats[userID]
+	if !ok || chats[chatID] {
+		return
+	}
+
+	if _, ok := chatSubs[chatID]; !ok {
+		unsubscribe, err := current().Subscribe(chatTopic(chatID), func(msg []byte) {
+			handleChatEnvelope(chatID, msg)
+		})
+		if err != nil {
+			log.Printf("Error subscribing to chat %s: %v", chatID, err)
+			return
+		}
+		chatSubs[chatID] = unsubscribe
+		chatMembers[chatID] = make(map[string]bool)
+	}
+	chats[chatID] = true
+	chatMembers[chatID][userID] = true
+}
+
+// leaveLocked is the reverse of joinLocked
+func leaveLocked(userID, chatID string) {
+	delete(userChats[userID], chatID)
+
+	members, ok := chatMembers[chatID]
+	if !ok {
+		return
+	}
+	delete(members, userID)
+	if len(members) == 0 {
+		chatSubs[chatID]()
+		delete(chatSubs, chatID)
+		delete(chatMembers, chatID)
+	}
+}
+
+func handleUserEnvelope(userID string, msg []byte) {
+	var env envelope
+	if err := json.Unmarshal(msg, &env); err != nil {
+		log.Printf("Error decoding broker message: %v", err)
+		return
+	}
+
+	switch env.Kind {
+	case kindFrame:
+		if conn, exists := store.GetConnection(userID); exists {
+			deliver(conn, env)
+		}
+	case kindDisconnect:
+		store.Disconnect(userID)
+	case kindJoin, kindLeave:
+		mutex.Lock()
+		if env.Kind == kindJoin {
+			joinLocked(userID, env.ChatID)
+		} else {
+			leaveLocked(userID, env.ChatID)
+		}
+		mutex.Unlock()
+		if conn, exists := store.GetConnection(userID); exists && env.Kind == kindLeave {
+			conn.DropSubscription(env.ChatID)
+		}
+	case kindPresence:
+		mutex.Lock()
+		handler := presenceHandler
+		mutex.Unlock()
+		if handler != nil {
+			handler(userID, env.State)
+		}
+	}
+}
+
+func handleChatEnvelope(chatID string, msg []byte) {
+	var env envelope
+	if err := json.Unmarshal(msg, &env); err != nil {
+		log.Printf("Error decoding broker message: %v", err)
+		return
+	}
+
+	excluded := make(map[string]bool, len(env.Exclude))
+	for _, userID := range env.Exclude {
+		excluded[userID] = true
+	}
+
+	mutex.Lock()
+	members := make([]string, 0, len(chatMembers[chatID]))
+	for userID := range chatMembers[chatID] {
+		if !excluded[userID] {
+			members = append(members, userID)
+		}
+	}
+	mutex.Unlock()
+
+	for _, userID := range members {
+		if conn, exists := store.GetConnection(userID); exists {
+			deliver(conn, env)
+		}
+	}
+}
+
+// deliver queues a frame, or its summary if it is about a chat the client
+// isn't subscribed to
+func deliver(conn *store.WebSocketConnection, env envelope) {
+	frame := env.Frame
+	if env.ChatID != "" && !conn.Subscribed(env.ChatID) {
+		if env.Summary == nil {
+			return
+		}
+		frame = env.Summary
+	}
+	conn.Deliver(frame, env.Priority, env.Key)
+}
+
+func publish(topic string, env envelope) {
+	msg, _ := json.Marshal(env)
+	if err := current().Publish(topic, msg); err != nil {
+		log.Printf("Error publishing to %s: %v", topic, err)
+	}
+}
+
+// SendToUsers delivers a frame to each user's connection, wherever it is.
+// See store.Priority for priority and key.
+func SendToUsers(userIDs []string, frame []byte, priority store.Priority, key string) {
+	for _, userID := range userIDs {
+		publish(userTopic(userID), envelope{Kind: kindFrame, Frame: frame, Priority: priority, Key: key})
+	}
+}
+
+// SendToChat delivers a frame to every connected participant of a chat
+// except those in exclude. Participants who subscribed to other chats only
+// get summary, if it isn't nil.
+func SendToChat(chatID string, exclude []string, frame, summary []byte, priority store.Priority, key string) {
+	publish(chatTopic(chatID), envelope{
+		Kind:     kindFrame,
+		Frame:    frame,
+		Priority: priority,
+		Key:      key,
+		Exclude:  exclude,
+		ChatID:   chatID,
+		Summary:  summary,
+	})
+}
+
+// IsMember reports whether a user connected to this instance is in a chat,
+// as far as the chats loaded on Register and changes since tell. It is
+// false for users connected elsewhere.
+func IsMember(userID, chatID string) bool {
+	mutex.Lock()
+	defer mutex.Unlock()
+	return userChats[userID][chatID]
+}
+
+// JoinChat tells the instance holding the user's connection that they were
+// added to a chat
+func JoinChat(userID, chatID string) {
+	publish(userTopic(userID), envelope{Kind: kindJoin, ChatID: chatID})
+}
+
+// LeaveChat tells the instance holding the user's connection that they were
+// removed from a chat
+func LeaveChat(userID, chatID string) {
+	publish(userTopic(userID), envelope{Kind: kindLeave, ChatID: chatID})
+}
+
+// Disconnect closes the user's connection on whichever instance holds it
+func Disconnect(userID string) {
+	publish(userTopic(userID), envelope{Kind: kindDisconnect})
+}
+
+// SetPresence passes a chosen presence state to the instance holding the
+// user's connection, see OnPresence
+func SetPresence(userID, state string) {
+	publish(userTopic(userID), envelope{Kind: kindPresence, State: state})
+}
@@ -0,0 +1,162 @@
+package ldapauth
+
+import (
+	"chat-app/internal/config"
+	"crypto/tls"
+	"errors"
+	"fmt"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+var (
+	// ErrUserNotFound means the directory has no entry for the login. Callers
+	// fall back to local accounts.
+	ErrUserNotFound = errors.New("user not found in directory")
+	// ErrInvalidCredentials means the entry exists but the password is wrong
+	ErrInvalidCredentials = errors.New("invalid directory credentials")
+)
+
+// Entry is a directory user mapped to the fields the chat app needs
+type Entry struct {
+	DN       string
+	Username string
+	Email    string
+	Avatar   string
+	// Groups holds the DNs of the groups the user is a member of
+	Groups []string
+}
+
+// Authenticate looks the login up with the service account, then binds as
+// the user's entry to check the password
+func Authenticate(login, password string) (*Entry, error) {
+	// An empty password would be an unauthenticated bind, which most servers
+	// accept without checking anything
+	if password == "" {
+		return nil, ErrInvalidCredentials
+	}
+
+	conn, err := dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if err := bindServiceAccount(conn); err != nil {
+		return nil, err
+	}
+
+	cfg := config.LDAP
+	attributes := []string{"dn", cfg.UsernameAttribute, cfg.EmailAttribute}
+	if cfg.AvatarAttribute != "" {
+		attributes = append(attributes, cfg.AvatarAttribute)
+	}
+	if cfg.GroupAttribute != "" {
+		attributes = append(attributes, cfg.GroupAttribute)
+	}
+
+	result, err := conn.Search(ldap.NewSearchRequest(
+		cfg.BaseDN,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, 0, false,
+		fmt.Sprintf(cfg.UserFilter, ldap.EscapeFilter(login)),
+		attributes,
+		nil,
+	))
+	if err != nil {
+		return nil, fmt.Errorf("user search failed: %v", err)
+	}
+	if len(result.Entries) == 0 {
+		return nil, ErrUserNotFound
+	}
+	if len(result.Entries) > 1 {
+		return nil, fmt.Errorf("user search for %q returned more than one entry", login)
+	}
+
+	entry := result.Entries[0]
+	if err := conn.Bind(entry.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return nil, ErrInvalidCredentials
+		}
+		return nil, fmt.Errorf("user bind failed: %v", err)
+	}
+
+	user := &Entry{
+		DN:       entry.DN,
+		Username: entry.GetAttributeValue(cfg.UsernameAttribute),
+		Email:    entry.GetAttributeValue(cfg.EmailAttribute),
+	}
+	if cfg.AvatarAttribute != "" {
+		user.Avatar = entry.GetAttributeValue(cfg.AvatarAttribute)
+	}
+
+	if cfg.GroupFilter != "" {
+		// Directories without a memberOf overlay need a group search, which
+		// is done with the service account again
+		if err := bindServiceAccount(conn); err != nil {
+			return nil, err
+		}
+		user.Groups, err = searchGroups(conn, entry.DN)
+		if err != nil {
+			return nil, err
+		}
+	} else if cfg.GroupAttribute != "" {
+		user.Groups = entry.GetAttributeValues(cfg.GroupAttribute)
+	}
+
+	return user, nil
+}
+
+func dial() (*ldap.Conn, error) {
+	cfg := config.LDAP
+
+	conn, err := ldap.DialURL(cfg.URL)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to directory: %v", err)
+	}
+
+	if cfg.StartTLS {
+		if err := conn.StartTLS(&tls.Config{InsecureSkipVerify: cfg.InsecureSkipVerify}); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("error starting TLS: %v", err)
+		}
+	}
+
+	return conn, nil
+}
+
+func bindServiceAccount(conn *ldap.Conn) error {
+	cfg := config.LDAP
+	if cfg.BindDN == "" {
+		return nil
+	}
+	if err := conn.Bind(cfg.BindDN, cfg.BindPassword); err != nil {
+		return fmt.Errorf("service account bind failed: %v", err)
+	}
+	return nil
+}
+
+func searchGroups(conn *ldap.Conn, userDN string) ([]string, error) {
+	cfg := config.LDAP
+
+	baseDN := cfg.GroupBaseDN
+	if baseDN == "" {
+		baseDN = cfg.BaseDN
+	}
+
+	result, err := conn.Search(ldap.NewSearchRequest(
+		baseDN,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+		fmt.Sprintf(cfg.GroupFilter, ldap.EscapeFilter(userDN)),
+		[]string{"dn"},
+		nil,
+	))
+	if err != nil {
+		return nil, fmt.Errorf("group search failed: %v", err)
+	}
+
+	groups := make([]string, 0, len(result.Entries))
+	for _, entry := range result.Entries {
+		groups = append(groups, entry.DN)
+	}
+	return groups, nil
+}
@@ -0,0 +1,331 @@
+package ldapauth
+
+import (
+	"chat-app/internal/config"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+)
+
+// fakeDirectory is an in-process LDAP server holding a few entries. It
+// speaks just enough of the protocol for the client: simple binds, searches
+// with and, or, equality and presence filters, and unbind.
+type fakeDirectory struct {
+	listener net.Listener
+
+	mutex sync.Mutex
+	// entries maps DNs to their attributes
+	entries map[string]map[string][]string
+	// passwords maps DNs to the password that binds as them
+	passwords map[string]string
+	// binds records every DN bound as, in order
+	binds []string
+}
+
+func newFakeDirectory(t *testing.T) *fakeDirectory {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &fakeDirectory{
+		listener: listener,
+		entries: map[string]map[string][]string{
+			"uid=alice,ou=people,dc=example,dc=com": {
+				"objectClass": {"person"},
+				"uid":         {"alice"},
+				"mail":        {"alice@example.com"},
+				"labeledURI":  {"https://example.com/alice.png"},
+				"memberOf":    {"cn=staff,ou=groups,dc=example,dc=com", "cn=ops,ou=groups,dc=example,dc=com"},
+			},
+			"uid=bob,ou=people,dc=example,dc=com": {
+				"objectClass": {"person"},
+				"uid":         {"bob"},
+				"mail":        {"shared@example.com"},
+			},
+			"uid=carol,ou=people,dc=example,dc=com": {
+				"objectClass": {"person"},
+				"uid":         {"carol"},
+				"mail":        {"shared@example.com"},
+			},
+			"cn=staff,ou=groups,dc=example,dc=com": {
+				"objectClass": {"groupOfNames"},
+				"member":      {"uid=alice,ou=people,dc=example,dc=com", "uid=bob,ou=people,dc=example,dc=com"},
+			},
+			"cn=ops,ou=groups,dc=example,dc=com": {
+				"objectClass": {"groupOfNames"},
+				"member":      {"uid=alice,ou=people,dc=example,dc=com"},
+			},
+		},
+		passwords: map[string]string{
+			"cn=service,dc=example,dc=com":          "service-secret",
+			"uid=alice,ou=people,dc=example,dc=com": "alice-secret",
+			"uid=bob,ou=people,dc=example,dc=com":   "bob-secret",
+		},
+	}
+	go d.serve()
+	t.Cleanup(func() { listener.Close() })
+
+	previous := config.LDAP
+	config.LDAP = config.LDAPConfig{
+		Enabled:           true,
+		URL:               "ldap://" + listener.Addr().String(),
+		BindDN:            "cn=service,dc=example,dc=com",
+		BindPassword:      "service-secret",
+		BaseDN:            "ou=people,dc=example,dc=com",
+		UserFilter:        "(&(objectClass=person)(|(uid=%[1]s)(mail=%[1]s)))",
+		UsernameAttribute: "uid",
+		EmailAttribute:    "mail",
+		AvatarAttribute:   "labeledURI",
+		GroupAttribute:    "memberOf",
+	}
+	t.Cleanup(func() { config.LDAP = previous })
+	return d
+}
+
+func (d *fakeDirectory) serve() {
+	for {
+		conn, err := d.listener.Accept()
+		if err != nil {
+			return
+		}
+		go d.handle(conn)
+	}
+}
+
+func (d *fakeDirectory) handle(conn net.Conn) {
+	defer conn.Close()
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+		messageID := packet.Children[0].Value
+		op := packet.Children[1]
+
+		var responses []*ber.Packet
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			responses = append(responses, d.bind(op))
+		case ldap.ApplicationSearchRequest:
+			responses = d.search(op)
+		default:
+			// Unbind, or anything else the tests don't need
+			return
+		}
+
+		for _, response := range responses {
+			envelope := ber.NewSequence("LDAP Response")
+			envelope.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, messageID, "Message ID"))
+			envelope.AppendChild(response)
+			if _, err := conn.Write(envelope.Bytes()); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (d *fakeDirectory) bind(op *ber.Packet) *ber.Packet {
+	dn, _ := op.Children[1].Value.(string)
+	password := op.Children[2].Data.String()
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.binds = append(d.binds, dn)
+
+	code := ldap.LDAPResultSuccess
+	if stored, ok := d.passwords[dn]; !ok || stored != password || password == "" {
+		code = ldap.LDAPResultInvalidCredentials
+	}
+	return result(ldap.ApplicationBindResponse, code)
+}
+
+func (d *fakeDirectory) search(op *ber.Packet) []*ber.Packet {
+	baseDN, _ := op.Children[0].Value.(string)
+	sizeLimit, _ := op.Children[3].Value.(int64)
+	filter := op.Children[6]
+	var requested []string
+	for _, attr := range op.Children[7].Children {
+		requested = append(requested, attr.Value.(string))
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	var responses []*ber.Packet
+	for dn, attrs := range d.entries {
+		if !strings.HasSuffix(strings.ToLower(dn), strings.ToLower(baseDN)) || !matches(filter, attrs) {
+			continue
+		}
+		if sizeLimit > 0 && int64(len(responses)) == sizeLimit {
+			return append(responses, result(ldap.ApplicationSearchResultDone, ldap.LDAPResultSizeLimitExceeded))
+		}
+
+		entry := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "Search Result Entry")
+		entry.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, dn, "DN"))
+		list := ber.NewSequence("Attributes")
+		for _, name := range requested {
+			values, ok := attrs[name]
+			if !ok {
+				continue
+			}
+			attr := ber.NewSequence("Attribute")
+			attr.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, "Type"))
+			set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "Values")
+			for _, v := range values {
+				set.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, v, "Value"))
+			}
+			attr.AppendChild(set)
+			list.AppendChild(attr)
+		}
+		entry.AppendChild(list)
+		responses = append(responses, entry)
+	}
+	return append(responses, result(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess))
+}
+
+// matches evaluates a search filter against an entry's attributes. Values
+// compare without regard to case, as they do for the attributes used here.
+func matches(filter *ber.Packet, attrs map[string][]string) bool {
+	switch filter.Tag {
+	case ldap.FilterAnd:
+		for _, child := range filter.Children {
+			if !matches(child, attrs) {
+				return false
+			}
+		}
+		return true
+	case ldap.FilterOr:
+		for _, child := range filter.Children {
+			if matches(child, attrs) {
+				return true
+			}
+		}
+		return false
+	case ldap.FilterEqualityMatch:
+		name, _ := filter.Children[0].Value.(string)
+		value, _ := filter.Children[1].Value.(string)
+		for _, v := range attrs[name] {
+			if strings.EqualFold(v, value) {
+				return true
+			}
+		}
+		return false
+	case ldap.FilterPresent:
+		return len(attrs[filter.Data.String()]) > 0
+	}
+	return false
+}
+
+func result(tag ber.Tag, code int) *ber.Packet {
+	packet := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "Result")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), "Result Code"))
+	packet.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Matched DN"))
+	packet.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Diagnostic Message"))
+	return packet
+}
+
+func TestAuthenticate(t *testing.T) {
+	d := newFakeDirectory(t)
+
+	// Users can log in with either their uid or their email
+	for _, login := range []string{"alice", "alice@example.com", "ALICE"} {
+		entry, err := Authenticate(login, "alice-secret")
+		if err != nil {
+			t.Fatalf("Authenticate(%q): %v", login, err)
+		}
+		want := &Entry{
+			DN:       "uid=alice,ou=people,dc=example,dc=com",
+			Username: "alice",
+			Email:    "alice@example.com",
+			Avatar:   "https://example.com/alice.png",
+			Groups:   []string{"cn=staff,ou=groups,dc=example,dc=com", "cn=ops,ou=groups,dc=example,dc=com"},
+		}
+		if !reflect.DeepEqual(entry, want) {
+			t.Errorf("Authenticate(%q) = %+v, want %+v", login, entry, want)
+		}
+	}
+
+	// The search runs as the service account, the password check as the user
+	d.mutex.Lock()
+	binds := d.binds[:2]
+	d.mutex.Unlock()
+	if binds[0] != config.LDAP.BindDN || binds[1] != "uid=alice,ou=people,dc=example,dc=com" {
+		t.Errorf("binds = %v, want the service account then the user", binds)
+	}
+}
+
+func TestAuthenticateGroupSearch(t *testing.T) {
+	newFakeDirectory(t)
+	config.LDAP.GroupAttribute = ""
+	config.LDAP.GroupBaseDN = "ou=groups,dc=example,dc=com"
+	config.LDAP.GroupFilter = "(member=%s)"
+
+	entry, err := Authenticate("bob", "bob-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"cn=staff,ou=groups,dc=example,dc=com"}; !reflect.DeepEqual(entry.Groups, want) {
+		t.Errorf("Groups = %v, want %v", entry.Groups, want)
+	}
+}
+
+func TestAuthenticateErrors(t *testing.T) {
+	newFakeDirectory(t)
+
+	tests := []struct {
+		name     string
+		login    string
+		password string
+		want     error
+	}{
+		{"wrong password", "alice", "wrong", ErrInvalidCredentials},
+		{"empty password", "alice", "", ErrInvalidCredentials},
+		{"unknown user", "dave", "secret", ErrUserNotFound},
+		// Escaping keeps the login from widening the filter
+		{"wildcard", "*", "alice-secret", ErrUserNotFound},
+		{"filter injection", "alice)(uid=*", "alice-secret", ErrUserNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Authenticate(tt.login, tt.password); err != tt.want {
+				t.Errorf("Authenticate(%q) error = %v, want %v", tt.login, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestAuthenticateAmbiguousLogin(t *testing.T) {
+	newFakeDirectory(t)
+
+	// Two entries share the email; neither may be picked
+	_, err := Authenticate("shared@example.com", "bob-secret")
+	if err == nil || err == ErrInvalidCredentials || err == ErrUserNotFound {
+		t.Errorf("Authenticate with an ambiguous login = %v, want a search error", err)
+	}
+}
+
+func TestAuthenticateServiceAccountFailure(t *testing.T) {
+	newFakeDirectory(t)
+	config.LDAP.BindPassword = "wrong"
+
+	// A broken service account is a configuration problem, not the user's
+	// wrong password, so callers don't count it as a failed login
+	_, err := Authenticate("alice", "alice-secret")
+	if err == nil || err == ErrInvalidCredentials || err == ErrUserNotFound {
+		t.Errorf("Authenticate with a bad service account = %v, want a bind error", err)
+	}
+}
+
+func TestAuthenticateUnreachable(t *testing.T) {
+	d := newFakeDirectory(t)
+	d.listener.Close()
+
+	if _, err := Authenticate("alice", "alice-secret"); err == nil || err == ErrUserNotFound {
+		t.Errorf("Authenticate with the directory down = %v, want a connection error", err)
+	}
+}
@@ -0,0 +1,110 @@
+package loginguard
+
+import (
+	"time"
+)
+
+// Record is the failure history kept for one key, e.g. an email or an IP
+type Record struct {
+	Failures    int
+	LastFailure time.Time
+	LockedUntil time.Time
+}
+
+// Store keeps failure records. Implementations must be safe for concurrent
+// use; the database store lets several server instances share counters.
+type Store interface {
+	Get(key string) (Record, error)
+	// Increment records a failure at now and returns the updated record.
+	// Failures older than window are forgotten first.
+	Increment(key string, now time.Time, window time.Duration) (Record, error)
+	SetLockedUntil(key string, until time.Time) error
+	Reset(key string) error
+}
+
+// Tracker applies exponential backoff and temporary lockout to repeated
+// failures for the same key
+type Tracker struct {
+	Store Store
+	// Prefix namespaces keys so trackers with different limits can share
+	// a store
+	Prefix string
+	// MaxFailures is the number of failures that triggers a lockout
+	MaxFailures int
+	// BaseDelay is the wait after the first failure; it doubles with every
+	// further failure up to MaxDelay
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// LockoutDuration is how long a key stays locked after MaxFailures
+	LockoutDuration time.Duration
+	// Window is how long failures are remembered without a new one
+	Window time.Duration
+	// OnLockout is called with the prefixed key when it gets locked
+	OnLockout func(key string, until time.Time)
+}
+
+// Check returns how long the caller must wait before the next attempt for
+// key is allowed. Zero means the attempt may go ahead.
+func (t *Tracker) Check(key string) (time.Duration, error) {
+	record, err := t.Store.Get(t.Prefix + key)
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	if now.Before(record.LockedUntil) {
+		return record.LockedUntil.Sub(now), nil
+	}
+	if record.Failures == 0 || now.Sub(record.LastFailure) > t.Window {
+		return 0, nil
+	}
+
+	next := record.LastFailure.Add(t.delay(record.Failures))
+	if now.Before(next) {
+		return next.Sub(now), nil
+	}
+	return 0, nil
+}
+
+// Failure records a failed attempt for key, locking it once MaxFailures is
+// reached
+func (t *Tracker) Failure(key string) error {
+	now := time.Now()
+	record, err := t.Store.Increment(t.Prefix+key, now, t.Window)
+	if err != nil {
+		return err
+	}
+
+	if t.MaxFailures > 0 && record.Failures >= t.MaxFailures {
+		until := now.Add(t.LockoutDuration)
+		if err := t.Store.SetLockedUntil(t.Prefix+key, until); err != nil {
+			return err
+		}
+		if t.OnLockout != nil {
+			t.OnLockout(t.Prefix+key, until)
+		}
+	}
+	return nil
+}
+
+// Success clears the failure history for key
+func (t *Tracker) Success(key string) error {
+	return t.Store.Reset(t.Prefix + key)
+}
+
+// Unlock lifts a lockout and clears the failure history for key
+func (t *Tracker) Unlock(key string) error {
+	return t.Store.Reset(t.Prefix + key)
+}
+
+// delay returns the backoff after the given number of failures
+func (t *Tracker) delay(failures int) time.Duration {
+	d := t.BaseDelay
+	for i := 1; i < failures; i++ {
+		d *= 2
+		if d >= t.MaxDelay {
+			return t.MaxDelay
+		}
+	}
+	return d
+}
@@ -0,0 +1,173 @@
+package loginguard
+
+import (
+	"testing"
+	"time"
+)
+
+func newTracker() *Tracker {
+	return &Tracker{
+		Store:           NewMemoryStore(),
+		Prefix:          "email:",
+		MaxFailures:     5,
+		BaseDelay:       time.Minute,
+		MaxDelay:        10 * time.Minute,
+		LockoutDuration: time.Hour,
+		Window:          24 * time.Hour,
+	}
+}
+
+// within reports whether d is want, give or take the time the test took
+func within(d, want time.Duration) bool {
+	return d <= want && d > want-5*time.Second
+}
+
+func TestDelay(t *testing.T) {
+	tr := newTracker()
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{1, time.Minute},
+		{2, 2 * time.Minute},
+		{3, 4 * time.Minute},
+		{4, 8 * time.Minute},
+		{5, 10 * time.Minute},
+		{60, 10 * time.Minute},
+	}
+	for _, tt := range tests {
+		if got := tr.delay(tt.failures); got != tt.want {
+			t.Errorf("delay(%d) = %v, want %v", tt.failures, got, tt.want)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	tr := newTracker()
+
+	if wait, err := tr.Check("a@example.com"); wait != 0 || err != nil {
+		t.Fatalf("Check before any failure = %v, %v", wait, err)
+	}
+
+	for i, want := range []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute} {
+		if err := tr.Failure("a@example.com"); err != nil {
+			t.Fatal(err)
+		}
+		if wait, _ := tr.Check("a@example.com"); !within(wait, want) {
+			t.Errorf("wait after %d failures = %v, want %v", i+1, wait, want)
+		}
+	}
+
+	// Other keys are unaffected
+	if wait, _ := tr.Check("b@example.com"); wait != 0 {
+		t.Errorf("wait for another key = %v", wait)
+	}
+
+	// Success starts over
+	tr.Success("a@example.com")
+	if wait, _ := tr.Check("a@example.com"); wait != 0 {
+		t.Errorf("wait after success = %v", wait)
+	}
+}
+
+func TestBackoffElapsed(t *testing.T) {
+	tr := newTracker()
+	store := tr.Store.(*MemoryStore)
+
+	// A failure whose delay has passed no longer holds up the next attempt
+	store.Increment("email:a@example.com", time.Now().Add(-2*time.Minute), tr.Window)
+	if wait, _ := tr.Check("a@example.com"); wait != 0 {
+		t.Errorf("wait after the delay passed = %v", wait)
+	}
+}
+
+func TestLockout(t *testing.T) {
+	tr := newTracker()
+	var lockedKey string
+	var lockedUntil time.Time
+	tr.OnLockout = func(key string, until time.Time) {
+		lockedKey, lockedUntil = key, until
+	}
+
+	for i := 0; i < tr.MaxFailures-1; i++ {
+		tr.Failure("a@example.com")
+	}
+	if lockedKey != "" {
+		t.Fatalf("locked after %d failures", tr.MaxFailures-1)
+	}
+
+	tr.Failure("a@example.com")
+	if lockedKey != "email:a@example.com" || !within(time.Until(lockedUntil), time.Hour) {
+		t.Fatalf("OnLockout(%q, %v), want the prefixed key locked for an hour", lockedKey, lockedUntil)
+	}
+	if wait, _ := tr.Check("a@example.com"); !within(wait, time.Hour) {
+		t.Errorf("wait while locked = %v, want an hour", wait)
+	}
+
+	tr.Unlock("a@example.com")
+	if wait, _ := tr.Check("a@example.com"); wait != 0 {
+		t.Errorf("wait after unlock = %v", wait)
+	}
+}
+
+func TestLockoutDisabled(t *testing.T) {
+	tr := newTracker()
+	tr.MaxFailures = 0
+	tr.OnLockout = func(string, time.Time) { t.Error("locked with MaxFailures 0") }
+
+	for i := 0; i < 10; i++ {
+		tr.Failure("a@example.com")
+	}
+	if wait, _ := tr.Check("a@example.com"); !within(wait, tr.MaxDelay) {
+		t.Errorf("wait = %v, want MaxDelay", wait)
+	}
+}
+
+func TestMemoryStoreWindow(t *testing.T) {
+	s := NewMemoryStore()
+	now := time.Now()
+	window := time.Hour
+
+	s.Increment("k", now, window)
+	record, _ := s.Increment("k", now.Add(30*time.Minute), window)
+	if record.Failures != 2 {
+		t.Errorf("failures within the window = %d, want 2", record.Failures)
+	}
+
+	// The count restarts once the last failure is older than the window
+	record, _ = s.Increment("k", now.Add(2*time.Hour), window)
+	if record.Failures != 1 {
+		t.Errorf("failures after the window = %d, want 1", record.Failures)
+	}
+
+	// but not while the key is locked
+	s.SetLockedUntil("k", now.Add(10*time.Hour))
+	record, _ = s.Increment("k", now.Add(5*time.Hour), window)
+	if record.Failures != 2 {
+		t.Errorf("failures while locked = %d, want 2", record.Failures)
+	}
+}
+
+func TestMemoryStoreSweep(t *testing.T) {
+	s := NewMemoryStore()
+	now := time.Now()
+	window := time.Hour
+
+	s.Increment("stale", now, window)
+	s.Increment("locked", now, window)
+	s.SetLockedUntil("locked", now.Add(24*time.Hour))
+
+	// Sweeps are rate limited, so a failure soon after leaves stale keys
+	s.Increment("fresh", now.Add(30*time.Second), window)
+	if len(s.records) != 3 {
+		t.Errorf("%d records before the next sweep, want 3", len(s.records))
+	}
+
+	s.Increment("fresh", now.Add(2*time.Hour), window)
+	if _, ok := s.records["stale"]; ok {
+		t.Error("a stale record survived the sweep")
+	}
+	if _, ok := s.records["locked"]; !ok {
+		t.Error("a locked record was swept")
+	}
+}
@@ -0,0 +1,125 @@
+package loginguard
+
+import (
+	"database/sql"
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps records in process memory. Counters are lost on restart
+// and not shared between instances.
+type MemoryStore struct {
+	mutex     sync.Mutex
+	records   map[string]Record
+	lastSweep time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{records: make(map[string]Record)}
+}
+
+func (s *MemoryStore) Get(key string) (Record, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.records[key], nil
+}
+
+func (s *MemoryStore) Increment(key string, now time.Time, window time.Duration) (Record, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	record := s.records[key]
+	if now.Sub(record.LastFailure) > window && now.After(record.LockedUntil) {
+		record = Record{}
+	}
+	record.Failures++
+	record.LastFailure = now
+	s.records[key] = record
+
+	// Forget stale keys so the map doesn't grow without bound. Sweeping at
+	// most once a minute keeps a flood of failures from each paying for a
+	// walk over every key.
+	if now.Sub(s.lastSweep) > time.Minute {
+		for k, r := range s.records {
+			if now.Sub(r.LastFailure) > window && now.After(r.LockedUntil) {
+				delete(s.records, k)
+			}
+		}
+		s.lastSweep = now
+	}
+
+	return record, nil
+}
+
+func (s *MemoryStore) SetLockedUntil(key string, until time.Time) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	record := s.records[key]
+	record.LockedUntil = until
+	s.records[key] = record
+	return nil
+}
+
+func (s *MemoryStore) Reset(key string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.records, key)
+	return nil
+}
+
+// DatabaseStore keeps records in the login_attempts table so every server
+// instance sees the same counters
+type DatabaseStore struct {
+	DB *sql.DB
+}
+
+func NewDatabaseStore(db *sql.DB) *DatabaseStore {
+	return &DatabaseStore{DB: db}
+}
+
+func (s *DatabaseStore) Get(key string) (Record, error) {
+	var record Record
+	var lockedUntil sql.NullTime
+	err := s.DB.QueryRow(`
+		SELECT failures, last_failure, locked_until FROM login_attempts WHERE attempt_key = ?
+	`, key).Scan(&record.Failures, &record.LastFailure, &lockedUntil)
+	if err == sql.ErrNoRows {
+		return Record{}, nil
+	}
+	if err != nil {
+		return Record{}, err
+	}
+	if lockedUntil.Valid {
+		record.LockedUntil = lockedUntil.Time
+	}
+	return record, nil
+}
+
+func (s *DatabaseStore) Increment(key string, now time.Time, window time.Duration) (Record, error) {
+	// The counter restarts when the last failure fell outside the window and
+	// no lockout is active; the comparison runs inside the upsert so
+	// concurrent failures are all counted
+	stale := now.Add(-window)
+	_, err := s.DB.Exec(`
+		INSERT INTO login_attempts (attempt_key, failures, last_failure)
+		VALUES (?, 1, ?)
+		ON DUPLICATE KEY UPDATE
+			failures = IF(last_failure < ? AND (locked_until IS NULL OR locked_until < ?), 1, failures + 1),
+			locked_until = IF(locked_until < ?, NULL, locked_until),
+			last_failure = VALUES(last_failure)
+	`, key, now, stale, now, now)
+	if err != nil {
+		return Record{}, err
+	}
+	return s.Get(key)
+}
+
+func (s *DatabaseStore) SetLockedUntil(key string, until time.Time) error {
+	_, err := s.DB.Exec("UPDATE login_attempts SET locked_until = ? WHERE attempt_key = ?", until, key)
+	return err
+}
+
+func (s *DatabaseStore) Reset(key string) error {
+	_, err := s.DB.Exec("DELETE FROM login_attempts WHERE attempt_key = ?", key)
+	return err
+}
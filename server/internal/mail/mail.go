@@ -0,0 +1,56 @@
+package mail
+
+import (
+	"chat-app/internal/config"
+	"fmt"
+	"log"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// Send delivers a plain text email through the configured SMTP server.
+// Without a host configured the message is logged instead, which is enough
+// for development.
+func Send(to, subject, body string) error {
+	cfg := config.SMTP
+	if cfg.Host == "" {
+		log.Printf("Email to %s (SMTP not configured)\nSubject: %s\n\n%s", to, subject, body)
+		return nil
+	}
+
+	// Header injection through the recipient or subject is not possible
+	// since neither may contain line breaks
+	if strings.ContainsAny(to, "\r\n") || strings.ContainsAny(subject, "\r\n") {
+		return fmt.Errorf("invalid email header")
+	}
+
+	msg := strings.Join([]string{
+		"From: " + cfg.From,
+		"To: " + to,
+		"Subject: " + subject,
+		"Date: " + time.Now().Format(time.RFC1123Z),
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=utf-8",
+		"",
+		body,
+	}, "\r\n")
+
+	var auth smtp.Auth
+	if cfg.Username != "" {
+		auth = smtp.PlainAuth("", cfg.Username, cfg.Password, cfg.Host)
+	}
+
+	addr := fmt.Sprintf("%s:%d", cfg.Host, cfg.Port)
+	return smtp.SendMail(addr, auth, senderAddress(cfg.From), []string{to}, []byte(msg))
+}
+
+// senderAddress extracts the bare address from "Name <address>"
+func senderAddress(from string) string {
+	if start := strings.LastIndex(from, "<"); start >= 0 {
+		if end := strings.LastIndex(from, ">"); end > start {
+			return from[start+1 : end]
+		}
+	}
+	return from
+}
@@ -52,6 +52,12 @@ func Auth(next http.Handler) http.Handler {
 			return
 		}
 
+		// Challenge tokens from a pending two-factor login are not sessions
+		if _, ok := claims["purpose"]; ok {
+			http.Error(w, "Invalid token", http.StatusUnauthorized)
+			return
+		}
+
 		userID, ok := claims["user_id"].(string)
 		if !ok {
 			http.Error(w, "Invalid user ID in token", http.StatusUnauthorized)
@@ -60,15 +66,36 @@ func Auth(next http.Handler) http.Handler {
 
 		// First check the in-memory store for the user
 		user, found := store.GetUser(userID)
+		if found {
+			// Role and suspension are read on every request rather than
+			// trusted from the cache, as they can be changed by another
+			// instance or the CLI
+			var role string
+			var suspendedAt sql.NullTime
+			err := config.DB.QueryRow(`
+				SELECT role, suspended_at FROM users WHERE id = ? AND deleted_at IS NULL
+			`, userID).Scan(&role, &suspendedAt)
+			if err == sql.ErrNoRows || (err == nil && suspendedAt.Valid) {
+				store.RemoveUser(userID)
+				found = false
+			} else if err != nil {
+				http.Error(w, fmt.Sprintf("Database error: %v", err), http.StatusInternalServerError)
+				return
+			} else if role != user.Role {
+				user.Role = role
+				store.AddUser(user)
+			}
+		}
 		if !found {
 			// If not found in memory, try to fetch from database
 			var dbUser models.User
+			var suspendedAt sql.NullTime
 			err := config.DB.QueryRow(`
-				SELECT id, username, email, avatar, is_online, last_seen
-				FROM users WHERE id = ?
+				SELECT id, username, email, COALESCE(avatar, ''), role, is_online, last_seen, suspended_at
+				FROM users WHERE id = ? AND deleted_at IS NULL
 			`, userID).Scan(
 				&dbUser.ID, &dbUser.Username, &dbUser.Email, 
-				&dbUser.Avatar, &dbUser.IsOnline, &dbUser.LastSeen,
+				&dbUser.Avatar, &dbUser.Role, &dbUser.IsOnline, &dbUser.LastSeen, &suspendedAt,
 			)
 			
 			if err != nil {
@@ -79,6 +106,12 @@ func Auth(next http.Handler) http.Handler {
 				}
 				return
 			}
+
+			// Suspended users are never cached
+			if suspendedAt.Valid {
+				http.Error(w, "Account suspended", http.StatusForbidden)
+				return
+			}
 			
 			// Add user to the store for future requests
 			store.AddUser(dbUser)
@@ -89,3 +122,26 @@ func Auth(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
+
+// RequireRole only lets users with one of the given roles through. It must
+// run after Auth.
+func RequireRole(roles ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user, ok := r.Context().Value("user").(models.User)
+			if !ok {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+
+			for _, role := range roles {
+				if user.Role == role {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+
+			http.Error(w, "Forbidden", http.StatusForbidden)
+		})
+	}
+}
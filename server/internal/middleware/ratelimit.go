@@ -0,0 +1,52 @@
+package middleware
+
+import (
+	"chat-app/internal/config"
+	"chat-app/internal/models"
+	"chat-app/internal/ratelimit"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+)
+
+// RateLimit limits requests per user, or per client address before the user
+// is known. name separates the buckets of different route groups.
+func RateLimit(name string, limit config.RateLimit) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == "OPTIONS" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			key := name + ":ip:" + ClientIP(r)
+			if user, ok := r.Context().Value("user").(models.User); ok {
+				key = name + ":user:" + user.ID
+			}
+
+			wait, err := ratelimit.Take(key, limit.Rate, limit.Burst)
+			if err != nil {
+				// Fail open rather than take the API down with the store
+				log.Printf("Error checking rate limit: %v", err)
+			} else if wait > 0 {
+				w.Header().Set("Retry-After", fmt.Sprintf("%d", int(math.Ceil(wait.Seconds()))))
+				http.Error(w, "Too many requests", http.StatusTooManyRequests)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// ClientIP returns the address of the connecting client. Forwarding headers
+// are ignored since clients can set them to dodge per-address limits.
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -1,7 +1,10 @@
 
 package models
 
-import "time"
+import (
+	"encoding/json"
+	"time"
+)
 
 // User model
 type User struct {
@@ -10,9 +13,20 @@ type User struct {
 	Email     string    `json:"email"`
 	Password  string    `json:"-"` // Hashed password, not exposed in JSON
 	Avatar    string    `json:"avatar,omitempty"`
+	Role      string    `json:"role,omitempty"`
 	IsOnline  bool      `json:"isOnline"`
 	LastSeen  time.Time `json:"lastSeen,omitempty"`
 	CreatedAt time.Time `json:"createdAt,omitempty"`
+
+	// Profile fields, only filled in where the profile is shown
+	DisplayName string `json:"displayName,omitempty"`
+	Bio         string `json:"bio,omitempty"`
+	StatusText  string `json:"statusText,omitempty"`
+	// Presence is the state other users see, see package presence
+	Presence string `json:"presence,omitempty"`
+
+	// SuspendedAt is only filled in for admin views
+	SuspendedAt *time.Time `json:"suspendedAt,omitempty"`
 }
 
 // Chat model
@@ -32,6 +46,13 @@ type Message struct {
 	Content   string    `json:"content"`
 	Timestamp time.Time `json:"timestamp"`
 	IsRead    bool      `json:"isRead"`
+	// Quarantined messages are only visible to their sender and moderators
+	Quarantined bool       `json:"quarantined,omitempty"`
+	EditedAt    *time.Time `json:"editedAt,omitempty"`
+	// Kind is "text" for messages users write and "call" for the record of
+	// a call, which is posted by the server in the caller's name
+	Kind   string `json:"kind,omitempty"`
+	CallID string `json:"callId,omitempty"`
 }
 
 // Request/Response types
@@ -63,3 +84,221 @@ type LoginResponse struct {
 	User
 	Token string `json:"token"`
 }
+
+// Two-factor authentication types
+type TwoFactorCodeRequest struct {
+	Code string `json:"code"`
+}
+
+type TwoFactorVerifyRequest struct {
+	ChallengeToken string `json:"challengeToken"`
+	Code           string `json:"code"`
+}
+
+type TwoFactorEnrollResponse struct {
+	Secret          string `json:"secret"`
+	ProvisioningURI string `json:"provisioningUri"`
+}
+
+type TwoFactorChallengeResponse struct {
+	TwoFactorRequired bool   `json:"twoFactorRequired"`
+	ChallengeToken    string `json:"challengeToken"`
+}
+
+type RecoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recoveryCodes"`
+}
+
+type OIDCAuthorizationResponse struct {
+	AuthorizationURL string `json:"authorizationUrl"`
+}
+
+// Admin types
+type SetRoleRequest struct {
+	Role string `json:"role"`
+}
+
+type AdminChat struct {
+	ID               string     `json:"id"`
+	Name             string     `json:"name"`
+	IsGroup          bool       `json:"isGroup"`
+	ParticipantCount int        `json:"participantCount"`
+	MessageCount     int        `json:"messageCount"`
+	LastMessageAt    *time.Time `json:"lastMessageAt,omitempty"`
+	CreatedAt        time.Time  `json:"createdAt"`
+}
+
+// Moderation types
+type ReportMessageRequest struct {
+	Reason  string `json:"reason"`
+	Details string `json:"details,omitempty"`
+}
+
+type MessageReport struct {
+	ID         string     `json:"id"`
+	MessageID  string     `json:"messageId"`
+	ChatID     string     `json:"chatId"`
+	SenderID   string     `json:"senderId"`
+	ReporterID string     `json:"reporterId,omitempty"`
+	Reason     string     `json:"reason"`
+	Details    string     `json:"details,omitempty"`
+	Content    string     `json:"content"`
+	Status     string     `json:"status"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	ResolvedAt *time.Time `json:"resolvedAt,omitempty"`
+}
+
+type ModerationAction struct {
+	ID          string    `json:"id"`
+	ReportID    string    `json:"reportId"`
+	ModeratorID string    `json:"moderatorId"`
+	Action      string    `json:"action"`
+	Note        string    `json:"note,omitempty"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+type ModerationActionRequest struct {
+	Action string `json:"action"`
+	Note   string `json:"note,omitempty"`
+}
+
+// ReportDetail is a report with the messages around the reported one and the
+// decisions taken so far
+type ReportDetail struct {
+	MessageReport
+	Context []Message          `json:"context"`
+	Actions []ModerationAction `json:"actions"`
+}
+
+// ChatFilterSettings overrides the configured message filters for one chat.
+// Nil and empty fields keep the defaults; BlockedWords are added to the
+// configured list.
+type ChatFilterSettings struct {
+	MaxLength          *int     `json:"maxLength,omitempty"`
+	BlockedWords       []string `json:"blockedWords,omitempty"`
+	BlockedWordsAction string   `json:"blockedWordsAction,omitempty"`
+	MaxLinks           *int     `json:"maxLinks,omitempty"`
+	DisabledFilters    []string `json:"disabledFilters,omitempty"`
+}
+
+// DeleteAccountRequest confirms an account deletion. The password is
+// required for accounts that have one.
+type DeleteAccountRequest struct {
+	Password string `json:"password"`
+}
+
+type AccountDeletionResponse struct {
+	DeletionScheduledAt time.Time `json:"deletionScheduledAt"`
+}
+
+// UpdateProfileRequest changes the fields that are set and leaves the rest
+type UpdateProfileRequest struct {
+	Username    *string `json:"username,omitempty"`
+	DisplayName *string `json:"displayName,omitempty"`
+	Bio         *string `json:"bio,omitempty"`
+	StatusText  *string `json:"statusText,omitempty"`
+}
+
+// ChangeEmailRequest starts an email change. The password is required for
+// accounts that have one.
+type ChangeEmailRequest struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+type VerifyEmailRequest struct {
+	Token string `json:"token"`
+}
+
+// PublicProfile is what users sharing a chat see of each other
+type PublicProfile struct {
+	ID          string `json:"id"`
+	Username    string `json:"username"`
+	DisplayName string `json:"displayName,omitempty"`
+	Bio         string `json:"bio,omitempty"`
+	StatusText  string `json:"statusText,omitempty"`
+	Avatar      string `json:"avatar,omitempty"`
+}
+
+// SetPresenceRequest changes the chosen presence state and custom status.
+// Fields left out are unchanged; an empty status text clears it.
+type SetPresenceRequest struct {
+	State           string     `json:"state,omitempty"`
+	StatusText      *string    `json:"statusText,omitempty"`
+	StatusExpiresAt *time.Time `json:"statusExpiresAt,omitempty"`
+}
+
+// PresenceResponse is the current user's own presence. State is
+// "invisible" for invisible users, who appear offline to others.
+type PresenceResponse struct {
+	State           string     `json:"state"`
+	StatusText      string     `json:"statusText,omitempty"`
+	StatusExpiresAt *time.Time `json:"statusExpiresAt,omitempty"`
+}
+
+// ConnectionStats are delivery metrics for one WebSocket connection.
+// Delivered counts frames handed to the write pump; Coalesced counts low
+// priority frames replaced by a newer one before being sent.
+type ConnectionStats struct {
+	UserID      string     `json:"userId"`
+	ConnectedAt time.Time  `json:"connectedAt"`
+	Queued      int        `json:"queued"`
+	Capacity    int        `json:"capacity"`
+	PendingLow  int        `json:"pendingLow"`
+	Delivered   uint64     `json:"delivered"`
+	Coalesced   uint64     `json:"coalesced"`
+	Dropped     uint64     `json:"dropped"`
+	SlowSince   *time.Time `json:"slowSince,omitempty"`
+}
+
+// Event is a WebSocket frame read from /api/events/poll. ID can be passed
+// back as lastEventId to resume after it.
+type Event struct {
+	ID      string          `json:"id"`
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// EventsResponse is what /api/events/poll returns. LastEventID is set even
+// when no events arrived before the poll timed out.
+type EventsResponse struct {
+	Events      []Event `json:"events"`
+	LastEventID string  `json:"lastEventId"`
+}
+
+// Call is a voice or video call in a chat. State is one of ringing,
+// accepted, declined, ended or missed.
+type Call struct {
+	ID           string            `json:"id"`
+	ChatID       string            `json:"chatId"`
+	InitiatorID  string            `json:"initiatorId"`
+	Video        bool              `json:"video"`
+	State        string            `json:"state"`
+	CreatedAt    time.Time         `json:"createdAt"`
+	AnsweredAt   *time.Time        `json:"answeredAt,omitempty"`
+	EndedAt      *time.Time        `json:"endedAt,omitempty"`
+	Participants []CallParticipant `json:"participants"`
+}
+
+// CallParticipant is one user's part in a call. State is one of ringing,
+// accepted, declined, missed or left.
+type CallParticipant struct {
+	UserID   string     `json:"userId"`
+	State    string     `json:"state"`
+	JoinedAt *time.Time `json:"joinedAt,omitempty"`
+	LeftAt   *time.Time `json:"leftAt,omitempty"`
+}
+
+// ICEServer is a STUN or TURN server in the shape RTCPeerConnection takes
+type ICEServer struct {
+	URLs       []string `json:"urls"`
+	Username   string   `json:"username,omitempty"`
+	Credential string   `json:"credential,omitempty"`
+}
+
+// ICEServersResponse lists the servers call clients should use. TURN
+// credentials stop working at ExpiresAt.
+type ICEServersResponse struct {
+	ICEServers []ICEServer `json:"iceServers"`
+	ExpiresAt  *time.Time  `json:"expiresAt,omitempty"`
+}
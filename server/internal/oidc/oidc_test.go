@@ -0,0 +1,425 @@
+package oidc
+
+import (
+	"chat-app/internal/config"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// mockIdP is an OpenID Connect provider serving discovery, a key set and a
+// token endpoint that checks PKCE
+type mockIdP struct {
+	server *httptest.Server
+	issuer string
+
+	mutex sync.Mutex
+	key   *rsa.PrivateKey
+	kid   string
+	// codes maps issued authorization codes to their code challenge
+	codes map[string]string
+	// claims are put in every ID token; "iss", "aud" and "exp" default to
+	// valid values unless set
+	claims jwt.MapClaims
+	// sign signs ID tokens, if set, instead of the published key
+	sign func(claims jwt.MapClaims) string
+}
+
+func newMockIdP(t *testing.T) *mockIdP {
+	idp := &mockIdP{
+		key:   newKey(t),
+		kid:   "key-1",
+		codes: make(map[string]string),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 idp.issuer,
+			"authorization_endpoint": idp.issuer + "/authorize",
+			"token_endpoint":         idp.issuer + "/token",
+			"jwks_uri":               idp.issuer + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		idp.mutex.Lock()
+		defer idp.mutex.Unlock()
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kid": idp.kid,
+				"kty": "RSA",
+				"use": "sig",
+				"n":   base64.RawURLEncoding.EncodeToString(idp.key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(idp.key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/token", idp.token)
+
+	idp.server = httptest.NewServer(mux)
+	idp.issuer = idp.server.URL
+	t.Cleanup(idp.server.Close)
+	return idp
+}
+
+func newKey(t *testing.T) *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// authorize stands in for the user signing in at the provider and returns
+// the code the browser brings back
+func (idp *mockIdP) authorize(t *testing.T, authURL string) string {
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Query().Get("code_challenge_method") != "S256" {
+		t.Fatalf("code_challenge_method = %q, want S256", u.Query().Get("code_challenge_method"))
+	}
+
+	code := "code-" + u.Query().Get("state")
+	idp.mutex.Lock()
+	idp.codes[code] = u.Query().Get("code_challenge")
+	idp.claims["nonce"] = u.Query().Get("nonce")
+	idp.mutex.Unlock()
+	return code
+}
+
+func (idp *mockIdP) token(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	idp.mutex.Lock()
+	defer idp.mutex.Unlock()
+
+	challenge, ok := idp.codes[r.Form.Get("code")]
+	delete(idp.codes, r.Form.Get("code"))
+	sum := sha256.Sum256([]byte(r.Form.Get("code_verifier")))
+	if !ok || base64.RawURLEncoding.EncodeToString(sum[:]) != challenge {
+		http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+		return
+	}
+
+	claims := jwt.MapClaims{
+		"iss": idp.issuer,
+		"aud": "client",
+		"exp": time.Now().Add(time.Minute).Unix(),
+	}
+	for k, v := range idp.claims {
+		claims[k] = v
+	}
+
+	var signed string
+	if idp.sign != nil {
+		signed = idp.sign(claims)
+	} else {
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+		token.Header["kid"] = idp.kid
+		signed, _ = token.SignedString(idp.key)
+	}
+	json.NewEncoder(w).Encode(map[string]string{"access_token": "unused", "id_token": signed})
+}
+
+// setupProvider configures a provider named after the test that uses idp
+func setupProvider(t *testing.T, idp *mockIdP) *Provider {
+	name := strings.ReplaceAll(t.Name(), "/", "_")
+	config.OIDCProviders[name] = config.OIDCProvider{
+		IssuerURL:   idp.issuer,
+		ClientID:    "client",
+		RedirectURL: "http://localhost/callback",
+	}
+	t.Cleanup(func() {
+		delete(config.OIDCProviders, name)
+		providersMutex.Lock()
+		delete(providers, name)
+		providersMutex.Unlock()
+	})
+
+	p, err := GetProvider(context.Background(), name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// signIn runs the authorization code flow against idp and returns the
+// claims from the ID token
+func signIn(t *testing.T, p *Provider, idp *mockIdP) (*Claims, error) {
+	state, nonce, challenge, err := BeginAuth(p.Name, "", "binding")
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := idp.authorize(t, p.AuthCodeURL(state, nonce, challenge))
+
+	req, ok, err := TakeAuth(state)
+	if err != nil || !ok {
+		t.Fatal("TakeAuth did not find the state from BeginAuth")
+	}
+	return p.Exchange(context.Background(), code, req.CodeVerifier, req.Nonce)
+}
+
+func TestSignIn(t *testing.T) {
+	idp := newMockIdP(t)
+	idp.claims = jwt.MapClaims{
+		"sub":                "user-1",
+		"email":              "user@example.com",
+		"email_verified":     "true",
+		"name":               "Some User",
+		"preferred_username": "someuser",
+		"picture":            "https://example.com/a.png",
+	}
+	p := setupProvider(t, idp)
+
+	claims, err := signIn(t, p, idp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Claims{
+		Subject:       "user-1",
+		Email:         "user@example.com",
+		EmailVerified: true,
+		Name:          "Some User",
+		Username:      "someuser",
+		Picture:       "https://example.com/a.png",
+	}
+	if *claims != want {
+		t.Errorf("claims = %+v, want %+v", *claims, want)
+	}
+}
+
+func TestSignInRejectsBadTokens(t *testing.T) {
+	otherKey := newKey(t)
+
+	tests := []struct {
+		name   string
+		claims jwt.MapClaims
+		sign   func(idp *mockIdP, claims jwt.MapClaims) string
+	}{
+		{"wrong audience", jwt.MapClaims{"aud": "someone-else"}, nil},
+		{"wrong issuer", jwt.MapClaims{"iss": "https://evil.example.com"}, nil},
+		{"expired", jwt.MapClaims{"exp": time.Now().Add(-time.Minute).Unix()}, nil},
+		{"no subject", jwt.MapClaims{"sub": ""}, nil},
+		{"unknown key", nil, func(idp *mockIdP, claims jwt.MapClaims) string {
+			token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+			token.Header["kid"] = idp.kid
+			signed, _ := token.SignedString(otherKey)
+			return signed
+		}},
+		{"symmetric algorithm", nil, func(idp *mockIdP, claims jwt.MapClaims) string {
+			// Signed with the public key as an HMAC secret, the classic
+			// algorithm confusion attack
+			token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+			token.Header["kid"] = idp.kid
+			signed, _ := token.SignedString(idp.key.N.Bytes())
+			return signed
+		}},
+		{"unsigned", nil, func(idp *mockIdP, claims jwt.MapClaims) string {
+			token := jwt.NewWithClaims(jwt.SigningMethodNone, claims)
+			signed, _ := token.SignedString(jwt.UnsafeAllowNoneSignatureType)
+			return signed
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			idp := newMockIdP(t)
+			idp.claims = jwt.MapClaims{"sub": "user-1"}
+			for k, v := range tt.claims {
+				idp.claims[k] = v
+			}
+			if tt.sign != nil {
+				idp.sign = func(claims jwt.MapClaims) string { return tt.sign(idp, claims) }
+			}
+			p := setupProvider(t, idp)
+
+			if claims, err := signIn(t, p, idp); err == nil {
+				t.Errorf("sign-in succeeded with claims %+v", *claims)
+			}
+		})
+	}
+}
+
+func TestExchangeChecksNonceAndVerifier(t *testing.T) {
+	idp := newMockIdP(t)
+	idp.claims = jwt.MapClaims{"sub": "user-1"}
+	p := setupProvider(t, idp)
+
+	state, nonce, challenge, err := BeginAuth(p.Name, "", "binding")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _, _ := TakeAuth(state)
+
+	code := idp.authorize(t, p.AuthCodeURL(state, nonce, challenge))
+	if _, err := p.Exchange(context.Background(), code, req.CodeVerifier, "another nonce"); err == nil {
+		t.Error("Exchange accepted an ID token with the wrong nonce")
+	}
+
+	code = idp.authorize(t, p.AuthCodeURL(state, nonce, challenge))
+	if _, err := p.Exchange(context.Background(), code, "another verifier", req.Nonce); err == nil {
+		t.Error("Exchange succeeded with the wrong code verifier")
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	idp := newMockIdP(t)
+	idp.claims = jwt.MapClaims{"sub": "user-1"}
+	p := setupProvider(t, idp)
+
+	if _, err := signIn(t, p, idp); err != nil {
+		t.Fatal(err)
+	}
+
+	// Tokens signed with a new key are accepted once the key set is
+	// fetched again
+	idp.mutex.Lock()
+	idp.key = newKey(t)
+	idp.kid = "key-2"
+	idp.mutex.Unlock()
+
+	if _, err := signIn(t, p, idp); err != nil {
+		t.Fatalf("sign-in after key rotation: %v", err)
+	}
+}
+
+func TestDiscoveryRejectsIssuerMismatch(t *testing.T) {
+	idp := newMockIdP(t)
+	config.OIDCProviders["mismatch"] = config.OIDCProvider{IssuerURL: idp.issuer + "/other", ClientID: "client"}
+	defer delete(config.OIDCProviders, "mismatch")
+
+	if _, err := GetProvider(context.Background(), "mismatch"); err == nil {
+		t.Error("GetProvider accepted metadata for another issuer")
+	}
+	if _, err := GetProvider(context.Background(), "missing"); err != ErrUnknownProvider {
+		t.Errorf("GetProvider(missing) = %v, want ErrUnknownProvider", err)
+	}
+}
+
+func TestTakeAuth(t *testing.T) {
+	state, _, _, err := BeginAuth("provider", "user-1", "binding")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, ok, err := TakeAuth(state)
+	if err != nil || !ok || req.Provider != "provider" || req.LinkUserID != "user-1" {
+		t.Fatalf("TakeAuth = %+v, %v", req, ok)
+	}
+	if req.BindingHash == "binding" {
+		t.Error("the binding is stored in the clear")
+	}
+	// Only the browser that started the request may finish it
+	if !req.BoundTo("binding") {
+		t.Error("the request is not bound to the browser that started it")
+	}
+	for _, other := range []string{"", "other", "bindin"} {
+		if req.BoundTo(other) {
+			t.Errorf("the request is bound to %q", other)
+		}
+	}
+	if _, ok, _ := TakeAuth(state); ok {
+		t.Error("a state was accepted twice")
+	}
+	if _, ok, _ := TakeAuth("unknown"); ok {
+		t.Error("an unknown state was accepted")
+	}
+}
+
+func TestTakeAuthExpired(t *testing.T) {
+	defer func(ttl time.Duration) { config.OIDCStateTTL = ttl }(config.OIDCStateTTL)
+	config.OIDCStateTTL = -time.Second
+
+	state, _, _, err := BeginAuth("provider", "", "binding")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := TakeAuth(state); ok {
+		t.Error("an expired state was accepted")
+	}
+}
+
+func TestSlowDiscoveryDoesNotBlockOtherProviders(t *testing.T) {
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer slow.Close()
+	defer close(release)
+
+	idp := newMockIdP(t)
+	config.OIDCProviders["slow"] = config.OIDCProvider{IssuerURL: slow.URL, ClientID: "client"}
+	config.OIDCProviders["fast"] = config.OIDCProvider{IssuerURL: idp.issuer, ClientID: "client"}
+	defer func() {
+		delete(config.OIDCProviders, "slow")
+		delete(config.OIDCProviders, "fast")
+		providersMutex.Lock()
+		delete(providers, "slow")
+		delete(providers, "fast")
+		providersMutex.Unlock()
+	}()
+
+	go GetProvider(context.Background(), "slow")
+	// Let the slow discovery start
+	time.Sleep(50 * time.Millisecond)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := GetProvider(context.Background(), "fast")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("discovery of one provider waited for another")
+	}
+}
+
+func TestDiscoveryFailureIsRetriedLater(t *testing.T) {
+	var requests int
+	var mutex sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		requests++
+		mutex.Unlock()
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	config.OIDCProviders["down"] = config.OIDCProvider{IssuerURL: server.URL, ClientID: "client"}
+	defer delete(config.OIDCProviders, "down")
+	defer func() {
+		providersMutex.Lock()
+		delete(providers, "down")
+		providersMutex.Unlock()
+	}()
+
+	for i := 0; i < 3; i++ {
+		if _, err := GetProvider(context.Background(), "down"); err == nil {
+			t.Fatal("GetProvider succeeded against a failing provider")
+		}
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if requests != 1 {
+		t.Errorf("%d discovery requests, want the failure remembered after 1", requests)
+	}
+}
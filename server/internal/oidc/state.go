@@ -0,0 +1,216 @@
+package oidc
+
+import (
+	"chat-app/internal/config"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// AuthRequest is what the server remembers between redirecting a browser to
+// the provider and handling the callback
+type AuthRequest struct {
+	Provider     string
+	Nonce        string
+	CodeVerifier string
+	// LinkUserID is set when an authenticated user is linking the provider
+	// to their existing account rather than signing in
+	LinkUserID string
+	// BindingHash is the hash of a random value kept in a cookie in the
+	// browser that started the request, so the callback only completes in
+	// that browser
+	BindingHash string
+}
+
+// StateStore keeps authorization requests between BeginAuth and TakeAuth
+type StateStore interface {
+	// Save keeps req under state for ttl
+	Save(state string, req AuthRequest, ttl time.Duration) error
+	// Take returns and forgets the request for state. ok is false when
+	// there is none or it has expired.
+	Take(state string) (req AuthRequest, ok bool, err error)
+}
+
+var (
+	stateStore StateStore = NewMemoryStateStore()
+	stateMutex            = &sync.RWMutex{}
+)
+
+// SetStateStore replaces where authorization requests are kept, e.g. with a
+// DatabaseStateStore so the callback may reach any server instance
+func SetStateStore(s StateStore) {
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+	stateStore = s
+}
+
+func currentStateStore() StateStore {
+	stateMutex.RLock()
+	defer stateMutex.RUnlock()
+	return stateStore
+}
+
+// BeginAuth creates the state, nonce and PKCE verifier for a new
+// authorization request bound to binding, the value of a cookie set in the
+// browser, and returns the state with the code challenge
+func BeginAuth(provider, linkUserID, binding string) (state, nonce, codeChallenge string, err error) {
+	state, err = randomString(24)
+	if err != nil {
+		return "", "", "", err
+	}
+	nonce, err = randomString(24)
+	if err != nil {
+		return "", "", "", err
+	}
+	verifier, codeChallenge, err := NewPKCE()
+	if err != nil {
+		return "", "", "", err
+	}
+
+	err = currentStateStore().Save(state, AuthRequest{
+		Provider:     provider,
+		Nonce:        nonce,
+		CodeVerifier: verifier,
+		LinkUserID:   linkUserID,
+		BindingHash:  hashBinding(binding),
+	}, config.OIDCStateTTL)
+	if err != nil {
+		return "", "", "", err
+	}
+	return state, nonce, codeChallenge, nil
+}
+
+// TakeAuth returns and forgets the authorization request for a state. Each
+// state can be used once.
+func TakeAuth(state string) (AuthRequest, bool, error) {
+	return currentStateStore().Take(state)
+}
+
+// NewBinding returns a random value for the browser binding cookie
+func NewBinding() (string, error) {
+	return randomString(32)
+}
+
+// BoundTo reports whether the request was started by the browser holding
+// binding. An empty binding never matches.
+func (req AuthRequest) BoundTo(binding string) bool {
+	if binding == "" || req.BindingHash == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(hashBinding(binding)), []byte(req.BindingHash)) == 1
+}
+
+func hashBinding(binding string) string {
+	if binding == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(binding))
+	return hex.EncodeToString(sum[:])
+}
+
+// MemoryStateStore keeps requests in process memory, so the callback must
+// reach the instance that started the sign-in
+type MemoryStateStore struct {
+	mutex   sync.Mutex
+	pending map[string]memoryAuthRequest
+}
+
+type memoryAuthRequest struct {
+	AuthRequest
+	expiresAt time.Time
+}
+
+func NewMemoryStateStore() *MemoryStateStore {
+	return &MemoryStateStore{pending: make(map[string]memoryAuthRequest)}
+}
+
+func (s *MemoryStateStore) Save(state string, req AuthRequest, ttl time.Duration) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// Drop abandoned requests while we hold the lock
+	now := time.Now()
+	for key, r := range s.pending {
+		if now.After(r.expiresAt) {
+			delete(s.pending, key)
+		}
+	}
+
+	s.pending[state] = memoryAuthRequest{req, now.Add(ttl)}
+	return nil
+}
+
+func (s *MemoryStateStore) Take(state string) (AuthRequest, bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	r, ok := s.pending[state]
+	if !ok {
+		return AuthRequest{}, false, nil
+	}
+	delete(s.pending, state)
+
+	if time.Now().After(r.expiresAt) {
+		return AuthRequest{}, false, nil
+	}
+	return r.AuthRequest, true, nil
+}
+
+// DatabaseStateStore keeps requests in the oidc_auth_requests table so every
+// server instance can complete a sign-in another one started
+type DatabaseStateStore struct {
+	DB *sql.DB
+}
+
+func NewDatabaseStateStore(db *sql.DB) *DatabaseStateStore {
+	return &DatabaseStateStore{DB: db}
+}
+
+func (s *DatabaseStateStore) Save(state string, req AuthRequest, ttl time.Duration) error {
+	// Drop abandoned requests first so the table doesn't keep growing
+	if _, err := s.DB.Exec("DELETE FROM oidc_auth_requests WHERE expires_at < NOW()"); err != nil {
+		return err
+	}
+
+	_, err := s.DB.Exec(`
+		INSERT INTO oidc_auth_requests (state, provider, nonce, code_verifier, link_user_id, binding_hash, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, NOW() + INTERVAL ? SECOND)
+	`, state, req.Provider, req.Nonce, req.CodeVerifier, req.LinkUserID, req.BindingHash, int(ttl.Seconds()))
+	return err
+}
+
+func (s *DatabaseStateStore) Take(state string) (AuthRequest, bool, error) {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return AuthRequest{}, false, err
+	}
+	defer tx.Rollback()
+
+	// The row lock makes a state replayed concurrently succeed only once
+	var req AuthRequest
+	var expired bool
+	err = tx.QueryRow(`
+		SELECT provider, nonce, code_verifier, link_user_id, binding_hash, expires_at < NOW()
+		FROM oidc_auth_requests WHERE state = ? FOR UPDATE
+	`, state).Scan(&req.Provider, &req.Nonce, &req.CodeVerifier, &req.LinkUserID, &req.BindingHash, &expired)
+	if err == sql.ErrNoRows {
+		return AuthRequest{}, false, nil
+	}
+	if err != nil {
+		return AuthRequest{}, false, err
+	}
+
+	if _, err := tx.Exec("DELETE FROM oidc_auth_requests WHERE state = ?", state); err != nil {
+		return AuthRequest{}, false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return AuthRequest{}, false, err
+	}
+	if expired {
+		return AuthRequest{}, false, nil
+	}
+	return req, true, nil
+}
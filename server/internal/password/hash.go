@@ -0,0 +1,126 @@
+package password
+
+import (
+	"chat-app/internal/config"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ErrUnknownHash is returned for stored hashes in a format we can't verify
+var ErrUnknownHash = errors.New("unknown password hash format")
+
+// Hash hashes a password with the configured algorithm
+func Hash(password string) (string, error) {
+	if config.PasswordHashAlgorithm == "bcrypt" {
+		hashed, err := bcrypt.GenerateFromPassword([]byte(password), config.BcryptCost)
+		if err != nil {
+			return "", err
+		}
+		return string(hashed), nil
+	}
+	return hashArgon2id(password, config.Argon2)
+}
+
+// Verify checks a password against a stored hash. needsRehash reports that
+// the hash was made with a different algorithm or weaker parameters than
+// currently configured, so the caller should store a new Hash.
+func Verify(password, encoded string) (ok bool, needsRehash bool, err error) {
+	switch {
+	case encoded == "":
+		// Accounts that only sign in through an identity provider
+		return false, false, nil
+	case strings.HasPrefix(encoded, "$argon2id$"):
+		params, salt, key, err := decodeArgon2id(encoded)
+		if err != nil {
+			return false, false, err
+		}
+		candidate := argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism, uint32(len(key)))
+		if subtle.ConstantTimeCompare(candidate, key) != 1 {
+			return false, false, nil
+		}
+		current := config.Argon2
+		needsRehash = config.PasswordHashAlgorithm != "argon2id" ||
+			params.Memory < current.Memory ||
+			params.Iterations < current.Iterations ||
+			params.Parallelism < current.Parallelism ||
+			uint32(len(key)) < current.KeyLength
+		return true, needsRehash, nil
+	case strings.HasPrefix(encoded, "$2"):
+		if err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password)); err != nil {
+			if err == bcrypt.ErrMismatchedHashAndPassword {
+				return false, false, nil
+			}
+			return false, false, err
+		}
+		cost, err := bcrypt.Cost([]byte(encoded))
+		if err != nil {
+			return false, false, err
+		}
+		needsRehash = config.PasswordHashAlgorithm != "bcrypt" || cost < config.BcryptCost
+		return true, needsRehash, nil
+	}
+	return false, false, ErrUnknownHash
+}
+
+// hashArgon2id encodes the hash in the PHC string format used by the
+// reference implementation:
+// $argon2id$v=19$m=65536,t=3,p=2$<salt>$<key>
+func hashArgon2id(password string, params config.Argon2Params) (string, error) {
+	salt := make([]byte, params.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism, params.KeyLength)
+
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, params.Memory, params.Iterations, params.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+func decodeArgon2id(encoded string) (config.Argon2Params, []byte, []byte, error) {
+	var params config.Argon2Params
+
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 {
+		return params, nil, nil, ErrUnknownHash
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return params, nil, nil, ErrUnknownHash
+	}
+
+	// argon2.IDKey panics on zero iterations or parallelism, so they are
+	// rejected here rather than during a login
+	var parallelism uint32
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &parallelism); err != nil {
+		return params, nil, nil, ErrUnknownHash
+	}
+	if params.Iterations < 1 || parallelism < 1 || parallelism > 255 {
+		return params, nil, nil, ErrUnknownHash
+	}
+	params.Parallelism = uint8(parallelism)
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil || len(salt) == 0 {
+		return params, nil, nil, ErrUnknownHash
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return params, nil, nil, ErrUnknownHash
+	}
+
+	params.SaltLength = uint32(len(salt))
+	params.KeyLength = uint32(len(key))
+	return params, salt, key, nil
+}
@@ -0,0 +1,158 @@
+package password
+
+import (
+	"chat-app/internal/config"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// useCheapParams makes hashing fast enough for tests and restores the
+// configuration afterwards
+func useCheapParams(t *testing.T) {
+	algorithm, cost, params := config.PasswordHashAlgorithm, config.BcryptCost, config.Argon2
+	t.Cleanup(func() {
+		config.PasswordHashAlgorithm, config.BcryptCost, config.Argon2 = algorithm, cost, params
+	})
+	config.PasswordHashAlgorithm = "argon2id"
+	config.BcryptCost = bcrypt.MinCost + 1
+	config.Argon2 = config.Argon2Params{Memory: 64, Iterations: 2, Parallelism: 2, SaltLength: 16, KeyLength: 32}
+}
+
+func TestHashAndVerify(t *testing.T) {
+	useCheapParams(t)
+
+	for _, algorithm := range []string{"argon2id", "bcrypt"} {
+		config.PasswordHashAlgorithm = algorithm
+
+		encoded, err := Hash("correct horse")
+		if err != nil {
+			t.Fatalf("%s: %v", algorithm, err)
+		}
+		ok, needsRehash, err := Verify("correct horse", encoded)
+		if !ok || needsRehash || err != nil {
+			t.Errorf("%s: Verify(right password) = %v, %v, %v; want true, false, nil", algorithm, ok, needsRehash, err)
+		}
+		ok, needsRehash, err = Verify("wrong horse", encoded)
+		if ok || needsRehash || err != nil {
+			t.Errorf("%s: Verify(wrong password) = %v, %v, %v; want false, false, nil", algorithm, ok, needsRehash, err)
+		}
+	}
+}
+
+func TestHashUsesRandomSalt(t *testing.T) {
+	useCheapParams(t)
+
+	a, _ := Hash("same password")
+	b, _ := Hash("same password")
+	if a == b {
+		t.Error("two hashes of the same password are identical")
+	}
+}
+
+func TestVerifyNeedsRehash(t *testing.T) {
+	useCheapParams(t)
+
+	tests := []struct {
+		name   string
+		hashed func() string
+	}{
+		{"bcrypt while argon2id is configured", func() string {
+			config.PasswordHashAlgorithm = "bcrypt"
+			defer func() { config.PasswordHashAlgorithm = "argon2id" }()
+			encoded, _ := Hash("secret")
+			return encoded
+		}},
+		{"argon2id with less memory", func() string {
+			return hashWith(t, config.Argon2Params{Memory: 32, Iterations: 2, Parallelism: 2, SaltLength: 16, KeyLength: 32})
+		}},
+		{"argon2id with fewer iterations", func() string {
+			return hashWith(t, config.Argon2Params{Memory: 64, Iterations: 1, Parallelism: 2, SaltLength: 16, KeyLength: 32})
+		}},
+		{"argon2id with less parallelism", func() string {
+			return hashWith(t, config.Argon2Params{Memory: 64, Iterations: 2, Parallelism: 1, SaltLength: 16, KeyLength: 32})
+		}},
+		{"argon2id with a shorter key", func() string {
+			return hashWith(t, config.Argon2Params{Memory: 64, Iterations: 2, Parallelism: 2, SaltLength: 16, KeyLength: 16})
+		}},
+		{"bcrypt with a lower cost", func() string {
+			hashed, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+			config.PasswordHashAlgorithm = "bcrypt"
+			return string(hashed)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.PasswordHashAlgorithm = "argon2id"
+			encoded := tt.hashed()
+			ok, needsRehash, err := Verify("secret", encoded)
+			if !ok || !needsRehash || err != nil {
+				t.Errorf("Verify = %v, %v, %v; want true, true, nil", ok, needsRehash, err)
+			}
+		})
+	}
+
+	// A wrong password never asks for a rehash, which would replace the
+	// hash with one of the wrong password
+	config.PasswordHashAlgorithm = "argon2id"
+	encoded := hashWith(t, config.Argon2Params{Memory: 32, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32})
+	if ok, needsRehash, _ := Verify("wrong", encoded); ok || needsRehash {
+		t.Errorf("Verify(wrong password) = %v, %v; want false, false", ok, needsRehash)
+	}
+
+	// Stronger parameters than configured are kept
+	encoded = hashWith(t, config.Argon2Params{Memory: 128, Iterations: 3, Parallelism: 4, SaltLength: 16, KeyLength: 32})
+	if ok, needsRehash, _ := Verify("secret", encoded); !ok || needsRehash {
+		t.Errorf("Verify(stronger hash) = %v, %v; want true, false", ok, needsRehash)
+	}
+}
+
+func hashWith(t *testing.T, params config.Argon2Params) string {
+	encoded, err := hashArgon2id("secret", params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return encoded
+}
+
+func TestVerifyMalformed(t *testing.T) {
+	useCheapParams(t)
+
+	valid := hashWith(t, config.Argon2)
+	parts := strings.Split(valid, "$")
+	salt, key := parts[4], parts[5]
+
+	tests := []struct {
+		name    string
+		encoded string
+	}{
+		{"unknown algorithm", "$scrypt$ln=15,r=8,p=1$c2FsdA$a2V5"},
+		{"plain text", "secret"},
+		{"missing key", "$argon2id$v=19$m=64,t=2,p=2$" + salt},
+		{"wrong version", "$argon2id$v=16$m=64,t=2,p=2$" + salt + "$" + key},
+		{"garbled parameters", "$argon2id$v=19$m=64;t=2;p=2$" + salt + "$" + key},
+		// argon2.IDKey panics on these, so they must be rejected before it
+		// is called
+		{"zero iterations", "$argon2id$v=19$m=64,t=0,p=2$" + salt + "$" + key},
+		{"zero parallelism", "$argon2id$v=19$m=64,t=2,p=0$" + salt + "$" + key},
+		{"parallelism out of range", "$argon2id$v=19$m=64,t=2,p=256$" + salt + "$" + key},
+		{"empty salt", "$argon2id$v=19$m=64,t=2,p=2$$" + key},
+		{"empty key", "$argon2id$v=19$m=64,t=2,p=2$" + salt + "$"},
+		{"invalid base64", "$argon2id$v=19$m=64,t=2,p=2$!!!$" + key},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ok, needsRehash, err := Verify("secret", tt.encoded)
+			if ok || needsRehash || err != ErrUnknownHash {
+				t.Errorf("Verify = %v, %v, %v; want false, false, ErrUnknownHash", ok, needsRehash, err)
+			}
+		})
+	}
+
+	// Accounts without a password, such as single sign-on only ones, fail
+	// quietly
+	if ok, _, err := Verify("", ""); ok || err != nil {
+		t.Errorf("Verify with no stored hash = %v, %v; want false, nil", ok, err)
+	}
+}
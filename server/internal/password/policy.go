@@ -0,0 +1,95 @@
+package password
+
+import (
+	"bufio"
+	"chat-app/internal/config"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+// PolicyError explains why a password was rejected. Its message is safe to
+// show to the user.
+type PolicyError struct {
+	Reason string
+}
+
+func (e *PolicyError) Error() string {
+	return e.Reason
+}
+
+// Validate checks a new password against the configured policy
+func Validate(password, username, email string) error {
+	length := utf8.RuneCountInString(password)
+	if length < config.PasswordMinLength {
+		return &PolicyError{fmt.Sprintf("Password must be at least %d characters", config.PasswordMinLength)}
+	}
+	if config.PasswordMaxLength > 0 && length > config.PasswordMaxLength {
+		return &PolicyError{fmt.Sprintf("Password must be at most %d characters", config.PasswordMaxLength)}
+	}
+
+	lower := strings.ToLower(password)
+	localPart := strings.SplitN(strings.ToLower(email), "@", 2)[0]
+	for _, personal := range []string{strings.ToLower(username), strings.ToLower(email), localPart} {
+		// Very short names would reject too many reasonable passwords
+		if len(personal) >= 3 && strings.Contains(lower, personal) {
+			return &PolicyError{"Password must not contain your username or email"}
+		}
+	}
+
+	breached, err := IsBreached(password)
+	if err != nil {
+		return err
+	}
+	if breached {
+		return &PolicyError{"This password has appeared in a data breach, please choose another"}
+	}
+
+	return nil
+}
+
+// IsBreached looks the password up in the local breached password list.
+//
+// The list uses the k-anonymity range format of the Pwned Passwords API: the
+// SHA-1 of the password is split into a five character prefix naming a file
+// in config.PasswordBreachedRangeDir, and the file holds "SUFFIX:COUNT"
+// lines for the remaining 35 characters. Without a configured directory the
+// check is skipped.
+func IsBreached(password string) (bool, error) {
+	if config.PasswordBreachedRangeDir == "" {
+		return false, nil
+	}
+
+	sum := sha1.Sum([]byte(password))
+	digest := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := digest[:5], digest[5:]
+
+	file, err := os.Open(filepath.Join(config.PasswordBreachedRangeDir, prefix))
+	if os.IsNotExist(err) {
+		// No hashes in this range
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		entry := strings.SplitN(line, ":", 2)
+		if !strings.EqualFold(entry[0], suffix) {
+			continue
+		}
+		// Padding entries in the downloaded ranges carry a zero count
+		if len(entry) == 2 && strings.TrimSpace(entry[1]) == "0" {
+			return false, nil
+		}
+		return true, nil
+	}
+	return false, scanner.Err()
+}
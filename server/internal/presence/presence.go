@@ -0,0 +1,159 @@
+package presence
+
+import (
+	"chat-app/internal/config"
+	"sync"
+	"time"
+)
+
+// Presence states. Online, Away, DND and Invisible can be chosen by the
+// user; Idle and Away are also reached automatically through inactivity.
+const (
+	Online    = "online"
+	Idle      = "idle"
+	Away      = "away"
+	DND       = "dnd"
+	Invisible = "invisible"
+	Offline   = "offline"
+)
+
+// ValidChoice reports whether a user may pick state explicitly
+func ValidChoice(state string) bool {
+	return state == Online || state == Away || state == DND || state == Invisible
+}
+
+// entry is kept for every user connected to this server
+type entry struct {
+	choice       string
+	lastActivity time.Time
+	// lastVisible is the state others were last told about
+	lastVisible string
+}
+
+var (
+	entries = make(map[string]*entry)
+	mutex   = &sync.Mutex{}
+)
+
+// Connect marks a user as connected with their chosen state and returns
+// what others now see
+func Connect(userID, choice string) string {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if !ValidChoice(choice) {
+		choice = Online
+	}
+	e := &entry{choice: choice, lastActivity: time.Now()}
+	entries[userID] = e
+	e.lastVisible = visible(e, time.Now())
+	return e.lastVisible
+}
+
+// Disconnect forgets a user's connection
+func Disconnect(userID string) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	delete(entries, userID)
+}
+
+// Touch records client activity and reports whether what others see
+// changed, e.g. from idle back to online
+func Touch(userID string) bool {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	e, ok := entries[userID]
+	if !ok {
+		return false
+	}
+	e.lastActivity = time.Now()
+	return e.update(time.Now())
+}
+
+// SetChoice changes a connected user's chosen state and reports whether what
+// others see changed
+func SetChoice(userID, choice string) bool {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	e, ok := entries[userID]
+	if !ok {
+		return false
+	}
+	e.choice = choice
+	return e.update(time.Now())
+}
+
+// State returns the user's own state, which for invisible users is
+// Invisible rather than Offline
+func State(userID string) string {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	e, ok := entries[userID]
+	if !ok {
+		return Offline
+	}
+	if e.choice == Invisible {
+		return Invisible
+	}
+	return visible(e, time.Now())
+}
+
+// Visible returns the state other users see. ok is false for users not
+// connected to this server.
+func Visible(userID string) (state string, ok bool) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	e, ok := entries[userID]
+	if !ok {
+		return Offline, false
+	}
+	return visible(e, time.Now()), true
+}
+
+// Sweep re-evaluates inactivity and returns the users whose visible state
+// changed since others were last told
+func Sweep() []string {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	now := time.Now()
+	var changed []string
+	for userID, e := range entries {
+		if e.update(now) {
+			changed = append(changed, userID)
+		}
+	}
+	return changed
+}
+
+// update recomputes the visible state and reports whether it changed
+func (e *entry) update(now time.Time) bool {
+	state := visible(e, now)
+	if state == e.lastVisible {
+		return false
+	}
+	e.lastVisible = state
+	return true
+}
+
+func visible(e *entry, now time.Time) string {
+	switch {
+	case e.choice == Invisible:
+		return Offline
+	case e.choice == DND || e.choice == Away:
+		return e.choice
+	}
+
+	inactive := now.Sub(e.lastActivity)
+	switch {
+	case inactive >= config.PresenceAwayAfter:
+		return Away
+	case inactive >= config.PresenceIdleAfter:
+		return Idle
+	}
+	return Online
+}
@@ -0,0 +1,88 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// MessagePackSubprotocol is Subprotocol with frames encoded as MessagePack
+// binary messages instead of JSON text
+const MessagePackSubprotocol = Subprotocol + ".msgpack"
+
+// Encoding is a wire format for frames. Frames are built, queued and passed
+// between instances as JSON; an Encoding converts them on the way to and
+// from the client, so the rest of the server never sees the difference.
+type Encoding interface {
+	// Binary reports whether frames are sent as binary WebSocket messages
+	// rather than text
+	Binary() bool
+	// Encode converts a JSON frame to the wire format
+	Encode(frame []byte) ([]byte, error)
+	// Decode converts a frame from the wire format to JSON
+	Decode(data []byte) ([]byte, error)
+}
+
+var (
+	// JSON sends frames as they are
+	JSON Encoding = jsonEncoding{}
+	// MessagePack sends frames as MessagePack, which is smaller and
+	// cheaper to parse on mobile clients. Timestamps stay RFC 3339
+	// strings.
+	MessagePack Encoding = msgpackEncoding{}
+)
+
+// Subprotocols are the subprotocols the server speaks. See Negotiate for
+// how one is picked.
+var Subprotocols = []string{Subprotocol, MessagePackSubprotocol}
+
+var encodings = map[string]Encoding{
+	Subprotocol:            JSON,
+	MessagePackSubprotocol: MessagePack,
+}
+
+// EncodingFor returns the encoding of a negotiated subprotocol. No
+// subprotocol means JSON.
+func EncodingFor(subprotocol string) Encoding {
+	if enc, ok := encodings[subprotocol]; ok {
+		return enc
+	}
+	return JSON
+}
+
+type jsonEncoding struct{}
+
+func (jsonEncoding) Binary() bool {
+	return false
+}
+
+func (jsonEncoding) Encode(frame []byte) ([]byte, error) {
+	return frame, nil
+}
+
+func (jsonEncoding) Decode(data []byte) ([]byte, error) {
+	return data, nil
+}
+
+type msgpackEncoding struct{}
+
+func (msgpackEncoding) Binary() bool {
+	return true
+}
+
+func (msgpackEncoding) Encode(frame []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(frame))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	return appendMsgpack(nil, v)
+}
+
+func (msgpackEncoding) Decode(data []byte) ([]byte, error) {
+	v, err := decodeMsgpack(data)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(v)
+}
@@ -0,0 +1,111 @@
+package protocol
+
+import (
+	"bytes"
+	"chat-app/internal/config"
+	"chat-app/internal/models"
+	"compress/flate"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+type sampleFrame struct {
+	name  string
+	frame []byte
+}
+
+// sampleFrames returns typical frames sent to clients
+func sampleFrames(tb testing.TB) []sampleFrame {
+	now := time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)
+	chatID := "0b6a3c8e-5d0f-4e43-9a7e-2f1c6d8b9e01"
+	userID := "7f2e9d41-3b6c-4a5e-8d1f-0c9b2a7e6f53"
+
+	samples := []struct {
+		name    string
+		payload interface{}
+	}{
+		{"message", models.Message{
+			ID:        "c4d5e6f7-1a2b-4c3d-8e9f-a0b1c2d3e4f5",
+			ChatID:    chatID,
+			SenderID:  userID,
+			Content:   "Are we still on for the review at three? I moved the notes to the shared folder.",
+			Timestamp: now,
+		}},
+		{"typing", TypingEvent{ChatID: chatID, UserID: userID, IsTyping: true}},
+		{"status", StatusEvent{UserID: userID, IsOnline: true, Presence: "away", StatusText: "In a meeting"}},
+		{"messages_read", MessagesReadEvent{ChatID: chatID, UserID: userID, ReadAt: now}},
+		{"error", ErrorEvent{Code: "rate_limited", Message: "Too many messages, slow down", RetryAfter: 2}},
+	}
+
+	var frames []sampleFrame
+	for _, s := range samples {
+		frame, err := json.Marshal(struct {
+			Type    string      `json:"type"`
+			Payload interface{} `json:"payload"`
+		}{s.name, s.payload})
+		if err != nil {
+			tb.Fatal(err)
+		}
+		frames = append(frames, sampleFrame{s.name, frame})
+	}
+	return frames
+}
+
+// deflate compresses data the way permessage-deflate does without context
+// takeover, which is how the server compresses
+func deflate(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, config.WebSocketCompressionLevel)
+	if err != nil {
+		return nil, err
+	}
+	w.Write(data)
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+	// The empty block ending the flush is left off the wire
+	return buf.Bytes()[:buf.Len()-4], nil
+}
+
+// benchmarkFrames encodes every sample frame and reports the size of the
+// result as bytes/op, so encodings can be compared with benchstat
+func benchmarkFrames(b *testing.B, encode func(frame []byte) ([]byte, error)) {
+	for _, s := range sampleFrames(b) {
+		s := s
+		b.Run(s.name, func(b *testing.B) {
+			var out []byte
+			for i := 0; i < b.N; i++ {
+				var err error
+				if out, err = encode(s.frame); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(len(out)), "bytes/op")
+		})
+	}
+}
+
+func BenchmarkJSON(b *testing.B) {
+	benchmarkFrames(b, JSON.Encode)
+}
+
+func BenchmarkMessagePack(b *testing.B) {
+	benchmarkFrames(b, MessagePack.Encode)
+}
+
+func BenchmarkJSONDeflate(b *testing.B) {
+	benchmarkFrames(b, func(frame []byte) ([]byte, error) {
+		return deflate(frame)
+	})
+}
+
+func BenchmarkMessagePackDeflate(b *testing.B) {
+	benchmarkFrames(b, func(frame []byte) ([]byte, error) {
+		packed, err := MessagePack.Encode(frame)
+		if err != nil {
+			return nil, err
+		}
+		return deflate(packed)
+	})
+}
@@ -0,0 +1,283 @@
+package protocol
+
+import (
+	"bytes"
+	"chat-app/internal/models"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// normalize parses JSON keeping numbers exact so documents can be compared
+func normalize(t *testing.T, data []byte) interface{} {
+	t.Helper()
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		t.Fatalf("invalid JSON %s: %v", data, err)
+	}
+	return v
+}
+
+func jsonString(s string) string {
+	data, _ := json.Marshal(s)
+	return string(data)
+}
+
+func jsonArray(n int) string {
+	return "[" + strings.TrimSuffix(strings.Repeat("1,", n), ",") + "]"
+}
+
+func jsonObject(n int) string {
+	fields := make([]string, n)
+	for i := range fields {
+		fields[i] = jsonString(strings.Repeat("k", i+1)) + ":" + jsonString("v")
+	}
+	return "{" + strings.Join(fields, ",") + "}"
+}
+
+func TestMsgpackRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		json string
+		// prefix is the start of the expected encoding, if checked
+		prefix []byte
+	}{
+		{"nil", `null`, []byte{0xc0}},
+		{"false", `false`, []byte{0xc2}},
+		{"true", `true`, []byte{0xc3}},
+
+		{"zero", `0`, []byte{0x00}},
+		{"positive fixint max", `127`, []byte{0x7f}},
+		{"uint8 min", `128`, []byte{0xcc, 0x80}},
+		{"uint8 max", `255`, []byte{0xcc, 0xff}},
+		{"uint16 min", `256`, []byte{0xcd, 0x01, 0x00}},
+		{"uint16 max", `65535`, []byte{0xcd, 0xff, 0xff}},
+		{"uint32 min", `65536`, []byte{0xce, 0x00, 0x01, 0x00, 0x00}},
+		{"uint32 max", `4294967295`, []byte{0xce, 0xff, 0xff, 0xff, 0xff}},
+		{"uint64 min", `4294967296`, []byte{0xcf, 0, 0, 0, 1, 0, 0, 0, 0}},
+		{"int64 max", `9223372036854775807`, []byte{0xcf, 0x7f, 0xff}},
+		{"negative fixint max", `-1`, []byte{0xff}},
+		{"negative fixint min", `-32`, []byte{0xe0}},
+		{"int8 max", `-33`, []byte{0xd0, 0xdf}},
+		{"int8 min", `-128`, []byte{0xd0, 0x80}},
+		{"int16 max", `-129`, []byte{0xd1, 0xff, 0x7f}},
+		{"int16 min", `-32768`, []byte{0xd1, 0x80, 0x00}},
+		{"int32 max", `-32769`, []byte{0xd2, 0xff, 0xff, 0x7f, 0xff}},
+		{"int32 min", `-2147483648`, []byte{0xd2, 0x80, 0, 0, 0}},
+		{"int64 max negative", `-2147483649`, []byte{0xd3, 0xff, 0xff, 0xff, 0xff, 0x7f}},
+		{"int64 min", `-9223372036854775808`, []byte{0xd3, 0x80, 0, 0, 0, 0, 0, 0, 0}},
+
+		{"float", `1.5`, []byte{0xcb, 0x3f, 0xf8}},
+		{"negative float", `-0.25`, []byte{0xcb, 0xbf, 0xd0}},
+		{"large float", `1e+300`, []byte{0xcb}},
+
+		{"empty string", `""`, []byte{0xa0}},
+		{"fixstr max", jsonString(strings.Repeat("a", 31)), []byte{0xbf, 'a'}},
+		{"str8 min", jsonString(strings.Repeat("a", 32)), []byte{0xd9, 32, 'a'}},
+		{"str8 max", jsonString(strings.Repeat("a", 255)), []byte{0xd9, 255, 'a'}},
+		{"str16 min", jsonString(strings.Repeat("a", 256)), []byte{0xda, 0x01, 0x00, 'a'}},
+		{"str16 max", jsonString(strings.Repeat("a", 65535)), []byte{0xda, 0xff, 0xff, 'a'}},
+		{"str32", jsonString(strings.Repeat("a", 65536)), []byte{0xdb, 0, 1, 0, 0, 'a'}},
+		// Lengths count bytes, not characters
+		{"multibyte string", `"héllo wörld ✓"`, []byte{0xa0 | 17}},
+
+		{"empty array", `[]`, []byte{0x90}},
+		{"fixarray max", jsonArray(15), []byte{0x9f, 0x01}},
+		{"array16 min", jsonArray(16), []byte{0xdc, 0x00, 0x10, 0x01}},
+		{"array32", jsonArray(65536), []byte{0xdd, 0, 1, 0, 0, 0x01}},
+
+		{"empty map", `{}`, []byte{0x80}},
+		{"fixmap max", jsonObject(15), []byte{0x8f}},
+		{"map16 min", jsonObject(16), []byte{0xde, 0x00, 0x10}},
+		// Keys are sorted so the encoding is stable
+		{"map key order", `{"b":1,"a":2}`, []byte{0x82, 0xa1, 'a', 0x02, 0xa1, 'b', 0x01}},
+
+		{"nested", `{"type":"send_message","payload":{"chatId":"c1","content":"hi","tags":[1,-1,null,true,2.5,{"x":[]}]}}`, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			packed, err := MessagePack.Encode([]byte(tt.json))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.HasPrefix(packed, tt.prefix) {
+				n := len(packed)
+				if n > 16 {
+					n = 16
+				}
+				t.Errorf("encoding starts % x, want % x", packed[:n], tt.prefix)
+			}
+
+			unpacked, err := MessagePack.Decode(packed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := normalize(t, unpacked), normalize(t, []byte(tt.json)); !reflect.DeepEqual(got, want) {
+				t.Errorf("round trip gave %.100s, want %.100s", unpacked, tt.json)
+			}
+		})
+	}
+}
+
+func TestMsgpackDecodeOtherFormats(t *testing.T) {
+	// Formats clients may send that the server never does
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"float32", []byte{0xca, 0x3f, 0xc0, 0x00, 0x00}, `1.5`},
+		{"uint64 max", []byte{0xcf, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, `18446744073709551615`},
+		{"small uint8", []byte{0xcc, 0x05}, `5`},
+		{"small int64", []byte{0xd3, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xfe}, `-2`},
+		{"short str8", []byte{0xd9, 0x02, 'h', 'i'}, `"hi"`},
+		{"short str32", []byte{0xdb, 0, 0, 0, 2, 'h', 'i'}, `"hi"`},
+		{"bin8", []byte{0xc4, 0x02, 'h', 'i'}, `"hi"`},
+		{"bin16", []byte{0xc5, 0, 2, 'h', 'i'}, `"hi"`},
+		{"bin32", []byte{0xc6, 0, 0, 0, 2, 'h', 'i'}, `"hi"`},
+		{"short array16", []byte{0xdc, 0, 1, 0xc0}, `[null]`},
+		{"short array32", []byte{0xdd, 0, 0, 0, 1, 0xc3}, `[true]`},
+		{"short map16", []byte{0xde, 0, 1, 0xa1, 'a', 0x01}, `{"a":1}`},
+		{"short map32", []byte{0xdf, 0, 0, 0, 1, 0xa1, 'a', 0x01}, `{"a":1}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := MessagePack.Decode(tt.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(normalize(t, got), normalize(t, []byte(tt.want))) {
+				t.Errorf("Decode = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// nested returns depth arrays, each holding the next, around nil
+func nested(depth int) []byte {
+	return append(bytes.Repeat([]byte{0x91}, depth), 0xc0)
+}
+
+func TestMsgpackDecodeRejects(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"truncated uint16", []byte{0xcd, 0x01}},
+		{"truncated float64", []byte{0xcb, 0x3f, 0xf8, 0, 0}},
+		{"truncated fixstr", []byte{0xa5, 'h', 'i'}},
+		{"truncated array", []byte{0x93, 0x01, 0x02}},
+		{"truncated map value", []byte{0x81, 0xa1, 'a'}},
+		{"truncated str16 length", []byte{0xda, 0x01}},
+		{"truncated array32 length", []byte{0xdd, 0, 0}},
+
+		// Lengths far beyond the data must fail before allocating
+		{"oversized str32", []byte{0xdb, 0xff, 0xff, 0xff, 0xff, 'a'}},
+		{"oversized bin32", []byte{0xc6, 0xff, 0xff, 0xff, 0xff, 'a'}},
+		{"oversized array32", []byte{0xdd, 0xff, 0xff, 0xff, 0xff, 0xc0}},
+		{"oversized map32", []byte{0xdf, 0xff, 0xff, 0xff, 0xff, 0xa1, 'a', 0xc0}},
+		{"oversized array16", []byte{0xdc, 0xff, 0xff, 0xc0, 0xc0}},
+		{"oversized map16", []byte{0xde, 0x00, 0x02, 0xa1, 'a', 0xc0}},
+
+		{"too deep", nested(maxMsgpackDepth + 1)},
+		{"too deep in maps", append(bytes.Repeat([]byte{0x81, 0xa1, 'a'}, maxMsgpackDepth+1), 0xc0)},
+		{"trailing data", []byte{0xc0, 0xc0}},
+		{"integer map key", []byte{0x81, 0x01, 0x02}},
+		{"nil map key", []byte{0x81, 0xc0, 0x02}},
+		{"never used byte", []byte{0xc1}},
+		{"extension", []byte{0xd4, 0x01, 0x00}},
+		{"timestamp extension", []byte{0xd6, 0xff, 0, 0, 0, 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, err := MessagePack.Decode(tt.data); err == nil {
+				t.Errorf("Decode(% x) = %.100s, want an error", tt.data, got)
+			}
+		})
+	}
+
+	// The deepest frame allowed still decodes
+	if _, err := MessagePack.Decode(nested(maxMsgpackDepth)); err != nil {
+		t.Errorf("Decode at the depth limit: %v", err)
+	}
+}
+
+func TestMsgpackDecodeEveryTruncation(t *testing.T) {
+	frame := []byte(`{"type":"call_signal","requestId":"r1","payload":{"callId":"c","toUserId":"u","type":"ice","candidate":{"sdpMLineIndex":0,"candidate":"` + strings.Repeat("x", 300) + `"},"n":[-70000,70000,1.25]}}`)
+	packed, err := MessagePack.Encode(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n := 0; n < len(packed); n++ {
+		if _, err := MessagePack.Decode(packed[:n]); err == nil {
+			t.Fatalf("Decode accepted the first %d of %d bytes", n, len(packed))
+		}
+	}
+}
+
+func TestMsgpackCommands(t *testing.T) {
+	statusText := "In a meeting"
+	expires := time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)
+
+	// A populated payload for every command clients can send
+	samples := map[string]interface{}{
+		"typing":       TypingCommand{ChatID: "chat-1", IsTyping: true},
+		"activity":     ActivityCommand{},
+		"set_presence": models.SetPresenceRequest{State: "dnd", StatusText: &statusText, StatusExpiresAt: &expires},
+		"send_message": SendMessageCommand{ChatID: "chat-1", Content: "Hello ✓ " + strings.Repeat("long ", 100)},
+		"edit":         EditMessageCommand{ChatID: "chat-1", MessageID: "msg-1", Content: "Edited"},
+		"delete":       DeleteMessageCommand{ChatID: "chat-1", MessageID: "msg-1"},
+		"mark_read":    MarkReadCommand{ChatID: "chat-1"},
+		"subscribe":    SubscribeCommand{ChatIDs: []string{"chat-1", "chat-2"}},
+		"unsubscribe":  UnsubscribeCommand{ChatIDs: []string{}},
+		"call_start":   CallStartCommand{ChatID: "chat-1", Video: true},
+		"call_accept":  CallAcceptCommand{CallID: "call-1"},
+		"call_decline": CallDeclineCommand{CallID: "call-1"},
+		"call_end":     CallEndCommand{CallID: "call-1"},
+		"call_signal": CallSignalCommand{
+			CallID:    "call-1",
+			ToUserID:  "user-2",
+			Type:      SignalICE,
+			Candidate: json.RawMessage(`{"candidate":"candidate:1 1 udp 2122260223 192.0.2.1 54400 typ host","sdpMLineIndex":0,"sdpMid":"0"}`),
+		},
+	}
+	for name := range Commands {
+		if _, ok := samples[name]; !ok {
+			t.Errorf("no sample for command %q", name)
+		}
+	}
+
+	for name, payload := range samples {
+		t.Run(name, func(t *testing.T) {
+			frame, err := json.Marshal(map[string]interface{}{"type": name, "payload": payload, "requestId": "req-1"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			packed, err := MessagePack.Encode(frame)
+			if err != nil {
+				t.Fatal(err)
+			}
+			unpacked, err := MessagePack.Decode(packed)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			decoded, got, err := Decode(unpacked)
+			if err != nil {
+				t.Fatalf("Decode(%s): %v", unpacked, err)
+			}
+			if decoded.Type != name || decoded.RequestID != "req-1" {
+				t.Errorf("frame = %+v", decoded)
+			}
+			if !reflect.DeepEqual(got, payload) {
+				t.Errorf("payload = %+v, want %+v", got, payload)
+			}
+		})
+	}
+}
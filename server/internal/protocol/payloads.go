@@ -0,0 +1,161 @@
+package protocol
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Fields without omitempty are required in command payloads and always set
+// in event payloads.
+
+// TypingCommand tells the other participants of a chat the user is typing
+type TypingCommand struct {
+	ChatID   string `json:"chatId"`
+	IsTyping bool   `json:"isTyping"`
+}
+
+// ActivityCommand is a heartbeat sent while the user is interacting with
+// the client, which keeps them from going idle
+type ActivityCommand struct{}
+
+type SendMessageCommand struct {
+	ChatID  string `json:"chatId"`
+	Content string `json:"content"`
+}
+
+type EditMessageCommand struct {
+	ChatID    string `json:"chatId"`
+	MessageID string `json:"messageId"`
+	Content   string `json:"content"`
+}
+
+type DeleteMessageCommand struct {
+	ChatID    string `json:"chatId"`
+	MessageID string `json:"messageId"`
+}
+
+// MarkReadCommand marks everything others sent to a chat as read
+type MarkReadCommand struct {
+	ChatID string `json:"chatId"`
+}
+
+// SubscribeCommand asks for every event of some chats, such as the one open
+// on screen. Clients that never subscribe or unsubscribe get every event of
+// every chat; the others only get ChatActivityEvent summaries for the
+// chats they aren't subscribed to.
+type SubscribeCommand struct {
+	ChatIDs []string `json:"chatIds"`
+}
+
+// UnsubscribeCommand stops full events for some chats
+type UnsubscribeCommand struct {
+	ChatIDs []string `json:"chatIds"`
+}
+
+// SubscriptionsResult lists the chats a client is now subscribed to
+type SubscriptionsResult struct {
+	ChatIDs []string `json:"chatIds"`
+}
+
+// CallStartCommand rings the other participants of a chat
+type CallStartCommand struct {
+	ChatID string `json:"chatId"`
+	Video  bool   `json:"video"`
+}
+
+type CallAcceptCommand struct {
+	CallID string `json:"callId"`
+}
+
+type CallDeclineCommand struct {
+	CallID string `json:"callId"`
+}
+
+// CallEndCommand leaves a call, or cancels it if the caller sends it while
+// it is still ringing
+type CallEndCommand struct {
+	CallID string `json:"callId"`
+}
+
+// Signal types relayed between call participants
+const (
+	SignalOffer  = "offer"
+	SignalAnswer = "answer"
+	SignalICE    = "ice"
+)
+
+// CallSignalCommand passes a WebRTC session description ("offer" or
+// "answer", in SDP) or an ICE candidate ("ice", in Candidate) to another
+// participant of the call. In group calls each pair of participants
+// negotiates its own connection.
+type CallSignalCommand struct {
+	CallID    string          `json:"callId"`
+	ToUserID  string          `json:"toUserId"`
+	Type      string          `json:"type"`
+	SDP       string          `json:"sdp,omitempty"`
+	Candidate json.RawMessage `json:"candidate,omitempty"`
+}
+
+type TypingEvent struct {
+	ChatID   string `json:"chatId"`
+	UserID   string `json:"userId"`
+	IsTyping bool   `json:"isTyping"`
+}
+
+// StatusEvent is a user's presence as others see it. Invisible users are
+// reported as offline.
+type StatusEvent struct {
+	UserID     string `json:"userId"`
+	IsOnline   bool   `json:"isOnline"`
+	Presence   string `json:"presence"`
+	StatusText string `json:"statusText"`
+}
+
+// CallSignalEvent is a CallSignalCommand relayed to its recipient
+type CallSignalEvent struct {
+	CallID     string          `json:"callId"`
+	FromUserID string          `json:"fromUserId"`
+	Type       string          `json:"type"`
+	SDP        string          `json:"sdp,omitempty"`
+	Candidate  json.RawMessage `json:"candidate,omitempty"`
+}
+
+// ChatActivityEvent tells a subscribing client there is a new message in a
+// chat it isn't subscribed to
+type ChatActivityEvent struct {
+	ChatID    string    `json:"chatId"`
+	MessageID string    `json:"messageId"`
+	SenderID  string    `json:"senderId"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+type MessageDeletedEvent struct {
+	ChatID    string `json:"chatId"`
+	MessageID string `json:"messageId"`
+}
+
+// MessagesReadEvent tells the other participants a user has read a chat
+type MessagesReadEvent struct {
+	ChatID string    `json:"chatId"`
+	UserID string    `json:"userId"`
+	ReadAt time.Time `json:"readAt"`
+}
+
+// WarningEvent tells a user a moderator warned them about a message
+type WarningEvent struct {
+	MessageID string `json:"messageId"`
+	Reason    string `json:"reason"`
+	Note      string `json:"note"`
+}
+
+// ResyncEvent is sent by /api/events when the events after Last-Event-ID
+// are no longer available. Clients should reload what they show.
+type ResyncEvent struct{}
+
+// ErrorEvent rejects a frame. RetryAfter is in seconds and only set for
+// rate limited frames.
+type ErrorEvent struct {
+	Code       string `json:"code"`
+	Message    string `json:"message"`
+	RetryAfter int    `json:"retryAfter,omitempty"`
+}
@@ -0,0 +1,153 @@
+// Package protocol defines the frames exchanged over /ws. Every command a
+// client can send and every event the server pushes has a payload type
+// here, which is also what the published schema is generated from.
+package protocol
+
+import (
+	"bytes"
+	"chat-app/internal/models"
+	"encoding/json"
+	"fmt"
+	"reflect"
+)
+
+// Version is the protocol version, negotiated through the
+// Sec-WebSocket-Protocol header as Subprotocol. Clients that don't ask for a
+// subprotocol get this version too.
+const (
+	Version     = 1
+	Subprotocol = "chat.v1"
+)
+
+// Negotiate returns the first of the subprotocols a client asked for, in
+// its order of preference, that the server speaks, or "" if none is
+func Negotiate(requested []string) string {
+	for _, p := range requested {
+		if _, ok := encodings[p]; ok {
+			return p
+		}
+	}
+	return ""
+}
+
+// Frame is a frame as read from a client, with the payload left undecoded
+type Frame struct {
+	Type      string          `json:"type"`
+	Payload   json.RawMessage `json:"payload,omitempty"`
+	RequestID string          `json:"requestId,omitempty"`
+}
+
+// Command describes a command clients can send
+type Command struct {
+	// Payload is a zero value of the payload type
+	Payload interface{}
+	// Result is a zero value of what the "ack" reply carries, or nil if it
+	// carries nothing
+	Result interface{}
+}
+
+// Commands are the commands clients can send, by frame type
+var Commands = map[string]Command{
+	"typing":       {Payload: TypingCommand{}},
+	"activity":     {Payload: ActivityCommand{}},
+	"set_presence": {Payload: models.SetPresenceRequest{}, Result: models.PresenceResponse{}},
+	"send_message": {Payload: SendMessageCommand{}, Result: models.Message{}},
+	"edit":         {Payload: EditMessageCommand{}, Result: models.Message{}},
+	"delete":       {Payload: DeleteMessageCommand{}},
+	"mark_read":    {Payload: MarkReadCommand{}},
+	"subscribe":    {Payload: SubscribeCommand{}, Result: SubscriptionsResult{}},
+	"unsubscribe":  {Payload: UnsubscribeCommand{}, Result: SubscriptionsResult{}},
+	"call_start":   {Payload: CallStartCommand{}, Result: models.Call{}},
+	"call_accept":  {Payload: CallAcceptCommand{}, Result: models.Call{}},
+	"call_decline": {Payload: CallDeclineCommand{}, Result: models.Call{}},
+	"call_end":     {Payload: CallEndCommand{}, Result: models.Call{}},
+	"call_signal":  {Payload: CallSignalCommand{}},
+}
+
+// Events are the frames the server sends, by frame type, with a zero value
+// of each payload type. The payload of "ack" depends on the command, see
+// Command.Result.
+var Events = map[string]interface{}{
+	"message":         models.Message{},
+	"message_edited":  models.Message{},
+	"message_deleted": MessageDeletedEvent{},
+	"chat_activity":   ChatActivityEvent{},
+	"messages_read":   MessagesReadEvent{},
+	"typing":          TypingEvent{},
+	"status":          StatusEvent{},
+	"profile_updated": models.PublicProfile{},
+	"warning":         WarningEvent{},
+	"call":            models.Call{},
+	"call_signal":     CallSignalEvent{},
+	"ack":             nil,
+	"error":           ErrorEvent{},
+	"resync":          ResyncEvent{},
+}
+
+// Error codes sent in error frames for frames that can't be handled
+const (
+	CodeMalformed      = "malformed_frame"
+	CodeUnknownType    = "unknown_type"
+	CodeInvalidPayload = "invalid_payload"
+)
+
+// Error is a frame the server rejected before running it
+type Error struct {
+	Code    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Decode parses a client frame and its payload. The payload is returned as
+// a value of the command's payload type. The frame is returned even when
+// decoding the payload fails so the error can echo its request ID.
+func Decode(data []byte) (Frame, interface{}, error) {
+	var frame Frame
+	if err := json.Unmarshal(data, &frame); err != nil {
+		return frame, nil, &Error{CodeMalformed, "Frame is not a valid JSON object"}
+	}
+	if frame.Type == "" {
+		return frame, nil, &Error{CodeMalformed, "Frame has no type"}
+	}
+
+	cmd, ok := Commands[frame.Type]
+	if !ok {
+		return frame, nil, &Error{CodeUnknownType, fmt.Sprintf("Unknown command %q", frame.Type)}
+	}
+
+	payload, err := decodePayload(frame.Payload, reflect.TypeOf(cmd.Payload))
+	return frame, payload, err
+}
+
+// decodePayload checks that every required field is present and no unknown
+// ones are, then decodes into a value of type t
+func decodePayload(raw json.RawMessage, t reflect.Type) (interface{}, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		raw = json.RawMessage("{}")
+	}
+
+	var present map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &present); err != nil {
+		return nil, &Error{CodeInvalidPayload, "Payload must be an object"}
+	}
+	for _, f := range structFields(t) {
+		if _, ok := present[f.name]; f.required && !ok {
+			return nil, &Error{CodeInvalidPayload, fmt.Sprintf("Missing field %q", f.name)}
+		}
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+	v := reflect.New(t)
+	if err := dec.Decode(v.Interface()); err != nil {
+		if typeErr, ok := err.(*json.UnmarshalTypeError); ok {
+			return nil, &Error{CodeInvalidPayload, fmt.Sprintf("Field %q has the wrong type", typeErr.Field)}
+		}
+		// Unknown fields and unparseable values such as bad timestamps
+		return nil, &Error{CodeInvalidPayload, "Invalid payload: " + err.Error()}
+	}
+	return v.Elem().Interface(), nil
+}
@@ -0,0 +1,127 @@
+package protocol
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Schema describes the protocol as JSON Schema fragments generated from the
+// payload types, so it can't drift from what the server accepts and sends
+func Schema() map[string]interface{} {
+	commands := make(map[string]interface{}, len(Commands))
+	for name, cmd := range Commands {
+		commands[name] = map[string]interface{}{
+			"payload": valueSchema(cmd.Payload),
+			"result":  valueSchema(cmd.Result),
+		}
+	}
+
+	events := make(map[string]interface{}, len(Events))
+	for name, payload := range Events {
+		events[name] = valueSchema(payload)
+	}
+
+	return map[string]interface{}{
+		"version":      Version,
+		"subprotocol":  Subprotocol,
+		"subprotocols": Subprotocols,
+		"frame":        typeSchema(reflect.TypeOf(Frame{})),
+		"commands":     commands,
+		"events":       events,
+	}
+}
+
+// valueSchema returns the schema of v's type, or nil for no payload
+func valueSchema(v interface{}) interface{} {
+	if v == nil {
+		return nil
+	}
+	return typeSchema(reflect.TypeOf(v))
+}
+
+var (
+	timeType       = reflect.TypeOf(time.Time{})
+	rawMessageType = reflect.TypeOf(json.RawMessage{})
+)
+
+func typeSchema(t reflect.Type) map[string]interface{} {
+	if t == timeType {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+	// json.RawMessage is a []byte holding any JSON value
+	if t == rawMessageType {
+		return map[string]interface{}{}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return typeSchema(t.Elem())
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": typeSchema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": typeSchema(t.Elem())}
+	case reflect.Struct:
+		properties := make(map[string]interface{})
+		required := []string{}
+		for _, f := range structFields(t) {
+			properties[f.name] = typeSchema(f.typ)
+			if f.required {
+				required = append(required, f.name)
+			}
+		}
+		return map[string]interface{}{
+			"type":                 "object",
+			"properties":           properties,
+			"required":             required,
+			"additionalProperties": false,
+		}
+	}
+	// interface{} accepts anything
+	return map[string]interface{}{}
+}
+
+type field struct {
+	name     string
+	typ      reflect.Type
+	required bool
+}
+
+// structFields lists the JSON fields of a struct type. Fields without
+// omitempty are required.
+func structFields(t reflect.Type) []field {
+	var fields []field
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		parts := strings.Split(tag, ",")
+		name := parts[0]
+		if name == "" {
+			name = f.Name
+		}
+		omitempty := false
+		for _, opt := range parts[1:] {
+			if opt == "omitempty" {
+				omitempty = true
+			}
+		}
+		fields = append(fields, field{name: name, typ: f.Type, required: !omitempty})
+	}
+	return fields
+}
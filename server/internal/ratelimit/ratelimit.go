@@ -0,0 +1,166 @@
+package ratelimit
+
+import (
+	"database/sql"
+	"log"
+	"sync"
+	"time"
+)
+
+// Store keeps token buckets. Take removes one token from the bucket for key,
+// refilling it at rate tokens per second up to burst, and returns how long
+// the caller must wait when the bucket is empty. Zero means allowed.
+type Store interface {
+	Take(key string, rate float64, burst int, now time.Time) (time.Duration, error)
+}
+
+var (
+	defaultStore Store = NewMemoryStore()
+	storeMutex         = &sync.RWMutex{}
+)
+
+// SetStore replaces the store used by Take, e.g. with a DatabaseStore so
+// limits hold across server instances
+func SetStore(s Store) {
+	storeMutex.Lock()
+	defer storeMutex.Unlock()
+	defaultStore = s
+}
+
+// Take removes a token from key's bucket in the configured store
+func Take(key string, rate float64, burst int) (time.Duration, error) {
+	storeMutex.RLock()
+	s := defaultStore
+	storeMutex.RUnlock()
+	return s.Take(key, rate, burst, time.Now())
+}
+
+// refill applies the token bucket algorithm to a bucket last updated at
+// updated, returning the new token count and the wait before the next token
+func refill(tokens float64, updated time.Time, rate float64, burst int, now time.Time) (float64, time.Duration) {
+	if elapsed := now.Sub(updated).Seconds(); elapsed > 0 {
+		tokens += elapsed * rate
+	}
+	if tokens > float64(burst) {
+		tokens = float64(burst)
+	}
+
+	if tokens >= 1 {
+		return tokens - 1, 0
+	}
+	if rate <= 0 {
+		return tokens, time.Hour
+	}
+	return tokens, time.Duration((1 - tokens) / rate * float64(time.Second))
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// MemoryStore keeps buckets in process memory
+type MemoryStore struct {
+	mutex       sync.Mutex
+	buckets     map[string]*bucket
+	lastCleanup time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{buckets: make(map[string]*bucket)}
+}
+
+func (s *MemoryStore) Take(key string, rate float64, burst int, now time.Time) (time.Duration, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(burst), updated: now}
+		s.buckets[key] = b
+	}
+
+	tokens, wait := refill(b.tokens, b.updated, rate, burst, now)
+	b.tokens = tokens
+	b.updated = now
+
+	// Buckets untouched for a while have refilled completely, so dropping
+	// them changes nothing
+	if now.Sub(s.lastCleanup) > time.Minute {
+		for k, old := range s.buckets {
+			if now.Sub(old.updated) > 10*time.Minute {
+				delete(s.buckets, k)
+			}
+		}
+		s.lastCleanup = now
+	}
+
+	return wait, nil
+}
+
+// DatabaseStore keeps buckets in the rate_limits table so every server
+// instance draws from the same bucket
+type DatabaseStore struct {
+	DB *sql.DB
+}
+
+func NewDatabaseStore(db *sql.DB) *DatabaseStore {
+	return &DatabaseStore{DB: db}
+}
+
+func (s *DatabaseStore) Take(key string, rate float64, burst int, now time.Time) (time.Duration, error) {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		INSERT IGNORE INTO rate_limits (bucket_key, tokens, updated_at) VALUES (?, ?, ?)
+	`, key, burst, now)
+	if err != nil {
+		return 0, err
+	}
+
+	var tokens float64
+	var updated time.Time
+	err = tx.QueryRow(`
+		SELECT tokens, updated_at FROM rate_limits WHERE bucket_key = ? FOR UPDATE
+	`, key).Scan(&tokens, &updated)
+	if err != nil {
+		return 0, err
+	}
+
+	tokens, wait := refill(tokens, updated, rate, burst, now)
+
+	_, err = tx.Exec(`
+		UPDATE rate_limits SET tokens = ?, updated_at = ? WHERE bucket_key = ?
+	`, tokens, now, key)
+	if err != nil {
+		return 0, err
+	}
+
+	return wait, tx.Commit()
+}
+
+// Cleanup deletes buckets not used since before, which are full anyway
+func (s *DatabaseStore) Cleanup(before time.Time) (int64, error) {
+	res, err := s.DB.Exec("DELETE FROM rate_limits WHERE updated_at < ?", before)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// StartCleanup deletes buckets idle for longer than interval, checking
+// every interval until the process exits
+func (s *DatabaseStore) StartCleanup(interval time.Duration) {
+	go func() {
+		for {
+			time.Sleep(interval)
+			if _, err := s.Cleanup(time.Now().Add(-interval)); err != nil {
+				log.Printf("Error deleting idle rate limit buckets: %v", err)
+			}
+		}
+	}()
+}
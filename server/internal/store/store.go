@@ -1,14 +1,299 @@
-
 package store
 
 import (
+	"chat-app/internal/config"
 	"chat-app/internal/models"
+	"sort"
 	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Priority decides what happens to a frame when a client can't keep up
+type Priority int
+
+const (
+	// PriorityNormal frames, such as chat messages, are never dropped. A
+	// client whose queue fills up is disconnected instead and catches up
+	// over the REST API when it reconnects.
+	PriorityNormal Priority = iota
+
+	// PriorityLow frames, such as typing and presence updates, are
+	// coalesced by key so only the latest one per key is sent. They are
+	// dropped if too many keys are waiting.
+	PriorityLow
+)
+
+// maxPendingLow bounds the coalesced low priority frames per connection
+const maxPendingLow = 256
+
+// Close reasons sent to the client in the close frame
+const (
+	closeReasonServer = "disconnected by server"
+	closeReasonSlow   = "too slow to keep up"
 )
 
 // WebSocket connections store
 type WebSocketConnection struct {
 	Send chan []byte
+	// ID tells the connection apart from the user's earlier and later
+	// ones, including those on other instances
+	ID string
+
+	done        chan struct{}
+	closeOnce   sync.Once
+	closeReason string
+
+	// sendMutex keeps Deliver from sending on Send once it is closed
+	sendMutex  sync.RWMutex
+	sendClosed bool
+
+	// mutex guards the coalesced low priority frames and the metrics
+	mutex        sync.Mutex
+	pending      map[string][]byte
+	pendingOrder []string
+	wake         chan struct{}
+	connectedAt  time.Time
+	slowSince    time.Time
+	queued       uint64
+	coalesced    uint64
+	dropped      uint64
+
+	// subscriptions are the chats the client wants every event of. It is
+	// nil until the client first subscribes or unsubscribes, and until then
+	// every chat counts as subscribed.
+	subMutex      sync.Mutex
+	subscriptions map[string]bool
+}
+
+func NewWebSocketConnection() *WebSocketConnection {
+	return &WebSocketConnection{
+		Send:        make(chan []byte, config.WebSocketSendBuffer),
+		ID:          uuid.New().String(),
+		done:        make(chan struct{}),
+		pending:     make(map[string][]byte),
+		wake:        make(chan struct{}, 1),
+		connectedAt: time.Now(),
+	}
+}
+
+// Close asks the connection's goroutines to shut the socket down. It is safe
+// to call more than once.
+func (c *WebSocketConnection) Close() {
+	c.closeWithReason(closeReasonServer)
+}
+
+func (c *WebSocketConnection) closeWithReason(reason string) {
+	c.closeOnce.Do(func() {
+		c.closeReason = reason
+		close(c.done)
+	})
+}
+
+// Done is closed once Close has been called
+func (c *WebSocketConnection) Done() <-chan struct{} {
+	return c.done
+}
+
+// CloseReason explains why the connection was closed. It is only set once
+// Done is closed.
+func (c *WebSocketConnection) CloseReason() string {
+	return c.closeReason
+}
+
+// Subscribe adds chats to the connection's subscriptions
+func (c *WebSocketConnection) Subscribe(chatIDs []string) {
+	c.subMutex.Lock()
+	defer c.subMutex.Unlock()
+
+	if c.subscriptions == nil {
+		c.subscriptions = make(map[string]bool)
+	}
+	for _, chatID := range chatIDs {
+		c.subscriptions[chatID] = true
+	}
+}
+
+// Unsubscribe removes chats from the connection's subscriptions
+func (c *WebSocketConnection) Unsubscribe(chatIDs []string) {
+	c.subMutex.Lock()
+	defer c.subMutex.Unlock()
+
+	if c.subscriptions == nil {
+		c.subscriptions = make(map[string]bool)
+	}
+	for _, chatID := range chatIDs {
+		delete(c.subscriptions, chatID)
+	}
+}
+
+// DropSubscription removes a chat the user has left. Unlike Unsubscribe it
+// leaves clients that never subscribed getting every event.
+func (c *WebSocketConnection) DropSubscription(chatID string) {
+	c.subMutex.Lock()
+	defer c.subMutex.Unlock()
+	delete(c.subscriptions, chatID)
+}
+
+// Subscriptions returns the chats the client subscribed to, sorted
+func (c *WebSocketConnection) Subscriptions() []string {
+	c.subMutex.Lock()
+	defer c.subMutex.Unlock()
+
+	chatIDs := make([]string, 0, len(c.subscriptions))
+	for chatID := range c.subscriptions {
+		chatIDs = append(chatIDs, chatID)
+	}
+	sort.Strings(chatIDs)
+	return chatIDs
+}
+
+// Subscribed reports whether the client gets every event of a chat, which
+// is the case for all chats until it first subscribes or unsubscribes
+func (c *WebSocketConnection) Subscribed(chatID string) bool {
+	c.subMutex.Lock()
+	defer c.subMutex.Unlock()
+	return c.subscriptions == nil || c.subscriptions[chatID]
+}
+
+// Deliver queues a frame for the write pump without waiting. Low priority
+// frames with a key replace any frame with the same key that hasn't been
+// written yet. It reports false if the frame was dropped.
+func (c *WebSocketConnection) Deliver(msg []byte, priority Priority, key string) bool {
+	if priority == PriorityLow && key != "" {
+		return c.deliverCoalesced(msg, key)
+	}
+
+	c.sendMutex.RLock()
+	defer c.sendMutex.RUnlock()
+	if c.sendClosed {
+		return false
+	}
+
+	select {
+	case c.Send <- msg:
+		c.mutex.Lock()
+		c.queued++
+		slow := c.checkSlow(time.Now())
+		c.mutex.Unlock()
+		if slow {
+			c.closeWithReason(closeReasonSlow)
+		}
+		return true
+	default:
+	}
+
+	c.mutex.Lock()
+	c.dropped++
+	c.mutex.Unlock()
+	if priority == PriorityNormal {
+		c.closeWithReason(closeReasonSlow)
+	}
+	return false
+}
+
+// TrySend queues a low priority frame that isn't coalesced, dropping it if
+// the queue is full
+func (c *WebSocketConnection) TrySend(msg []byte) bool {
+	return c.Deliver(msg, PriorityLow, "")
+}
+
+// checkSlow tracks how long the queue has been over half full and reports
+// whether that has gone on for longer than WebSocketSlowConsumerTimeout.
+// It is called with mutex held.
+func (c *WebSocketConnection) checkSlow(now time.Time) bool {
+	if len(c.Send) < cap(c.Send)/2 {
+		c.slowSince = time.Time{}
+		return false
+	}
+	if c.slowSince.IsZero() {
+		c.slowSince = now
+		return false
+	}
+	return now.Sub(c.slowSince) > config.WebSocketSlowConsumerTimeout
+}
+
+func (c *WebSocketConnection) deliverCoalesced(msg []byte, key string) bool {
+	select {
+	case <-c.done:
+		return false
+	default:
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if _, exists := c.pending[key]; exists {
+		c.coalesced++
+	} else if len(c.pendingOrder) >= maxPendingLow {
+		c.dropped++
+		return false
+	} else {
+		c.pendingOrder = append(c.pendingOrder, key)
+	}
+	c.pending[key] = msg
+
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// Pending signals that coalesced frames are waiting to be taken
+func (c *WebSocketConnection) Pending() <-chan struct{} {
+	return c.wake
+}
+
+// TakePending returns the coalesced frames in the order their keys were
+// first queued and clears them
+func (c *WebSocketConnection) TakePending() [][]byte {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	frames := make([][]byte, 0, len(c.pendingOrder))
+	for _, key := range c.pendingOrder {
+		frames = append(frames, c.pending[key])
+		delete(c.pending, key)
+	}
+	c.pendingOrder = c.pendingOrder[:0]
+	c.queued += uint64(len(frames))
+	return frames
+}
+
+// Stats returns the connection's queue metrics
+func (c *WebSocketConnection) Stats() models.ConnectionStats {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	stats := models.ConnectionStats{
+		ConnectedAt: c.connectedAt,
+		Queued:      len(c.Send),
+		Capacity:    cap(c.Send),
+		PendingLow:  len(c.pendingOrder),
+		Delivered:   c.queued,
+		Coalesced:   c.coalesced,
+		Dropped:     c.dropped,
+	}
+	if !c.slowSince.IsZero() {
+		slowSince := c.slowSince
+		stats.SlowSince = &slowSince
+	}
+	return stats
+}
+
+// CloseSend closes the connection and its Send channel once no Deliver is
+// in progress. It is safe to call more than once.
+func (c *WebSocketConnection) CloseSend() {
+	c.Close()
+
+	c.sendMutex.Lock()
+	defer c.sendMutex.Unlock()
+	if !c.sendClosed {
+		c.sendClosed = true
+		close(c.Send)
+	}
 }
 
 var (
@@ -17,16 +302,29 @@ var (
 	mutex       = &sync.RWMutex{}
 )
 
+// SetConnection stores the user's connection, closing any connection it
+// replaces
 func SetConnection(userID string, conn *WebSocketConnection) {
 	mutex.Lock()
-	defer mutex.Unlock()
+	previous, exists := connections[userID]
 	connections[userID] = conn
+	mutex.Unlock()
+
+	if exists && previous != conn {
+		previous.Close()
+	}
 }
 
-func RemoveConnection(userID string) {
+// RemoveConnection forgets conn if it is still the user's connection and
+// reports whether it was. A connection replaced by a newer one is left alone.
+func RemoveConnection(userID string, conn *WebSocketConnection) bool {
 	mutex.Lock()
 	defer mutex.Unlock()
+	if connections[userID] != conn {
+		return false
+	}
 	delete(connections, userID)
+	return true
 }
 
 func GetConnection(userID string) (*WebSocketConnection, bool) {
@@ -36,10 +334,24 @@ func GetConnection(userID string) (*WebSocketConnection, bool) {
 	return conn, exists
 }
 
+// Disconnect closes the user's WebSocket connection, if any
+func Disconnect(userID string) bool {
+	conn, exists := GetConnection(userID)
+	if exists {
+		conn.Close()
+	}
+	return exists
+}
+
 func GetAllConnections() map[string]*WebSocketConnection {
 	mutex.RLock()
 	defer mutex.RUnlock()
-	return connections
+	// Copy so callers can range over it without holding the lock
+	all := make(map[string]*WebSocketConnection, len(connections))
+	for userID, conn := range connections {
+		all[userID] = conn
+	}
+	return all
 }
 
 // User store functions
@@ -67,3 +379,19 @@ func GetUsers() map[string]models.User {
 	defer mutex.RUnlock()
 	return users
 }
+
+// GetConnectionStats returns queue metrics for every connection, ordered by
+// user ID
+func GetConnectionStats() []models.ConnectionStats {
+	all := GetAllConnections()
+	stats := make([]models.ConnectionStats, 0, len(all))
+	for userID, conn := range all {
+		s := conn.Stats()
+		s.UserID = userID
+		stats = append(stats, s)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].UserID < stats[j].UserID
+	})
+	return stats
+}
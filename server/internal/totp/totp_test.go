@@ -0,0 +1,129 @@
+package totp
+
+import (
+	"encoding/base32"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// rfcSecret is the SHA-1 key from the RFC 6238 test vectors
+var rfcSecret = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte("12345678901234567890"))
+
+func TestCode(t *testing.T) {
+	// RFC 6238 appendix B, truncated to six digits
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		got, err := Code(rfcSecret, Step(time.Unix(tt.unix, 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("Code at %d = %s, want %s", tt.unix, got, tt.want)
+		}
+	}
+
+	if _, err := Code("not base32!", 1); err == nil {
+		t.Error("Code accepted an invalid secret")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	step := Step(now)
+
+	for offset := int64(-Skew); offset <= Skew; offset++ {
+		code, _ := Code(rfcSecret, step+offset)
+		got, ok := Validate(rfcSecret, code, now)
+		if !ok || got != step+offset {
+			t.Errorf("Validate(code of step %+d) = %d, %v; want %d, true", offset, got, ok, step+offset)
+		}
+	}
+
+	for _, offset := range []int64{-Skew - 1, Skew + 1} {
+		code, _ := Code(rfcSecret, step+offset)
+		if _, ok := Validate(rfcSecret, code, now); ok {
+			t.Errorf("Validate accepted the code of step %+d", offset)
+		}
+	}
+
+	code, _ := Code(rfcSecret, step)
+	if _, ok := Validate(rfcSecret, " "+code+"\n", now); !ok {
+		t.Error("Validate rejected a code with surrounding whitespace")
+	}
+	for _, bad := range []string{"", "12345", "1234567", code[:5] + "x"} {
+		if _, ok := Validate(rfcSecret, bad, now); ok {
+			t.Errorf("Validate accepted %q", bad)
+		}
+	}
+}
+
+func TestValidateAfterRejectsReplay(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	step := Step(now)
+	code, _ := Code(rfcSecret, step)
+
+	used, ok := ValidateAfter(rfcSecret, code, now, 0)
+	if !ok || used != step {
+		t.Fatalf("first use = %d, %v; want %d, true", used, ok, step)
+	}
+
+	// The same code stays within the skew window for another period but
+	// must not be accepted again
+	for _, later := range []time.Time{now, now.Add(Period * time.Second)} {
+		if _, ok := ValidateAfter(rfcSecret, code, later, used); ok {
+			t.Errorf("code accepted again at %v", later)
+		}
+	}
+
+	// An earlier code that is still within the window is refused too,
+	// since it is older than the one already used
+	earlier, _ := Code(rfcSecret, step-1)
+	if _, ok := ValidateAfter(rfcSecret, earlier, now, used); ok {
+		t.Error("a code from an earlier step was accepted after a later one")
+	}
+
+	// The next period's code works
+	next, _ := Code(rfcSecret, step+1)
+	if got, ok := ValidateAfter(rfcSecret, next, now.Add(Period*time.Second), used); !ok || got != step+1 {
+		t.Errorf("next code = %d, %v; want %d, true", got, ok, step+1)
+	}
+}
+
+func TestGenerateSecret(t *testing.T) {
+	a, err := GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := GenerateSecret()
+	if a == b {
+		t.Error("two generated secrets are identical")
+	}
+	if _, err := Code(a, 1); err != nil {
+		t.Errorf("generated secret is unusable: %v", err)
+	}
+}
+
+func TestProvisioningURI(t *testing.T) {
+	u, err := url.Parse(ProvisioningURI("Chat App", "user@example.com", "SECRET"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+	if u.Scheme != "otpauth" || u.Host != "totp" || u.Path != "/Chat App:user@example.com" {
+		t.Errorf("URI = %s", u)
+	}
+	if q.Get("secret") != "SECRET" || q.Get("issuer") != "Chat App" || q.Get("digits") != "6" || q.Get("period") != "30" {
+		t.Errorf("query = %v", q)
+	}
+}
@@ -0,0 +1,96 @@
+// Package typing tracks who is typing in which chat on this server, so that
+// typing events can be throttled and ended for clients that go quiet.
+package typing
+
+import (
+	"chat-app/internal/config"
+	"sync"
+	"time"
+)
+
+// Indicator is one user typing in one chat
+type Indicator struct {
+	UserID string
+	ChatID string
+}
+
+type entry struct {
+	// lastSent is when others were last told the user is typing
+	lastSent time.Time
+	// lastSeen is when the client last said the user is typing
+	lastSeen time.Time
+}
+
+var (
+	entries = make(map[Indicator]*entry)
+	mutex   = &sync.Mutex{}
+)
+
+// Start records that a user is typing and reports whether others should be
+// told. Repeats within config.TypingThrottleInterval of the last event sent
+// only keep the indicator alive.
+func Start(userID, chatID string) bool {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	now := time.Now()
+	key := Indicator{userID, chatID}
+	e, ok := entries[key]
+	if !ok {
+		entries[key] = &entry{lastSent: now, lastSeen: now}
+		return true
+	}
+	e.lastSeen = now
+	if now.Sub(e.lastSent) < config.TypingThrottleInterval {
+		return false
+	}
+	e.lastSent = now
+	return true
+}
+
+// Stop records that a user stopped typing and reports whether others had
+// been told they were
+func Stop(userID, chatID string) bool {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	key := Indicator{userID, chatID}
+	if _, ok := entries[key]; !ok {
+		return false
+	}
+	delete(entries, key)
+	return true
+}
+
+// StopAll ends every indicator of a user, e.g. when they disconnect, and
+// returns the chats they were typing in
+func StopAll(userID string) []string {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	var chatIDs []string
+	for key := range entries {
+		if key.UserID == userID {
+			chatIDs = append(chatIDs, key.ChatID)
+			delete(entries, key)
+		}
+	}
+	return chatIDs
+}
+
+// Sweep ends indicators the client hasn't renewed within
+// config.TypingTimeout and returns them
+func Sweep() []Indicator {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	now := time.Now()
+	var expired []Indicator
+	for key, e := range entries {
+		if now.Sub(e.lastSeen) >= config.TypingTimeout {
+			expired = append(expired, key)
+			delete(entries, key)
+		}
+	}
+	return expired
+}
@@ -2,13 +2,18 @@
 package main
 
 import (
+	"chat-app/internal/accounts"
 	"chat-app/internal/config"
 	"chat-app/internal/handlers"
 	authmdw "chat-app/internal/middleware"
+	"chat-app/internal/oidc"
+	"chat-app/internal/ratelimit"
 
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
@@ -16,10 +21,62 @@ import (
 )
 
 func main() {
+	// Without a subcommand the binary starts the server, as it always has
+	args := os.Args[1:]
+	if len(args) == 0 {
+		args = []string{"serve"}
+	}
+
+	if err := runCommand(args); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// serve starts the HTTP server
+func serve(port int) {
 	// Initialize database connection
 	config.InitDB()
 	defer config.DB.Close()
 
+	// Initialize failed login tracking
+	handlers.InitLoginGuard()
+
+	// Connect to the broker other instances share
+	if err := handlers.InitBroker(); err != nil {
+		log.Fatal("Error connecting to broker:", err)
+	}
+
+	// Build the message filter pipeline
+	if err := handlers.InitMessageFilters(); err != nil {
+		log.Fatal("Invalid message filter configuration:", err)
+	}
+
+	// Move inactive users to idle or away and expire custom statuses
+	handlers.StartPresenceSweeper()
+
+	// End typing indicators clients stopped renewing
+	handlers.StartTypingSweeper()
+
+	// Mark calls nobody answered as missed
+	handlers.StartCallSweeper()
+
+	// Delete accounts whose deletion grace period has run out
+	handlers.StartAccountDeletions(time.Hour)
+
+	// Share rate limits between instances through the database if
+	// configured, deleting idle buckets so the table doesn't keep growing
+	if config.RateLimitStore == "database" {
+		rateLimitStore := ratelimit.NewDatabaseStore(config.DB)
+		ratelimit.SetStore(rateLimitStore)
+		rateLimitStore.StartCleanup(10 * time.Minute)
+	}
+
+	// Keep pending single sign-ins where any instance can complete them
+	if config.OIDCStateStore == "database" {
+		oidc.SetStateStore(oidc.NewDatabaseStateStore(config.DB))
+	}
+
 	r := chi.NewRouter()
 
 	// Standard middlewares.
@@ -29,39 +86,125 @@ func main() {
 	// CORS middleware
 	r.Use(cors.Handler(cors.Options{
 		AllowedOrigins:   []string{"*"},
-		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
+		AllowedMethods:   []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
 		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token"},
 		ExposedHeaders:   []string{"Link"},
 		AllowCredentials: true,
 		MaxAge:           300,
 	}))
 
+	// Uploaded avatars
+	r.Get("/avatars/*", handlers.ServeAvatar)
+
+	// WebSocket protocol description for client developers
+	r.Get("/api/ws/schema", handlers.GetProtocolSchema)
+
 	// Public routes
 	r.Group(func(r chi.Router) {
+		r.Use(authmdw.RateLimit("auth", config.AuthRateLimit))
+
 		r.Post("/api/auth/register", handlers.Register)
+		r.Post("/api/auth/email/verify", handlers.VerifyEmail)
 		r.Post("/api/auth/login", handlers.Login)
+		r.Post("/api/auth/2fa/verify", handlers.VerifyTwoFactor)
+
+		// Single sign-on
+		r.Get("/api/auth/oidc/providers", handlers.GetOIDCProviders)
+		r.Get("/api/auth/oidc/{provider}/login", handlers.OIDCLogin)
+		r.Get("/api/auth/oidc/{provider}/callback", handlers.OIDCCallback)
 	})
 
 	// Protected routes
 	r.Group(func(r chi.Router) {
 		r.Use(authmdw.Auth)
+		r.Use(authmdw.RateLimit("api", config.APIRateLimit))
 
 		// WebSocket endpoint needs to be defined before other routes
 		r.Get("/ws", handlers.HandleWebSocket)
 
+		// The same events for clients that can't open a WebSocket
+		r.Get("/api/events", handlers.StreamEvents)
+		r.Get("/api/events/poll", handlers.PollEvents)
+
+		// Two-factor authentication management
+		r.Post("/api/auth/2fa/enroll", handlers.EnrollTwoFactor)
+		r.Post("/api/auth/2fa/confirm", handlers.ConfirmTwoFactor)
+		r.Post("/api/auth/2fa/disable", handlers.DisableTwoFactor)
+
+		// Linking single sign-on identities to an existing account
+		r.Post("/api/auth/oidc/{provider}/link", handlers.LinkOIDCIdentity)
+		r.Delete("/api/auth/oidc/{provider}/link", handlers.UnlinkOIDCIdentity)
+
 		// Chat routes
 		r.Get("/api/chats", handlers.GetChats)
 		r.Post("/api/chats", handlers.CreateChat)
 		r.Route("/api/chats/{id}", func(r chi.Router) {
 			r.Get("/messages", handlers.GetMessages)
-			r.Post("/messages", handlers.SendMessage)
+			r.With(authmdw.RateLimit("messages", config.MessageRateLimit)).Post("/messages", handlers.SendMessage)
+			r.Patch("/messages/{messageId}", handlers.EditMessage)
+			r.Delete("/messages/{messageId}", handlers.DeleteMessage)
+			r.Post("/messages/{messageId}/report", handlers.ReportMessage)
+			r.Post("/read", handlers.MarkChatRead)
 		})
 
+		// Calls are signalled over /ws
+		r.Get("/api/calls/ice-servers", handlers.GetICEServers)
+		r.Get("/api/calls/{id}", handlers.GetCall)
+
+		// Current user's account and profile
+		r.Get("/api/me", handlers.GetProfile)
+		r.Patch("/api/me", handlers.UpdateProfile)
+		r.Post("/api/me/avatar", handlers.UploadAvatar)
+		r.Delete("/api/me/avatar", handlers.DeleteAvatar)
+		r.Post("/api/me/email", handlers.ChangeEmail)
+		r.Put("/api/me/presence", handlers.SetPresence)
+		r.Delete("/api/me", handlers.DeleteAccount)
+		r.Post("/api/me/restore", handlers.RestoreAccount)
+		r.Get("/api/me/export", handlers.ExportAccount)
+
 		// Add new users route
 		r.Get("/api/users", handlers.GetUsers)
+
+		// Blocking
+		r.Get("/api/users/blocked", handlers.GetBlockedUsers)
+		r.Post("/api/users/{id}/block", handlers.BlockUser)
+		r.Delete("/api/users/{id}/block", handlers.UnblockUser)
+
+		// Admin routes
+		r.Route("/api/admin", func(r chi.Router) {
+			r.Use(authmdw.RequireRole(accounts.RoleAdmin))
+
+			r.Get("/users", handlers.AdminListUsers)
+			r.Put("/users/{id}/role", handlers.AdminSetRole)
+			r.Post("/users/{id}/suspend", handlers.AdminSuspendUser)
+			r.Post("/users/{id}/unsuspend", handlers.AdminUnsuspendUser)
+			r.Post("/users/{id}/unlock", handlers.AdminUnlockLogin)
+			r.Delete("/users/{id}", handlers.AdminDeleteUser)
+
+			r.Get("/chats", handlers.AdminListChats)
+
+			r.Get("/connections", handlers.AdminListConnections)
+			r.Get("/connections/stats", handlers.AdminConnectionStats)
+			r.Delete("/connections/{userId}", handlers.AdminDisconnect)
+
+			r.Get("/audit", handlers.GetAuditLog)
+			r.Get("/audit/verify", handlers.VerifyAuditLog)
+		})
+
+		// Moderation queue
+		r.Route("/api/moderation", func(r chi.Router) {
+			r.Use(authmdw.RequireRole(accounts.RoleModerator, accounts.RoleAdmin))
+
+			r.Get("/reports", handlers.GetReports)
+			r.Get("/reports/{reportId}", handlers.GetReport)
+			r.Post("/reports/{reportId}/actions", handlers.TakeModerationAction)
+			r.Get("/actions", handlers.GetModerationActions)
+
+			r.Get("/chats/{id}/filters", handlers.GetChatFilters)
+			r.Put("/chats/{id}/filters", handlers.UpdateChatFilters)
+		})
 	})
 
-	port := 8000
 	fmt.Printf("Server running on http://localhost:%d\n", port)
 	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", port), r))
 }